@@ -0,0 +1,817 @@
+package npm
+
+// the module cache keeps downloaded tarballs, git mirrors and the checkouts
+// exported from them between installs. Entries have a sidecar in .meta
+// recording where they came from, when they were last used and, for
+// tarballs, their hash, so that they can be listed, checked, collected and
+// evicted later.
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheDir is where downloads are kept between installs
+var CacheDir = ".module-cache"
+
+const cacheMetaDir = ".meta"
+
+// the kinds of cache entries
+const (
+	CacheTarball  = "tarball"
+	CacheMirror   = "git"
+	CacheCheckout = "checkout"
+	CacheBuild    = "build"
+)
+
+// CacheEntry is a tarball, git mirror or checkout in the cache
+type CacheEntry struct {
+	Kind    string
+	Name    string // slash-separated, relative to the cache
+	Url     string
+	Size    int64
+	Fetched time.Time
+	Used    time.Time
+}
+
+type cacheMeta struct {
+	Url       string    `json:"url"`
+	Integrity string    `json:"integrity"`
+	Size      int64     `json:"size"`
+	Fetched   time.Time `json:"fetched"`
+	Used      time.Time `json:"used"`
+}
+
+func cacheMetaPath(cacheDir string, name string) string {
+	return filepath.Join(cacheDir, cacheMetaDir, filepath.FromSlash(name)+".json")
+}
+
+func readCacheMeta(cacheDir string, name string) (meta cacheMeta, err error) {
+	content, err := ioutil.ReadFile(cacheMetaPath(cacheDir, name))
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(content, &meta)
+	return
+}
+
+func writeCacheMeta(cacheDir string, name string, meta cacheMeta) (err error) {
+	content, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return
+	}
+
+	target := cacheMetaPath(cacheDir, name)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return
+	}
+
+	return writeFileAtomic(target, content)
+}
+
+// integrity formats a sha512 sum the way lockfiles do
+func integrity(sum []byte) string {
+	return "sha512-" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// ListCache lists what's in the cache at cacheDir
+func ListCache(cacheDir string) (entries []CacheEntry, err error) {
+	names, err := readDirNames(cacheDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		full := filepath.Join(cacheDir, name)
+		info, err := os.Lstat(full)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case strings.HasPrefix(name, "."):
+			// metadata and locks
+		case name == "git" && info.IsDir():
+			mirrors, err := listMirrors(full)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, mirrors...)
+		case name == "git-build" && info.IsDir():
+			entries = append(entries, dirEntry(CacheBuild, name, full, info))
+		case strings.HasPrefix(name, "@") && info.IsDir():
+			// the checkouts of scoped packages
+			scoped, err := readDirNames(full)
+			if err != nil {
+				return nil, err
+			}
+			for _, checkout := range scoped {
+				entry, err := checkoutEntry(cacheDir, name+"/"+checkout)
+				if err != nil {
+					return nil, err
+				}
+				if entry.Kind != "" {
+					entries = append(entries, entry)
+				}
+			}
+		case info.IsDir():
+			entry, err := checkoutEntry(cacheDir, name)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case strings.HasSuffix(name, ".tgz") && isDir(filepath.Join(cacheDir, strings.TrimSuffix(name, ".tgz"))):
+			// the packed checkout, counted with it
+		case strings.HasSuffix(name, ".partial"):
+			// still downloading
+		default:
+			entries = append(entries, CacheEntry{Kind: CacheTarball, Name: name, Size: info.Size(), Fetched: info.ModTime()})
+		}
+	}
+
+	for i := range entries {
+		entry := &entries[i]
+		if meta, err := readCacheMeta(cacheDir, entry.Name); err == nil {
+			if meta.Url != "" {
+				entry.Url = meta.Url
+			}
+			if !meta.Fetched.IsZero() && entry.Kind == CacheTarball {
+				entry.Fetched = meta.Fetched
+			}
+			entry.Used = meta.Used
+		}
+		if entry.Used.IsZero() {
+			entry.Used = entry.Fetched
+		}
+	}
+
+	return
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// checkoutEntry describes the checkout at name, along with its packed
+// tarball; checkouts are exported again on every install, so they're as old
+// as their last install
+func checkoutEntry(cacheDir string, name string) (entry CacheEntry, err error) {
+	full := filepath.Join(cacheDir, filepath.FromSlash(name))
+	info, err := os.Lstat(full)
+	if err != nil || !info.IsDir() {
+		return
+	}
+
+	entry = dirEntry(CacheCheckout, name, full, info)
+	if packed, err := os.Stat(full + ".tgz"); err == nil {
+		entry.Size += packed.Size()
+	}
+
+	return
+}
+
+func dirEntry(kind string, name string, full string, info os.FileInfo) CacheEntry {
+	return CacheEntry{Kind: kind, Name: name, Size: dirSize(full), Fetched: info.ModTime()}
+}
+
+func listMirrors(gitDir string) (entries []CacheEntry, err error) {
+	names, err := readDirNames(gitDir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		full := filepath.Join(gitDir, name)
+		info, err := os.Stat(full)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			continue
+		}
+
+		entry := dirEntry(CacheMirror, "git/"+name, full, info)
+		entry.Url = mirrorUrl(full)
+		// fetches add packs
+		if packs, err := os.Stat(filepath.Join(full, "objects", "pack")); err == nil {
+			entry.Fetched = packs.ModTime()
+		}
+		entries = append(entries, entry)
+	}
+
+	return
+}
+
+// mirrorUrl reads the URL of origin from a mirror's config
+func mirrorUrl(mirror string) string {
+	f, err := os.Open(filepath.Join(mirror, "config"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if section == `[remote "origin"]` && eq >= 0 && strings.TrimSpace(line[:eq]) == "url" {
+			return strings.TrimSpace(line[eq+1:])
+		}
+	}
+
+	return ""
+}
+
+func dirSize(dir string) (size int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return
+}
+
+// removeCacheEntry deletes an entry, along with its metadata and, for
+// checkouts, its packed tarball
+func removeCacheEntry(cacheDir string, entry CacheEntry) (err error) {
+	full := filepath.Join(cacheDir, filepath.FromSlash(entry.Name))
+	err = os.RemoveAll(full)
+	if err != nil {
+		return
+	}
+
+	if entry.Kind == CacheCheckout {
+		os.Remove(full + ".tgz")
+	}
+
+	err = os.Remove(cacheMetaPath(cacheDir, entry.Name))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return
+}
+
+// PrintCache lists cache entries with their size, age, when they were last
+// used and their source
+func PrintCache(entries []CacheEntry) {
+	var total int64
+	fmt.Printf("%-8s  %9s  %5s  %5s  %s\n", "KIND", "SIZE", "AGE", "USED", "NAME")
+	for _, entry := range entries {
+		fmt.Printf("%-8s  %9s  %5s  %5s  %s", entry.Kind, formatSize(entry.Size), formatAge(time.Since(entry.Fetched)), formatAge(time.Since(entry.Used)), entry.Name)
+		if entry.Url != "" {
+			fmt.Printf("  %s", entry.Url)
+		}
+		fmt.Println()
+		total += entry.Size
+	}
+	fmt.Printf("%d entries, %s\n", len(entries), formatSize(total))
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size) / unit
+	units := "KMGT"
+	i := 0
+	for value >= unit && i < len(units)-1 {
+		value /= unit
+		i++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, units[i])
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age/time.Minute))
+	case age < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(age/time.Hour))
+	}
+
+	return fmt.Sprintf("%dd", int(age/(24*time.Hour)))
+}
+
+// VerifyCache re-hashes every tarball in the cache against its metadata,
+// and checks that every mirror has the commits its refs point to, removing
+// those that don't check out. Tarballs without metadata are checked by
+// reading them, then recorded.
+func VerifyCache(cacheDir string) (err error) {
+	unlock, err := LockCache(cacheDir, true)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	entries, err := ListCache(cacheDir)
+	if err != nil {
+		return
+	}
+
+	checked, removed := 0, 0
+	for _, entry := range entries {
+		var verifyErr error
+		switch entry.Kind {
+		case CacheTarball:
+			verifyErr = verifyTarball(cacheDir, entry)
+		case CacheMirror:
+			verifyErr = verifyMirror(filepath.Join(cacheDir, filepath.FromSlash(entry.Name)))
+		default:
+			// exported again on every install
+			continue
+		}
+		checked++
+
+		if verifyErr == nil {
+			continue
+		}
+
+		fmt.Printf("removing %s: %v\n", entry.Name, verifyErr)
+		err = removeCacheEntry(cacheDir, entry)
+		if err != nil {
+			return
+		}
+		removed++
+	}
+
+	err = pruneCacheMeta(cacheDir)
+	fmt.Printf("verified %d entries, removed %d\n", checked, removed)
+	return
+}
+
+func verifyTarball(cacheDir string, entry CacheEntry) (err error) {
+	full := filepath.Join(cacheDir, filepath.FromSlash(entry.Name))
+	meta, metaErr := readCacheMeta(cacheDir, entry.Name)
+	if metaErr != nil || meta.Integrity == "" {
+		sum, size, err := readTarball(full)
+		if err != nil {
+			return err
+		}
+
+		meta.Integrity, meta.Size = sum, size
+		if meta.Fetched.IsZero() {
+			meta.Fetched = entry.Fetched
+		}
+		return writeCacheMeta(cacheDir, entry.Name, meta)
+	}
+
+	f, err := os.Open(full)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	hash := sha512.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return
+	}
+
+	if sum := integrity(hash.Sum(nil)); sum != meta.Integrity || size != meta.Size {
+		return fmt.Errorf("%d bytes with %s, expected %d bytes with %s", size, sum, meta.Size, meta.Integrity)
+	}
+
+	return
+}
+
+// readTarball reads every file in a gzipped tarball, returning the hash and
+// size of the tarball
+func readTarball(archive string) (sum string, size int64, err error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	hash := sha512.New()
+	counter := &countingWriter{}
+	gz, err := gzip.NewReader(io.TeeReader(f, io.MultiWriter(hash, counter)))
+	if err != nil {
+		return
+	}
+
+	tarReader := tar.NewReader(gz)
+	for {
+		_, err = tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		_, err = io.Copy(ioutil.Discard, tarReader)
+		if err != nil {
+			return
+		}
+	}
+
+	// anything after the end of the archive
+	_, err = io.Copy(ioutil.Discard, gz)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(io.MultiWriter(hash, counter), f)
+
+	return integrity(hash.Sum(nil)), counter.n, err
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// verifyMirror reads the commit and root tree every ref of a mirror points to
+func verifyMirror(mirror string) (err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	refs, err := repo.refs()
+	if err != nil {
+		return
+	}
+
+	for name, sha := range refs {
+		commit, err := repo.peel(sha)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		tree, err := repo.commitTree(commit)
+		if err == nil {
+			_, err = repo.read(tree)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	return
+}
+
+// pruneCacheMeta removes the metadata of tarballs that are gone
+func pruneCacheMeta(cacheDir string) (err error) {
+	metaDir := filepath.Join(cacheDir, cacheMetaDir)
+	err = filepath.Walk(metaDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(path, ".json") {
+			return err
+		}
+
+		rel, err := filepath.Rel(metaDir, strings.TrimSuffix(path, ".json"))
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(cacheDir, rel)); os.IsNotExist(err) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	return
+}
+
+// CleanCache empties the cache or, given package names, removes their
+// tarballs and git checkouts
+func CleanCache(cacheDir string, packages []string) (err error) {
+	unlock, err := LockCache(cacheDir, true)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	clean := make(map[string]bool)
+	for _, name := range packages {
+		clean[name] = true
+	}
+
+	entries, err := ListCache(cacheDir)
+	if err != nil {
+		return
+	}
+
+	var removed []CacheEntry
+	for _, entry := range entries {
+		if len(packages) > 0 && !clean[entry.packageName()] {
+			continue
+		}
+
+		err = removeCacheEntry(cacheDir, entry)
+		if err != nil {
+			return
+		}
+		removed = append(removed, entry)
+	}
+
+	if len(packages) == 0 {
+		// the lock on the cache itself stays, for those waiting on it
+		for _, dir := range []string{cacheMetaDir, cacheLockDir} {
+			err = os.RemoveAll(filepath.Join(cacheDir, dir))
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	printRemoved(removed)
+	return
+}
+
+// registry tarballs are at <registry>/<name>/-/<name>-<version>.tgz
+var tarballVersionRe = regexp.MustCompile(`-\d+\.\d+\.\d+[^/]*\.t(ar\.)?gz$`)
+
+// packageName guesses the package a tarball or checkout is of
+func (entry CacheEntry) packageName() string {
+	switch entry.Kind {
+	case CacheCheckout:
+		if cut := strings.LastIndex(entry.Name, "__"); cut >= 0 {
+			return entry.Name[:cut]
+		}
+	case CacheTarball:
+		if u, err := url.Parse(entry.Url); err == nil && strings.Contains(u.Path, "/-/") {
+			name := u.Path[:strings.Index(u.Path, "/-/")]
+			name = strings.Replace(name, "%2f", "/", -1)
+			name = strings.Replace(name, "%2F", "/", -1)
+
+			segments := strings.Split(name, "/")
+			last := len(segments) - 1
+			if last > 0 && strings.HasPrefix(segments[last-1], "@") {
+				return segments[last-1] + "/" + segments[last]
+			}
+			return segments[last]
+		}
+
+		return tarballVersionRe.ReplaceAllString(entry.Name, "")
+	}
+
+	return ""
+}
+
+// GCCache removes the entries that none of lockfiles need, if any are
+// given, and those fetched before cutoff, unless it's zero
+func GCCache(cacheDir string, lockfiles []string, cutoff time.Time) (err error) {
+	if len(lockfiles) == 0 && cutoff.IsZero() {
+		return fmt.Errorf("unwrap: cache gc needs lockfiles to keep entries for, or a cutoff")
+	}
+
+	unlock, err := LockCache(cacheDir, true)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	keep := make(map[string]bool)
+	for _, lockfile := range lockfiles {
+		app, err := LoadLockfile(lockfile)
+		if err != nil {
+			return fmt.Errorf("unwrap: %s: %v", lockfile, err)
+		}
+		keepForApp(cacheDir, app, keep)
+	}
+
+	entries, err := ListCache(cacheDir)
+	if err != nil {
+		return
+	}
+
+	var removed []CacheEntry
+	for _, entry := range entries {
+		unused := len(lockfiles) > 0 && !keep[entry.Name]
+		stale := !cutoff.IsZero() && entry.Fetched.Before(cutoff)
+		if !unused && !stale {
+			continue
+		}
+
+		err = removeCacheEntry(cacheDir, entry)
+		if err != nil {
+			return
+		}
+		removed = append(removed, entry)
+	}
+
+	err = pruneCacheMeta(cacheDir)
+	printRemoved(removed)
+	return
+}
+
+func printRemoved(removed []CacheEntry) {
+	var freed int64
+	for _, entry := range removed {
+		fmt.Printf("removed %s\n", entry.Name)
+		freed += entry.Size
+	}
+	fmt.Printf("removed %d entries, freeing %s\n", len(removed), formatSize(freed))
+}
+
+// keepForApp marks the cache entries installing app uses
+func keepForApp(cacheDir string, app App, keep map[string]bool) {
+	packages := []Package{app}
+	for _, ws := range app.Workspaces {
+		packages = append(packages, ws)
+	}
+	if app.Graph != nil {
+		packages = append(packages, app.Graph)
+	}
+
+	for _, pkg := range packages {
+		keepForPackage(cacheDir, pkg, keep)
+	}
+}
+
+func keepForPackage(cacheDir string, pkg Package, keep map[string]bool) {
+	for _, dep := range pkg.DependencyList() {
+		if _, _, isLocal := dep.LocalSpec(); isLocal || dep.Bundled {
+			// not downloaded
+		} else if gitUrl, isGit := dep.GitSpec(); isGit {
+			mirror := gitMirrorDir("", gitUrl.Url)
+			keep[filepath.ToSlash(mirror)] = true
+
+			checkout := gitUrl.dirName(dep.Name)
+			keep[checkout] = true
+			keepSubmoduleMirrors(filepath.Join(cacheDir, checkout), gitUrl.Url, keep, 0)
+		} else if dep.Resolved != "" {
+			keep[path.Base(dep.Resolved)] = true
+		} else {
+			// what npm view is likely to resolve it to
+			keep[path.Base(dep.Name)+"-"+dep.Version+".tgz"] = true
+		}
+
+		keepForPackage(cacheDir, dep, keep)
+	}
+}
+
+// keepSubmoduleMirrors marks the mirrors of the submodules in a checkout,
+// which was exported from the remote at url
+func keepSubmoduleMirrors(dir string, url string, keep map[string]bool, depth int) {
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".gitmodules"))
+	if err != nil || depth >= maxSubmoduleDepth {
+		return
+	}
+
+	paths := make([]string, 0)
+	urls := parseGitmodules(content)
+	for subPath := range urls {
+		paths = append(paths, subPath)
+	}
+	sort.Strings(paths)
+
+	for _, subPath := range paths {
+		subUrl := submoduleUrl(url, urls[subPath])
+		keep[filepath.ToSlash(gitMirrorDir("", subUrl))] = true
+		keepSubmoduleMirrors(filepath.Join(dir, filepath.FromSlash(subPath)), subUrl, keep, depth+1)
+	}
+}
+
+// recordDownload writes the metadata of a tarball just downloaded to the
+// cache; without it, the tarball can't be verified later
+func recordDownload(cacheDir string, name string, tarUrl string, sum []byte, size int64) {
+	now := time.Now()
+	meta := cacheMeta{Url: tarUrl, Integrity: integrity(sum), Size: size, Fetched: now, Used: now}
+	err := writeCacheMeta(cacheDir, name, meta)
+	if err != nil {
+		log.Printf("[WARN] could not record %s in the cache: %v\n", name, err)
+	}
+}
+
+// touchCacheEntry records that an install used the entry name, fetched from
+// url. Filesystems often don't track access times, or only roughly, so
+// they're kept in the entry's metadata instead. Callers hold the entry's
+// lock.
+func touchCacheEntry(cacheDir string, name string, url string) {
+	meta, err := readCacheMeta(cacheDir, name)
+	if err != nil {
+		meta = cacheMeta{}
+	}
+	if meta.Url == "" {
+		meta.Url = url
+	}
+
+	meta.Used = time.Now()
+	if meta.Fetched.IsZero() {
+		meta.Fetched = meta.Used
+	}
+
+	err = writeCacheMeta(cacheDir, name, meta)
+	if err != nil {
+		log.Printf("[WARN] could not record %s in the cache: %v\n", name, err)
+	}
+}
+
+// EvictCache removes the least recently used entries in the cache until it
+// takes up no more than maxSize bytes. Entries in use by other installs
+// aren't touched: if any are running, nothing is evicted.
+func EvictCache(cacheDir string, maxSize int64) (err error) {
+	unlock, err := openLock(filepath.Join(cacheDir, cacheLockFile), true, false)
+	if err == errLocked {
+		log.Printf("[WARN] not evicting from %s: another install is using it\n", cacheDir)
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	entries, err := ListCache(cacheDir)
+	if err != nil {
+		return
+	}
+
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+	if total <= maxSize {
+		return
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Used.Before(entries[j].Used)
+	})
+
+	var evicted []CacheEntry
+	for _, entry := range entries {
+		if total <= maxSize {
+			break
+		}
+
+		err = removeCacheEntry(cacheDir, entry)
+		if err != nil {
+			return
+		}
+		evicted = append(evicted, entry)
+		total -= entry.Size
+	}
+
+	var freed int64
+	for _, entry := range evicted {
+		freed += entry.Size
+	}
+	fmt.Printf("evicted %d cache entries, freeing %s; %s is now %s\n", len(evicted), formatSize(freed), cacheDir, formatSize(total))
+	return
+}
+
+var sizeRe = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMGT]?)(?:I?B)?$`)
+
+// ParseSize reads a size like 500M or 10GB, in powers of 1024
+func ParseSize(s string) (size int64, err error) {
+	groups := sizeRe.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(s)))
+	if groups == nil {
+		return 0, fmt.Errorf("unwrap: invalid size %q", s)
+	}
+
+	value, err := strconv.ParseFloat(groups[1], 64)
+	if err != nil {
+		return
+	}
+	for i := strings.Index("KMGT", groups[2]); groups[2] != "" && i >= 0; i-- {
+		value *= 1024
+	}
+
+	return int64(value), nil
+}
@@ -0,0 +1,56 @@
+package npm
+
+// installs sharing a cache directory coordinate through file locks: each
+// holds a shared lock on the cache as a whole while it runs, and an
+// exclusive lock on an entry while writing it. Commands that remove entries
+// hold the cache exclusively, so they never pull one out from under an
+// install.
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const (
+	cacheLockFile = ".lock"
+	cacheLockDir  = ".locks"
+)
+
+var errLocked = errors.New("locked by another process")
+
+// openLock takes a lock on the file at path, creating it if needed
+func openLock(path string, exclusive bool, wait bool) (unlock func(), err error) {
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+
+	err = lockFile(f, exclusive, wait)
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// LockCache locks the cache at cacheDir, waiting for other processes: an
+// install only needs a shared lock, but removing entries an exclusive one
+func LockCache(cacheDir string, exclusive bool) (unlock func(), err error) {
+	return openLock(filepath.Join(cacheDir, cacheLockFile), exclusive, true)
+}
+
+// lockCacheEntry keeps other processes from writing the entry name while
+// this one does
+func lockCacheEntry(cacheDir string, name string) (unlock func(), err error) {
+	return openLock(filepath.Join(cacheDir, cacheLockDir, filepath.FromSlash(name)+".lock"), true, true)
+}
@@ -1,12 +1,14 @@
 package npm
 
 import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -19,11 +21,54 @@ import (
 const MaxConcurrentDownloads = 20
 
 func (a *App) DownloadDependencies() (tmpdir string) {
-	deps, gitModules, err := depsSlice(a)
+	var moduleDir string
+	var err error
+	useTmpDir := false
+
+	if useTmpDir {
+		moduleDir, err = ioutil.TempDir("", a.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		moduleDir = CacheDir
+		err = os.MkdirAll(moduleDir, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	log.Printf("writing to directory: %s\n", moduleDir)
+
+	optional := make(map[string]bool)
+	integrity := make(map[string]string)
+	deps, gitModules, deferred, err := depsSlice(a, nil, moduleDir, optional, integrity)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	for _, ws := range a.Workspaces {
+		wsDeps, wsGitModules, wsDeferred, err := depsSlice(ws, nil, moduleDir, optional, integrity)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		deps = append(deps, wsDeps...)
+		gitModules = append(gitModules, wsGitModules...)
+		deferred = append(deferred, wsDeferred...)
+	}
+
+	if a.Graph != nil {
+		graphDeps, graphGitModules, graphDeferred, err := depsSlice(a.Graph, nil, moduleDir, optional, integrity)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		deps = append(deps, graphDeps...)
+		gitModules = append(gitModules, graphGitModules...)
+		deferred = append(deferred, graphDeferred...)
+	}
+
 	sort.Strings(deps)
 
 	deps = dedupeSlice(deps)
@@ -37,47 +82,82 @@ func (a *App) DownloadDependencies() (tmpdir string) {
 	}
 	*/
 
-	var moduleDir string
-	useTmpDir := false
+	// git dependencies are fetched alongside the tarballs
+	gitDone := make(chan error, 1)
+	go func() {
+		gitDone <- fetchGitRepos(moduleDir, gitModules)
+	}()
 
-	if useTmpDir {
-		moduleDir, err = ioutil.TempDir("", a.Name)
-		if err != nil {
-			log.Fatal(err)
+	// download all files - MaxConcurrentDownloads concurrently
+	err = downloadTarballs(moduleDir, deps, optional, integrity)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the nested dependencies of packages that weren't in the cache yet are
+	// listed once their tarballs (and bundleDependencies) can be read
+	var laterGitModules []Module
+	for len(deferred) > 0 {
+		deps = nil
+		var next []Module
+		for _, m := range deferred {
+			bundled, err := tarballBundled(filepath.Join(moduleDir, path.Base(m.Resolved)))
+			if os.IsNotExist(err) {
+				// an optional dependency that could not be downloaded, and
+				// is skipped when installing
+				continue
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			depDeps, gitDeps, depDeferred, err := depsSlice(m, bundled, moduleDir, optional, integrity)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			deps = append(deps, depDeps...)
+			laterGitModules = append(laterGitModules, gitDeps...)
+			next = append(next, depDeferred...)
 		}
-	} else {
-		moduleDir = ".module-cache"
-		err = os.MkdirAll(moduleDir, 0755)
+
+		sort.Strings(deps)
+		deps = dedupeSlice(deps)
+		fmt.Printf("nested tarball dependencies: %d\n", len(deps))
+
+		err = downloadTarballs(moduleDir, deps, optional, integrity)
 		if err != nil {
 			log.Fatal(err)
 		}
-	}
 
-	log.Printf("writing to directory: %s\n", moduleDir)
+		deferred = next
+	}
 
-	// download all files - MaxConcurrentDownloads concurrently
-	err = downloadTarballs(moduleDir, deps)
+	err = <-gitDone
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = fetchGitRepos(moduleDir, gitModules)
+	err = fetchGitRepos(moduleDir, laterGitModules)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	log.Printf("downloaded dependencies to %s\n", moduleDir)
 
-	// get all git repos
-
 	return moduleDir
 }
 
 /*
  * takes package with tree of dependencies, returns slice of URL dependencies (tarballs)
  * and slice of git dependencies (repo URLs + refs)
+ * tarballs only needed by optional dependencies are marked in optional, and
+ * the lockfile's integrity field for each tarball is kept in integrity
+ * bundled names the dependencies shipped in pkg's own tarball; modules whose
+ * tarballs aren't in moduleDir yet are returned in deferred, with resolved
+ * set, as their bundleDependencies can't be read until they are downloaded
  */
-func depsSlice(pkg Package) (urls []string, gitModules []Module, err error) {
+func depsSlice(pkg Package, bundled map[string]bool, moduleDir string, optional map[string]bool, integrity map[string]string) (urls []string, gitModules []Module, deferred []Module, err error) {
 	npmbin, err := exec.LookPath("npm")
 	if err != nil {
 		log.Fatal("cannot find npm in $PATH")
@@ -85,31 +165,140 @@ func depsSlice(pkg Package) (urls []string, gitModules []Module, err error) {
 	npmCommand := NpmCommand{npmbin}
 
 	for _, dep := range pkg.DependencyList() {
-		if dep.Resolved == "" {
-			log.Printf("[WARNING] empty resolved field for %s@%s\n", dep.Name, dep.Version)
-			resolvedUrl, err := npmCommand.view(dep)
-			if err != nil {
-				return urls, gitModules, err
-			}
+		if dep.Bundled || bundled[dep.Name] {
+			// shipped inside its parent's tarball, along with its own
+			// dependencies
+			continue
+		}
 
-			urls = append(urls, resolvedUrl)
-		} else if strings.HasPrefix(dep.Resolved, "git+") {
+		var depBundled map[string]bool
+		localPath, _, isLocal := dep.LocalSpec()
+		_, isGit := dep.GitSpec()
+
+		if isLocal {
+			// installed straight from disk
+			depBundled = localBundled(localPath)
+		} else if isGit {
+			// packed when installing: only the lockfile records what it bundles
 			gitModules = append(gitModules, dep)
 		} else {
+			if dep.Resolved == "" {
+				log.Printf("[WARNING] empty resolved field for %s@%s\n", dep.Name, dep.Version)
+				dep.Resolved, err = npmCommand.view(dep)
+				if err != nil {
+					return urls, gitModules, deferred, err
+				}
+			}
+
 			urls = append(urls, dep.Resolved)
+			markOptional(optional, dep.Resolved, dep.Optional)
+			markIntegrity(integrity, dep.Resolved, dep.Integrity)
+
+			if len(dep.Dependencies) == 0 {
+				continue
+			}
+
+			tarball := filepath.Join(moduleDir, path.Base(dep.Resolved))
+			depBundled, err = tarballBundled(tarball)
+			if os.IsNotExist(err) {
+				deferred, err = append(deferred, dep), nil
+				continue
+			}
+			if err != nil {
+				return urls, gitModules, deferred, err
+			}
 		}
 
-		depDeps, gitDeps, err := depsSlice(dep)
+		depDeps, gitDeps, depDeferred, err := depsSlice(dep, depBundled, moduleDir, optional, integrity)
 		if err != nil {
 			log.Fatal(err)
-			return urls, gitModules, err
+			return urls, gitModules, deferred, err
 		}
 
 		urls = append(urls, depDeps...)
 		gitModules = append(gitModules, gitDeps...)
+		deferred = append(deferred, depDeferred...)
 	}
 
-	return urls, gitModules, err
+	return urls, gitModules, deferred, err
+}
+
+// localBundled reads the bundleDependencies of a file: or link: dependency,
+// either a directory or a tarball
+func localBundled(localPath string) (bundled map[string]bool) {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		// reported when installing
+		return nil
+	}
+
+	var pkg PackageJSON
+	if info.IsDir() {
+		pkg, err = ReadPackageJSON(localPath)
+		if err != nil {
+			return nil
+		}
+		return pkg.BundledDependencies()
+	}
+
+	bundled, err = tarballBundled(localPath)
+	if err != nil {
+		return nil
+	}
+	return
+}
+
+// tarballBundled reads the bundleDependencies from the package.json in a
+// package tarball
+func tarballBundled(archive string) (bundled map[string]bool, err error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer gz.Close()
+
+	tarReader := tar.NewReader(gz)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("unwrap: no package.json in %s", archive)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the top-level directory is stripped when extracting
+		parts := strings.Split(strings.TrimPrefix(header.Name, "./"), "/")
+		if len(parts) != 2 || parts[1] != "package.json" {
+			continue
+		}
+
+		var pkg PackageJSON
+		err = json.NewDecoder(tarReader).Decode(&pkg)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap: %s: %v", archive, err)
+		}
+		return pkg.BundledDependencies(), nil
+	}
+}
+
+// a tarball is optional unless a required module needs it
+func markOptional(optional map[string]bool, url string, isOptional bool) {
+	if wasOptional, seen := optional[url]; !seen || wasOptional {
+		optional[url] = isOptional
+	}
+}
+
+func markIntegrity(integrity map[string]string, url string, sri string) {
+	if sri != "" {
+		integrity[url] = sri
+	}
 }
 
 // takes sorted slice orig, returns deduped (still sorted) slice
@@ -133,9 +322,8 @@ func minInt(a int, b int) (min int) {
 	}
 }
 
-func downloadTarballs(tmpdir string, tarballs []string) (err error) {
+func downloadTarballs(tmpdir string, tarballs []string, optional map[string]bool, integrity map[string]string) (err error) {
 	var wg sync.WaitGroup
-	client := &http.Client{}
 
 	downloads := make(chan string, MaxConcurrentDownloads)
 	quit := make(chan bool)
@@ -145,7 +333,7 @@ func downloadTarballs(tmpdir string, tarballs []string) (err error) {
 	wg.Add(workerCount)
 	go func() {
 		for i := 0; i < workerCount; i++ {
-			go getTarball(i, tmpdir, downloads, client, &wg)
+			go getTarball(i, tmpdir, downloads, optional, integrity, &wg)
 		}
 		<-quit
 	}()
@@ -161,40 +349,178 @@ func downloadTarballs(tmpdir string, tarballs []string) (err error) {
 	return
 }
 
+// the number of git remotes fetched at once
+const MaxConcurrentGitFetches = 4
+
 func fetchGitRepos(tmpdir string, gitModules []Module) (err error) {
-	gitbin, err := exec.LookPath("git")
-	if err != nil {
-		log.Fatal("cannot find git in $PATH")
+	if len(gitModules) == 0 {
+		return
 	}
 
+	client := newGitClient()
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	slots := make(chan struct{}, MaxConcurrentGitFetches)
+	mirrors := &mirrorLocks{locks: make(map[string]*sync.Mutex), fetched: make(map[string]bool)}
+	seen := make(map[string]bool)
+
 	for _, m := range gitModules {
-		gitUrl, err := GitUrlFromString(m.Resolved)
-		if err != nil {
-			return err
+		// the same dependency can appear all over the tree
+		gitUrl, _ := m.GitSpec()
+		key := gitUrl.Url + " " + gitUrl.dirName(m.Name)
+		if seen[key] {
+			continue
 		}
+		seen[key] = true
 
-		fmt.Println(gitbin)
-		fmt.Printf("cloning %s from %s at ref %s\n", m.Name, gitUrl.Url, gitUrl.Ref)
+		wg.Add(1)
+		go func(m Module) {
+			defer wg.Done()
 
-		// clone
-		target := fmt.Sprintf("%s__%s", m.Name, gitUrl.Ref)
+			slots <- struct{}{}
+			fetchErr := fetchGitRepo(client, tmpdir, m, mirrors)
+			<-slots
 
-		// for some reason, git needs an empty first argument - it only reads
-		// the command from the second arg
-		cloneArgs := []string{"", "clone", gitUrl.Url, target}
-		err = execGit(gitbin, cloneArgs, tmpdir)
-		if err != nil {
-			return err
-		}
+			if fetchErr != nil && m.Optional {
+				// the module is skipped when installing
+				log.Printf("[WARN] could not fetch optional dependency %s: %v\n", m.Name, fetchErr)
+				return
+			}
 
-		// checkout
-		checkoutArgs := []string{"", "checkout", "-q", gitUrl.Ref}
-		err = execGit(gitbin, checkoutArgs, filepath.Join(tmpdir, target))
-		if err != nil {
-			return err
+			errMu.Lock()
+			defer errMu.Unlock()
+			if fetchErr != nil && err == nil {
+				err = fetchErr
+			}
+		}(m)
+	}
+
+	wg.Wait()
+	return
+}
+
+// fetchGitRepo brings the mirror of m's remote up to date, and writes the
+// commit m refers to into tmpdir/name__ref
+func fetchGitRepo(client gitClient, tmpdir string, m Module, mirrors *mirrorLocks) (err error) {
+	gitUrl, ok := m.GitSpec()
+	if !ok {
+		return fmt.Errorf("unwrap: %s is not a git dependency", m.Name)
+	}
+
+	mirror, commit, err := fetchGitCommit(client, tmpdir, gitUrl, mirrors)
+	if err != nil {
+		return fmt.Errorf("unwrap: %s: %v", m.Name, err)
+	}
+
+	err = checkGitCommit(m, gitUrl, commit)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("checking out %s from %s at %s\n", m.Name, gitUrl, commit)
+	checkout := filepath.Join(tmpdir, gitUrl.dirName(m.Name))
+
+	unlock, err := lockCacheEntry(tmpdir, gitUrl.dirName(m.Name))
+	if err != nil {
+		return
+	}
+	defer unlock()
+	touchCacheEntry(tmpdir, gitUrl.dirName(m.Name), gitUrl.Url)
+
+	// the checkout is packed again when installing
+	err = os.Remove(checkout + ".tgz")
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	err = exportGitCommit(client, tmpdir, mirror, gitUrl.Url, commit, checkout, mirrors, 0)
+	if err != nil {
+		return fmt.Errorf("unwrap: %s: %v", m.Name, err)
+	}
+
+	return
+}
+
+// fetchGitCommit brings the mirror of gitUrl's remote up to date, returning
+// where it is and the commit gitUrl refers to
+func fetchGitCommit(client gitClient, tmpdir string, gitUrl GitUrl, mirrors *mirrorLocks) (mirror string, commit string, err error) {
+	mirror, err = filepath.Abs(gitMirrorDir(tmpdir, gitUrl.Url))
+	if err != nil {
+		return
+	}
+
+	unlock := mirrors.lock(mirror)
+	defer unlock()
+
+	// and from other installs sharing the cache
+	name := "git/" + filepath.Base(mirror)
+	unlockEntry, err := lockCacheEntry(tmpdir, name)
+	if err != nil {
+		return
+	}
+	defer unlockEntry()
+
+	commit, err = updateMirror(client, mirror, gitUrl, mirrors)
+	if err == nil {
+		touchCacheEntry(tmpdir, name, gitUrl.Url)
+	}
+	return
+}
+
+// RequirePinnedGitRefs makes git dependencies that the lockfile doesn't pin
+// to a commit an error, rather than a warning
+var RequirePinnedGitRefs = false
+
+// checkGitCommit makes sure commit is the one the lockfile records for m, if
+// it records any, and complains about refs that can move
+func checkGitCommit(m Module, gitUrl GitUrl, commit string) (err error) {
+	for _, locked := range m.lockedCommits() {
+		if !strings.HasPrefix(commit, locked) {
+			return fmt.Errorf("unwrap: %s: %s resolved to commit %s, but the lockfile has %s", m.Name, gitUrl, commit, locked)
 		}
 	}
 
+	if gitUrl.IsCommit() {
+		return
+	}
+
+	ref := gitUrl.Ref
+	if gitUrl.Range != "" {
+		ref = "semver:" + gitUrl.Range
+	} else if ref == "" {
+		ref = "the default branch"
+	}
+
+	if RequirePinnedGitRefs {
+		return fmt.Errorf("unwrap: %s: %s refers to %s, not a commit; pin it to %s", m.Name, gitUrl.Url, ref, commit)
+	}
+
+	log.Printf("[WARN] %s: %s refers to %s, not a commit; pin it to %s\n", m.Name, gitUrl.Url, ref, commit)
+	return
+}
+
+// resolveGitRef picks what gitUrl refers to in a repository: the ref as
+// given, the highest tag matching a semver range, or "" for the default branch
+func resolveGitRef(client gitClient, repoDir string, gitUrl GitUrl) (ref string, err error) {
+	if gitUrl.Range == "" {
+		return gitUrl.Ref, nil
+	}
+
+	tags, err := client.tags(repoDir)
+	if err != nil {
+		return
+	}
+
+	ref, err = maxSatisfying(tags, gitUrl.Range)
+	if err != nil {
+		return
+	}
+	if ref == "" {
+		return "", fmt.Errorf("unwrap: no tag of %s matches %s", gitUrl.Url, gitUrl.Range)
+	}
+
+	fmt.Printf("resolved %s to tag %s\n", gitUrl, ref)
 	return
 }
 
@@ -220,9 +546,26 @@ func execGit(gitbin string, args []string, wd string) (err error) {
 	return
 }
 
-func getTarball(id int, tmpdir string, downloads chan string, client *http.Client, wg *sync.WaitGroup) (err error) {
+func gitOutput(gitbin string, args []string, wd string) (output string, err error) {
+	cmd := exec.Cmd{
+		Path: gitbin,
+		Args: args,
+		Dir: wd,
+		Stderr: os.Stderr,
+	}
+
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+func getTarball(id int, tmpdir string, downloads chan string, optional map[string]bool, integrity map[string]string, wg *sync.WaitGroup) (err error) {
 	for dl := range downloads {
-		err = downloadUrl(tmpdir, dl, client)
+		err = downloadUrl(tmpdir, dl, integrity[dl])
+		if err != nil && optional[dl] {
+			// the module is skipped when installing
+			log.Printf("[WARN] could not download optional dependency %s: %v\n", dl, err)
+			continue
+		}
 		if err != nil {
 			fmt.Printf("Error downloading %s\n", dl)
 			log.Fatal(err)
@@ -233,11 +576,21 @@ func getTarball(id int, tmpdir string, downloads chan string, client *http.Clien
 	return
 }
 
-func downloadUrl(tmpdir string, tarUrl string, client *http.Client) (err error) {
-	target := filepath.Join(tmpdir, path.Base(tarUrl))
+func downloadUrl(tmpdir string, tarUrl string, sri string) (err error) {
+	name := path.Base(tarUrl)
+	target := filepath.Join(tmpdir, name)
+
+	// other installs sharing the cache may be downloading it too
+	unlock, err := lockCacheEntry(tmpdir, name)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
 	_, statErr := os.Stat(target)
 	if statErr == nil {
 		// log.Printf("reading %s from cache\n", path.Base(tarUrl))
+		touchCacheEntry(tmpdir, name, tarUrl)
 		return
 	}
 
@@ -246,41 +599,86 @@ func downloadUrl(tmpdir string, tarUrl string, client *http.Client) (err error)
 		return statErr
 	}
 
-	urlObj, err := url.Parse(tarUrl)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// don't leave a truncated tarball in the cache
+	partial := target + ".partial"
+	defer os.Remove(partial)
 
-	req, err := http.NewRequest("GET", tarUrl, nil)
-	if err != nil {
-		log.Fatal(err)
+	var download tarballDownload
+	remote := RemoteCache != nil && RemoteCache.caches(sri)
+	if remote {
+		download, err = saveTarball(partial, sri, func(w io.Writer) (bool, error) {
+			return RemoteCache.get(sri, w)
+		})
+		if err != nil {
+			log.Printf("[WARN] could not get %s from the remote cache: %v\n", name, err)
+		}
 	}
 
-	// is this sensible? who knows!
-	if strings.Contains(urlObj.Host, "artifactory") {
-		//req.Header.Set("User-Agent", "alunny hates artifactory")
-		req.Close = true
-	}
+	fromRegistry := !download.found
+	if fromRegistry {
+		urls := Registries.candidates(tarUrl)
+		for i, candidate := range urls {
+			download, err = saveTarball(partial, sri, func(w io.Writer) (bool, error) {
+				return true, Registries.get(candidate, w)
+			})
+			if err == nil {
+				break
+			}
 
-	resp, err := client.Do(req)
-	if err == io.EOF {
-		err = nil
+			err = fmt.Errorf("unwrap: %s: %v", candidate, err)
+			if i < len(urls)-1 {
+				log.Printf("[WARN] %v; trying %s\n", err, urls[i+1])
+			}
+		}
+		if err != nil {
+			return
+		}
 	}
 
+	err = os.Rename(partial, target)
 	if err != nil {
-		log.Printf("%q\n", err)
-		log.Fatal(err)
+		return err
+	}
+
+	recordDownload(tmpdir, name, tarUrl, download.sum, download.size)
+
+	if fromRegistry && remote && !RemoteCache.ReadOnly {
+		err = RemoteCache.put(sri, target)
+		if err != nil {
+			log.Printf("[WARN] could not upload %s to the remote cache: %v\n", name, err)
+		}
 	}
-	// fmt.Printf("downloaded %s\n", url)
-	defer resp.Body.Close()
 
-	output, err := os.Create(target)
+	return nil
+}
+
+type tarballDownload struct {
+	found bool
+	sum   []byte // sha512
+	size  int64
+}
+
+// saveTarball writes what fetch finds to file, checking it against the
+// lockfile's integrity field
+func saveTarball(file string, sri string, fetch func(w io.Writer) (found bool, err error)) (download tarballDownload, err error) {
+	output, err := os.Create(file)
 	if err != nil {
-		log.Fatal(err)
+		return
 	}
-	defer output.Close()
 
-	io.Copy(output, resp.Body)
+	hash := sha512.New()
+	checker := newIntegrityChecker(sri)
+	counter := &countingWriter{}
+	found, err := fetch(io.MultiWriter(output, hash, checker, counter))
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && found {
+		err = checker.check()
+	}
+	if err != nil || !found {
+		return
+	}
 
-	return
+	return tarballDownload{found: true, sum: hash.Sum(nil), size: counter.n}, nil
 }
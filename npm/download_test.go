@@ -0,0 +1,162 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDepsSliceBundled(t *testing.T) {
+	if _, err := exec.LookPath("npm"); err != nil {
+		t.Skip("npm is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "unwrap-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cacheDir := filepath.Join(dir, "cache")
+	if err = os.MkdirAll(cacheDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTarball(t, filepath.Join(cacheDir, "a-1.0.0.tgz"), map[string]string{
+		"package.json": `{"name":"a","version":"1.0.0","bundleDependencies":["b"]}`,
+	})
+	writeTarball(t, filepath.Join(cacheDir, "n-1.0.0.tgz"), map[string]string{
+		"package.json": `{"name":"n","version":"1.0.0"}`,
+	})
+	writeTree(t, filepath.Join(dir, "local"), map[string]string{
+		"package.json": `{"name":"local","dependencies":{"b":"1"},"bundleDependencies":true}`,
+	})
+
+	registry := "https://registry.example/"
+	module := func(name string, deps ...Module) Module {
+		return Module{Name: name, Version: "1.0.0", Resolved: registry + name + "/-/" + name + "-1.0.0.tgz", Dependencies: deps}
+	}
+	url := func(name string) string {
+		return registry + name + "/-/" + name + "-1.0.0.tgz"
+	}
+
+	flagged := module("b")
+	flagged.Bundled = true
+
+	local := Module{Name: "local", Version: "file:" + filepath.Join(dir, "local"), Dependencies: []Module{module("b")}}
+
+	tests := []struct {
+		name     string
+		deps     []Module
+		urls     []string
+		deferred []string
+	}{
+		{
+			name: "lockfile flag",
+			deps: []Module{module("n", flagged, module("c"))},
+			urls: []string{url("n"), url("c")},
+		},
+		{
+			name: "cached parent tarball",
+			deps: []Module{module("a", module("b"), module("c"))},
+			urls: []string{url("a"), url("c")},
+		},
+		{
+			name:     "parent tarball not downloaded yet",
+			deps:     []Module{module("x", module("b", module("c")))},
+			urls:     []string{url("x")},
+			deferred: []string{"x"},
+		},
+		{
+			name: "local directory",
+			deps: []Module{local},
+		},
+		{
+			name: "no nested dependencies",
+			deps: []Module{module("x"), module("y")},
+			urls: []string{url("x"), url("y")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			urls, _, deferred, err := depsSlice(App{Dependencies: tt.deps}, nil, cacheDir, make(map[string]bool), make(map[string]string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(urls, tt.urls) {
+				t.Errorf("urls = %q, want %q", urls, tt.urls)
+			}
+
+			var names []string
+			for _, m := range deferred {
+				names = append(names, m.Name)
+			}
+			if !reflect.DeepEqual(names, tt.deferred) {
+				t.Errorf("deferred = %q, want %q", names, tt.deferred)
+			}
+		})
+	}
+}
+
+func TestTarballBundled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unwrap-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{
+			name:  "list",
+			files: map[string]string{"package.json": `{"bundleDependencies":["b","c"]}`, "lib/package.json": `{}`},
+			want:  map[string]bool{"b": true, "c": true},
+		},
+		{
+			name:  "old spelling",
+			files: map[string]string{"package.json": `{"bundledDependencies":["b"]}`},
+			want:  map[string]bool{"b": true},
+		},
+		{
+			name:  "none",
+			files: map[string]string{"package.json": `{"name":"a"}`},
+			want:  map[string]bool{},
+		},
+		{
+			name:    "no package.json",
+			files:   map[string]string{"index.js": ""},
+			wantErr: true,
+		},
+		{
+			name:    "invalid package.json",
+			files:   map[string]string{"package.json": `{`},
+			wantErr: true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := filepath.Join(dir, string(rune('a'+i))+".tgz")
+			writeTarball(t, archive, tt.files)
+
+			got, err := tarballBundled(archive)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := tarballBundled(filepath.Join(dir, "missing.tgz")); !os.IsNotExist(err) {
+		t.Errorf("missing tarball: err = %v, want not exist", err)
+	}
+}
@@ -1,68 +1,546 @@
 package npm
 
 import (
+	"archive/tar"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
-func copyGitModule(m Module, tmpdir string, target string) (err error) {
-	gitUrl, err := GitUrlFromString(m.Resolved)
+// git dependencies are fetched into bare mirrors of their remotes, kept in
+// the download directory between installs: a remote is cloned once, then
+// only fetched from again when a dependency refers to something that might
+// have moved, or to a commit the mirror doesn't have yet. Each dependency's
+// commit is then exported from the mirror with git archive.
+//
+// A dependency pinned to a full commit SHA only needs that commit, which the
+// git binary fetches by itself, without history (--depth=1), falling back to
+// the whole remote when the server won't serve a commit by its SHA. The
+// in-process client always fetches the whole remote: its repositories are
+// assumed to hold the history of every commit they have.
+
+var unsafePathRe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// gitMirrorDir is where the mirror of the remote at url is kept
+func gitMirrorDir(tmpdir string, url string) string {
+	name := strings.Trim(unsafePathRe.ReplaceAllString(url, "_"), "_")
+	if len(name) > 64 {
+		name = name[len(name)-64:]
+	}
+	sum := sha256.Sum256([]byte(url))
+
+	return filepath.Join(tmpdir, "git", fmt.Sprintf("%s-%x.git", name, sum[:4]))
+}
+
+// mirrorLocks keeps concurrent fetches from using the same mirror at once,
+// and remembers which mirrors are already up to date for this install
+type mirrorLocks struct {
+	mu      sync.Mutex
+	locks   map[string]*sync.Mutex
+	fetched map[string]bool
+}
+
+func (l *mirrorLocks) lock(mirror string) (unlock func()) {
+	l.mu.Lock()
+	lock, ok := l.locks[mirror]
+	if !ok {
+		lock = &sync.Mutex{}
+		l.locks[mirror] = lock
+	}
+	l.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+func (l *mirrorLocks) isFetched(mirror string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.fetched[mirror]
+}
+
+func (l *mirrorLocks) markFetched(mirror string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.fetched[mirror] = true
+}
+
+// gitClient is how mirrors are fetched into and read from: by running git,
+// or, where there is none, in-process
+type gitClient interface {
+	cloneMirror(url string, mirror string) error
+	fetchMirror(url string, mirror string) error
+
+	// fetchCommit adds commit to the mirror, creating it if needed, without
+	// the commit's history where the client and server support it
+	fetchCommit(url string, mirror string, commit string) error
+
+	// tags lists the names of the mirror's tags
+	tags(mirror string) ([]string, error)
+
+	// commit resolves a ref, tag, branch or commit to a full commit SHA
+	commit(mirror string, ref string) (string, error)
+
+	// archive writes the files of commit into target, replacing whatever
+	// was there. Submodules are left as empty directories.
+	archive(mirror string, commit string, target string) error
+
+	// readFile returns the content of the file at path in commit
+	readFile(mirror string, commit string, path string) ([]byte, error)
+
+	// gitlinks lists the commits of the submodules in commit, by path
+	gitlinks(mirror string, commit string) (map[string]string, error)
+}
+
+// NativeGit fetches git dependencies in-process even when git is installed
+var NativeGit = false
+
+func newGitClient() gitClient {
+	if !NativeGit {
+		gitbin, err := exec.LookPath("git")
+		if err == nil {
+			return gitBinary(gitbin)
+		}
+		log.Printf("[WARN] cannot find git in $PATH; fetching git dependencies in-process\n")
+	}
+
+	return nativeGit{}
+}
+
+// updateMirror makes sure the mirror has what gitUrl refers to, and returns
+// its commit. A commit the mirror already has can't have moved, so that
+// case doesn't touch the network, and neither does a mirror fetched from
+// earlier in the same install.
+func updateMirror(client gitClient, mirror string, gitUrl GitUrl, mirrors *mirrorLocks) (commit string, err error) {
+	_, statErr := os.Stat(mirror)
+	exists := !os.IsNotExist(statErr)
+
+	if exists && (mirrors.isFetched(mirror) || gitUrl.IsCommit()) {
+		commit, err = mirrorCommit(client, mirror, gitUrl)
+		if err == nil {
+			return
+		}
+	}
+
+	if !exists {
+		err = os.MkdirAll(filepath.Dir(mirror), 0755)
+		if err != nil {
+			return
+		}
+	}
+
+	// a full SHA can be fetched on its own
+	if gitUrl.IsCommit() && len(gitUrl.Ref) == 40 {
+		fmt.Printf("fetching %s from %s\n", gitUrl.Ref, gitUrl.Url)
+		err = client.fetchCommit(gitUrl.Url, mirror, gitUrl.Ref)
+		if err == nil {
+			return mirrorCommit(client, mirror, gitUrl)
+		}
+		log.Printf("[WARN] could not fetch commit %s by itself from %s, fetching the whole repository: %v\n", gitUrl.Ref, gitUrl.Url, err)
+
+		if !exists {
+			os.RemoveAll(mirror)
+		}
+	}
+
+	if !exists {
+		fmt.Printf("cloning %s\n", gitUrl.Url)
+
+		err = client.cloneMirror(gitUrl.Url, mirror)
+		if err != nil {
+			os.RemoveAll(mirror)
+			return
+		}
+		mirrors.markFetched(mirror)
+
+		return mirrorCommit(client, mirror, gitUrl)
+	}
+
+	fmt.Printf("fetching %s\n", gitUrl.Url)
+	err = client.fetchMirror(gitUrl.Url, mirror)
+	if err != nil {
+		return
+	}
+	mirrors.markFetched(mirror)
+
+	return mirrorCommit(client, mirror, gitUrl)
+}
+
+// mirrorCommit resolves gitUrl to a full commit SHA in the mirror
+func mirrorCommit(client gitClient, mirror string, gitUrl GitUrl) (commit string, err error) {
+	ref, err := resolveGitRef(client, mirror, gitUrl)
+	if err != nil {
+		return
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	commit, err = client.commit(mirror, ref)
+	if err != nil {
+		return "", fmt.Errorf("no commit %s in %s", ref, gitUrl.Url)
+	}
+
+	return
+}
+
+// gitBinary runs the git found at its path
+type gitBinary string
+
+func (git gitBinary) cloneMirror(url string, mirror string) error {
+	return execGit(string(git), []string{"", "clone", "--mirror", "--quiet", url, mirror}, "")
+}
+
+// fetchMirror fetches branches and tags, and only prunes those, keeping the
+// refs fetchCommit adds. It also fetches the history left out of a shallow
+// mirror.
+func (git gitBinary) fetchMirror(url string, mirror string) error {
+	args := []string{"", "fetch", "--prune", "--quiet"}
+	if _, err := os.Stat(filepath.Join(mirror, "shallow")); err == nil {
+		args = append(args, "--unshallow")
+	}
+	args = append(args, "origin", "+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+
+	return execGit(string(git), args, mirror)
+}
+
+// fetchCommit sets up the mirror as clone --mirror would, then fetches just
+// commit into a ref of its own, so that it isn't garbage collected. Servers
+// may refuse to serve commits no branch or tag points to.
+func (git gitBinary) fetchCommit(url string, mirror string, commit string) (err error) {
+	if _, statErr := os.Stat(mirror); os.IsNotExist(statErr) {
+		for _, args := range [][]string{
+			{"", "init", "--bare", "--quiet", mirror},
+			{"", "-C", mirror, "config", "remote.origin.url", url},
+			{"", "-C", mirror, "config", "remote.origin.fetch", "+refs/*:refs/*"},
+			{"", "-C", mirror, "config", "remote.origin.mirror", "true"},
+		} {
+			err = execGit(string(git), args, "")
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	cmd := exec.Command(string(git), "fetch", "--quiet", "--depth=1", "--no-tags", "origin", "+"+commit+":refs/unwrap/"+commit)
+	cmd.Dir = mirror
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return
+}
+
+func (git gitBinary) tags(mirror string) (tags []string, err error) {
+	out, err := gitOutput(string(git), []string{"", "tag", "--list"}, mirror)
+	return strings.Fields(out), err
+}
+
+func (git gitBinary) commit(mirror string, ref string) (commit string, err error) {
+	out, err := gitOutput(string(git), []string{"", "rev-parse", "--verify", "--quiet", ref + "^{commit}"}, mirror)
+	return strings.TrimSpace(out), err
+}
+
+func (git gitBinary) archive(mirror string, commit string, target string) (err error) {
+	err = os.RemoveAll(target)
 	if err != nil {
 		return
 	}
 
-	sourceDir := filepath.Join(tmpdir, fmt.Sprintf("%s__%s", m.Name, gitUrl.Ref))
+	cmd := exec.Cmd{
+		Path:   string(git),
+		Args:   []string{"", "archive", "--format=tar", commit},
+		Dir:    mirror,
+		Stderr: os.Stderr,
+	}
+
+	archive, err := cmd.StdoutPipe()
+	if err != nil {
+		return
+	}
 
-	err = filepath.Walk(sourceDir, func (path string, info os.FileInfo, err error) error {
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	err = extractTar(archive, target)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+
+	return cmd.Wait()
+}
+
+func (git gitBinary) readFile(mirror string, commit string, path string) (content []byte, err error) {
+	out, err := gitOutput(string(git), []string{"", "cat-file", "blob", commit + ":" + path}, mirror)
+	return []byte(out), err
+}
+
+func (git gitBinary) gitlinks(mirror string, commit string) (links map[string]string, err error) {
+	out, err := gitOutput(string(git), []string{"", "ls-tree", "-r", "-z", commit}, mirror)
+	if err != nil {
+		return
+	}
+
+	// <mode> <type> <sha>\t<path>, NUL-terminated
+	links = make(map[string]string)
+	for _, entry := range strings.Split(out, "\x00") {
+		tab := strings.IndexByte(entry, '\t')
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(entry[:tab])
+		if len(fields) == 3 && fields[0] == "160000" {
+			links[entry[tab+1:]] = fields[2]
+		}
+	}
+
+	return
+}
+
+// nativeGit reads and writes mirrors itself, see gitrepo.go, fetching from
+// the remotes in gitremote.go
+type nativeGit struct{}
+
+func (nativeGit) cloneMirror(url string, mirror string) (err error) {
+	repo, err := initGitRepo(mirror, url)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	return fetchNative(repo, url)
+}
+
+// fetchCommit fetches the whole remote: there are no shallow fetches
+// in-process
+func (n nativeGit) fetchCommit(url string, mirror string, commit string) (err error) {
+	if _, statErr := os.Stat(mirror); os.IsNotExist(statErr) {
+		return n.cloneMirror(url, mirror)
+	}
+
+	return n.fetchMirror(url, mirror)
+}
+
+func (nativeGit) fetchMirror(url string, mirror string) (err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	return fetchNative(repo, url)
+}
+
+// fetchNative brings repo's branches and tags in line with the remote's,
+// like git fetch --prune into a mirror
+func fetchNative(repo *gitRepo, url string) (err error) {
+	remote, err := openGitRemote(url)
+	if err != nil {
+		return
+	}
+
+	refs, head, err := remote.refs()
+	if err != nil {
+		return
+	}
+
+	current, err := repo.refs()
+	if err != nil {
+		return
+	}
+
+	var wants, haves []string
+	wanted := make(map[string]bool)
+	for _, sha := range refs {
+		if !wanted[sha] && !repo.has(sha) {
+			wanted[sha] = true
+			wants = append(wants, sha)
+		}
+	}
+	for _, sha := range current {
+		if repo.has(sha) {
+			haves = append(haves, sha)
+		}
+	}
+	sort.Strings(wants)
+	sort.Strings(haves)
+
+	if len(wants) > 0 {
+		err = remote.fetch(repo, wants, haves)
 		if err != nil {
-			fmt.Println(err)
+			return
+		}
+	}
+
+	return repo.writeRefs(refs, head)
+}
+
+func (nativeGit) tags(mirror string) (tags []string, err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	refs, err := repo.refs()
+	for name := range refs {
+		if strings.HasPrefix(name, "refs/tags/") {
+			tags = append(tags, strings.TrimPrefix(name, "refs/tags/"))
+		}
+	}
+
+	return
+}
+
+func (nativeGit) commit(mirror string, ref string) (commit string, err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	return repo.resolve(ref)
+}
+
+func (nativeGit) archive(mirror string, commit string, target string) (err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	return repo.checkout(commit, target)
+}
+
+func (nativeGit) readFile(mirror string, commit string, path string) (content []byte, err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	return repo.readPath(commit, path)
+}
+
+func (nativeGit) gitlinks(mirror string, commit string) (links map[string]string, err error) {
+	repo, err := openGitRepo(mirror)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	return repo.gitlinks(commit)
+}
+
+// extractTar unpacks an uncompressed tar stream into target as is. Unlike
+// package tarballs, repositories may contain symlinks, which are kept.
+func extractTar(r io.Reader, target string) (err error) {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
 			return nil
 		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(target, filepath.FromSlash(header.Name))
+		if !isWithin(path, target) {
+			return fmt.Errorf("unwrap: archive entry %s is outside of %s", header.Name, target)
+		}
 
-		if info.IsDir() && info.Name() == ".git" {
-			return filepath.SkipDir
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+		case tar.TypeSymlink:
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = os.Symlink(header.Linkname, path)
+			}
+		case tar.TypeReg:
+			err = os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = writeFile(path, header.FileInfo(), tarReader)
+			}
+		default:
+			// the pax header git archive starts with, and anything else
+			// a package can't use
+		}
+		if err != nil {
+			return err
 		}
-		if !info.IsDir() && info.Name() == ".gitignore" {
+	}
+}
+
+// copyTree copies the contents of sourceDir into target, leaving out the
+// files and directories for which skip returns true
+func copyTree(sourceDir string, target string, skip func(relativePath string, info os.FileInfo) bool) (err error) {
+	return filepath.Walk(sourceDir, func (path string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Println(err)
 			return nil
 		}
+
 		if path == sourceDir {
 			return nil
 		}
 
-		relativePath := strings.TrimPrefix(path, sourceDir)
+		relativePath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+
+		if skip(relativePath, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		targetPath := filepath.Join(target, relativePath)
 
 		if info.IsDir() {
-			err = os.MkdirAll(targetPath, info.Mode())
-			if err != nil {
-				return err
-			}
-			fmt.Println("created new directory")
-		} else {
-			output, err := os.OpenFile(targetPath, os.O_CREATE | os.O_RDWR | os.O_TRUNC, info.Mode())
-			if err != nil {
-				return err
-			}
-			defer output.Close()
+			return os.MkdirAll(targetPath, info.Mode())
+		}
 
-			input, err := os.Open(path)
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
 			if err != nil {
 				return err
 			}
-			defer input.Close()
+			os.Remove(targetPath)
+			return os.Symlink(link, targetPath)
+		}
 
-			_, err = io.Copy(output, input)
-			if err != nil {
-				return err
-			}
+		output, err := os.OpenFile(targetPath, os.O_CREATE | os.O_RDWR | os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
 		}
+		defer output.Close()
 
-		return nil
-	})
+		input, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
 
-	return
+		_, err = io.Copy(output, input)
+		return err
+	})
 }
-
@@ -0,0 +1,81 @@
+package npm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdateMirrorShallow(t *testing.T) {
+	work, bare := testGitRepo(t)
+	gitbin, err := exec.LookPath("git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gitBinary(gitbin)
+	url := "file://" + filepath.ToSlash(bare)
+
+	first := testGit(t, work, "", "rev-parse", "master~1")
+	feature := testGit(t, work, "", "rev-parse", "feature")
+
+	tests := []struct {
+		name string
+		// protocol version 0 servers only serve what their refs point to
+		protocol string
+		refs     []string
+		want     string
+		shallow  bool
+		commits  int
+	}{
+		{name: "pinned commit", refs: []string{first}, want: first, shallow: true, commits: 1},
+		{name: "refused", protocol: "0", refs: []string{first}, want: first, commits: 3},
+		{name: "abbreviated commit", refs: []string{first[:10]}, want: first, commits: 3},
+		{name: "pinned commits", refs: []string{first, feature}, want: feature, shallow: true, commits: 2},
+		{name: "branch after commit", refs: []string{first, "feature"}, want: feature, commits: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.protocol != "" {
+				t.Setenv("GIT_CONFIG_COUNT", "1")
+				t.Setenv("GIT_CONFIG_KEY_0", "protocol.version")
+				t.Setenv("GIT_CONFIG_VALUE_0", tt.protocol)
+			}
+
+			mirror := filepath.Join(t.TempDir(), "mirror.git")
+			mirrors := &mirrorLocks{locks: make(map[string]*sync.Mutex), fetched: make(map[string]bool)}
+
+			var commit string
+			for _, ref := range tt.refs {
+				commit, err = updateMirror(client, mirror, GitUrl{Url: url, Ref: ref}, mirrors)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if commit != tt.want {
+				t.Errorf("commit = %s, want %s", commit, tt.want)
+			}
+
+			_, err = os.Stat(filepath.Join(mirror, "shallow"))
+			if shallow := err == nil; shallow != tt.shallow {
+				t.Errorf("shallow = %v, want %v", shallow, tt.shallow)
+			}
+
+			commits := strings.Fields(testGit(t, mirror, "", "rev-list", "--all"))
+			if len(commits) != tt.commits {
+				t.Errorf("mirror has %d commits, want %d", len(commits), tt.commits)
+			}
+
+			target := filepath.Join(t.TempDir(), "checkout")
+			if err = client.archive(mirror, commit, target); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = os.Stat(filepath.Join(target, "package.json")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
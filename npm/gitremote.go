@@ -0,0 +1,393 @@
+package npm
+
+// the remotes the in-process git client can fetch from: repositories on
+// disk, read directly, and smart HTTP servers, spoken to in version 0 of
+// the upload-pack protocol, without side-band or multi-ack, so that the
+// response is a single packfile
+// see https://git-scm.com/docs/http-protocol and
+// https://git-scm.com/docs/pack-protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type gitRemote interface {
+	// refs lists the remote's branches and tags, and the ref its HEAD
+	// points to
+	refs() (refs map[string]string, head string, err error)
+
+	// fetch adds what's reachable from wants to repo, which has haves
+	fetch(repo *gitRepo, wants []string, haves []string) error
+}
+
+func openGitRemote(rawurl string) (remote gitRemote, err error) {
+	switch {
+	case strings.HasPrefix(rawurl, "http://"), strings.HasPrefix(rawurl, "https://"):
+		return httpGitRemote{url: strings.TrimSuffix(rawurl, "/")}, nil
+	case strings.HasPrefix(rawurl, "file://"):
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+		return fileGitRemote{dir: filepath.FromSlash(u.Path)}, nil
+	case filepath.IsAbs(rawurl):
+		return fileGitRemote{dir: rawurl}, nil
+	}
+
+	return nil, fmt.Errorf("can't fetch %s without git: only http(s) and file URLs are supported", rawurl)
+}
+
+// a branch or tag, as opposed to other refs servers advertise, like pull
+// requests
+func isMirroredRef(name string) bool {
+	return (strings.HasPrefix(name, "refs/heads/") || strings.HasPrefix(name, "refs/tags/")) && !strings.HasSuffix(name, "^{}")
+}
+
+type fileGitRemote struct {
+	dir string
+}
+
+func (f fileGitRemote) refs() (refs map[string]string, head string, err error) {
+	repo, err := openGitRepo(f.dir)
+	if err != nil {
+		return
+	}
+	defer repo.close()
+
+	all, err := repo.refs()
+	if err != nil {
+		return
+	}
+
+	refs = make(map[string]string)
+	for name, sha := range all {
+		if isMirroredRef(name) {
+			refs[name] = sha
+		}
+	}
+
+	head, _, err = repo.head(all)
+	return
+}
+
+func (f fileGitRemote) fetch(repo *gitRepo, wants []string, haves []string) (err error) {
+	source, err := openGitRepo(f.dir)
+	if err != nil {
+		return
+	}
+	defer source.close()
+
+	objects, err := repo.missingObjects(source.read, wants)
+	if err != nil {
+		return
+	}
+
+	return repo.writePack(objects)
+}
+
+type httpGitRemote struct {
+	url string
+}
+
+func (h httpGitRemote) refs() (refs map[string]string, head string, err error) {
+	resp, err := Registries.clientFor(h.url).Get(h.url + "/info/refs?service=git-upload-pack")
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+	if resp.Header.Get("Content-Type") != "application/x-git-upload-pack-advertisement" {
+		return nil, "", fmt.Errorf("%s is not a smart HTTP git server", h.url)
+	}
+
+	r := bufio.NewReader(resp.Body)
+	line, _, err := readPktLine(r)
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(string(line)) != "# service=git-upload-pack" {
+		return nil, "", fmt.Errorf("%s: unexpected response %q", h.url, line)
+	}
+
+	// the service announcement and the refs each end with a flush
+	refs = make(map[string]string)
+	for flushes := 0; flushes < 2; {
+		line, flush, err := readPktLine(r)
+		if err != nil {
+			return nil, "", err
+		}
+		if flush {
+			flushes++
+			continue
+		}
+
+		// the first ref carries the server's capabilities
+		ref := string(line)
+		if nul := strings.IndexByte(ref, 0); nul >= 0 {
+			for _, capability := range strings.Fields(ref[nul+1:]) {
+				if strings.HasPrefix(capability, "symref=HEAD:") {
+					head = strings.TrimPrefix(capability, "symref=HEAD:")
+				}
+			}
+			ref = ref[:nul]
+		}
+
+		fields := strings.Fields(ref)
+		if len(fields) == 2 && isMirroredRef(fields[1]) {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	return
+}
+
+func (h httpGitRemote) fetch(repo *gitRepo, wants []string, haves []string) (err error) {
+	var body bytes.Buffer
+	for i, want := range wants {
+		if i == 0 {
+			body.WriteString(pktLine("want " + want + " ofs-delta agent=npm-unwrap\n"))
+		} else {
+			body.WriteString(pktLine("want " + want + "\n"))
+		}
+	}
+	body.WriteString("0000")
+	for _, have := range haves {
+		body.WriteString(pktLine("have " + have + "\n"))
+	}
+	body.WriteString(pktLine("done\n"))
+
+	resp, err := Registries.clientFor(h.url).Post(h.url+"/git-upload-pack", "application/x-git-upload-pack-request", &body)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", h.url, resp.Status)
+	}
+
+	// the ACK or NAK lines ending the negotiation come before the pack
+	r := bufio.NewReader(resp.Body)
+	for {
+		start, err := r.Peek(4)
+		if err != nil {
+			return fmt.Errorf("%s: no pack in the response: %v", h.url, err)
+		}
+		if string(start) == "PACK" {
+			break
+		}
+
+		line, _, err := readPktLine(r)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(string(line), "ERR ") {
+			return fmt.Errorf("%s: %s", h.url, strings.TrimSpace(string(line[4:])))
+		}
+	}
+
+	objects, err := readPackStream(r, repo)
+	if err != nil {
+		return fmt.Errorf("%s: %v", h.url, err)
+	}
+
+	return repo.writePack(objects)
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+// readPktLine reads a pkt-line, reporting flush packets separately
+func readPktLine(r *bufio.Reader) (line []byte, flush bool, err error) {
+	header := make([]byte, 4)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+
+	length, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return nil, false, fmt.Errorf("bad pkt-line length %q", header)
+	}
+	if length == 0 {
+		return nil, true, nil
+	}
+	if length < 4 {
+		return nil, false, fmt.Errorf("bad pkt-line length %q", header)
+	}
+
+	line = make([]byte, length-4)
+	_, err = io.ReadFull(r, line)
+	return
+}
+
+// countingReader tracks the offset into a pack stream, reading no further
+// than the zlib streams in it ask for
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (n int, err error) {
+	n, err = c.r.Read(p)
+	c.n += int64(n)
+	return
+}
+
+func (c *countingReader) ReadByte() (b byte, err error) {
+	b, err = c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return
+}
+
+// readPackStream reads a packfile as it arrives, resolving its deltas
+// against earlier entries or, by name, objects repo already has
+func readPackStream(stream *bufio.Reader, repo *gitRepo) (objects []gitObject, err error) {
+	type packEntry struct {
+		obj        gitObject
+		baseOffset int64
+		baseName   string
+		resolved   bool
+	}
+
+	r := &countingReader{r: stream}
+	header := make([]byte, 12)
+	_, err = io.ReadFull(r, header)
+	if err != nil {
+		return
+	}
+	if string(header[:4]) != "PACK" {
+		return nil, fmt.Errorf("not a packfile")
+	}
+	count := int(header[8])<<24 | int(header[9])<<16 | int(header[10])<<8 | int(header[11])
+
+	entries := make([]*packEntry, 0, count)
+	byOffset := make(map[int64]*packEntry)
+	for i := 0; i < count; i++ {
+		offset := r.n
+		kind, size, err := readPackObjectHeader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &packEntry{obj: gitObject{kind: kind}}
+		switch kind {
+		case gitOfsDelta:
+			distance, err := readOfsDeltaDistance(r)
+			if err != nil {
+				return nil, err
+			}
+			entry.baseOffset = offset - distance
+		case gitRefDelta:
+			name := make([]byte, sha1.Size)
+			_, err = io.ReadFull(r, name)
+			if err != nil {
+				return nil, err
+			}
+			entry.baseName = hex.EncodeToString(name)
+		default:
+			entry.resolved = true
+		}
+
+		entry.obj.data, err = inflate(r, size)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+		byOffset[offset] = entry
+	}
+
+	// the trailing checksum
+	_, err = io.ReadFull(r, make([]byte, sha1.Size))
+	if err != nil {
+		return
+	}
+
+	byName := make(map[string]*packEntry)
+	for _, entry := range entries {
+		if entry.resolved {
+			byName[entry.obj.hash()] = entry
+		}
+	}
+
+	var resolve func(entry *packEntry, depth int) error
+	resolve = func(entry *packEntry, depth int) error {
+		if entry.resolved {
+			return nil
+		}
+		if depth > len(entries) {
+			return fmt.Errorf("delta cycle in pack")
+		}
+
+		var base gitObject
+		if entry.obj.kind == gitOfsDelta {
+			baseEntry, ok := byOffset[entry.baseOffset]
+			if !ok {
+				return fmt.Errorf("delta base at %d is not in the pack", entry.baseOffset)
+			}
+			err := resolve(baseEntry, depth+1)
+			if err != nil {
+				return err
+			}
+			base = baseEntry.obj
+		} else if baseEntry, ok := byName[entry.baseName]; ok {
+			base = baseEntry.obj
+		} else {
+			var err error
+			base, err = repo.read(entry.baseName)
+			if err != nil {
+				return err
+			}
+		}
+
+		data, err := applyDelta(base.data, entry.obj.data)
+		if err != nil {
+			return err
+		}
+
+		entry.obj = gitObject{kind: base.kind, data: data}
+		entry.resolved = true
+		byName[entry.obj.hash()] = entry
+		return nil
+	}
+
+	// ref-deltas may refer to entries resolved later, so keep going while
+	// that makes progress
+	for progress := true; progress; {
+		progress = false
+		for _, entry := range entries {
+			if entry.resolved {
+				continue
+			}
+			if resolve(entry, 0) == nil {
+				progress = true
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		if !entry.resolved {
+			return nil, resolve(entry, 0)
+		}
+		objects = append(objects, entry.obj)
+	}
+
+	return
+}
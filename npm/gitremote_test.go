@@ -0,0 +1,371 @@
+package npm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testGit runs git in dir, with an environment that doesn't depend on the
+// machine's configuration
+func testGit(t *testing.T, dir string, stdin string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"HOME="+dir, "GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	cmd.Stdin = strings.NewReader(stdin)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func commitFiles(t *testing.T, work string, message string, files map[string]string) string {
+	writeTree(t, work, files)
+	testGit(t, work, "", "add", "-A")
+	testGit(t, work, "", "commit", "-q", "-m", message)
+	return testGit(t, work, "", "rev-parse", "HEAD")
+}
+
+// a long file, so that later versions of it are stored as deltas
+func bigFile(changed int) string {
+	var b strings.Builder
+	for i := 0; i < 500; i++ {
+		if i == changed {
+			fmt.Fprintf(&b, "line %d was changed\n", i)
+		} else {
+			fmt.Fprintf(&b, "line %d of a file that is long enough to delta\n", i)
+		}
+	}
+
+	return b.String()
+}
+
+// testGitRepo creates a repository with a few commits on two branches and
+// a tag, and a bare clone of it with everything packed, deltas included
+func testGitRepo(t *testing.T) (work string, bare string) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	work = filepath.Join(dir, "work")
+	bare = filepath.Join(dir, "repo.git")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testGit(t, work, "", "init", "-q", "-b", "master")
+	commitFiles(t, work, "first", map[string]string{"big.txt": bigFile(-1), "package.json": `{"name": "pkg"}`})
+	commitFiles(t, work, "second", map[string]string{"big.txt": bigFile(10), "lib/index.js": "module.exports = 1\n"})
+	testGit(t, work, "", "tag", "-a", "v1.0.0", "-m", "release")
+	testGit(t, work, "", "checkout", "-q", "-b", "feature")
+	commitFiles(t, work, "third", map[string]string{"big.txt": bigFile(20)})
+	testGit(t, work, "", "checkout", "-q", "master")
+
+	testGit(t, dir, "", "clone", "-q", "--bare", work, bare)
+	testGit(t, bare, "", "repack", "-q", "-a", "-d", "-f", "--window=50", "--depth=50")
+
+	return
+}
+
+func sortedObjects(objects []gitObject) (shas []string) {
+	for _, obj := range objects {
+		shas = append(shas, obj.hash())
+	}
+	sort.Strings(shas)
+
+	return
+}
+
+func allObjects(t *testing.T, repo string, revs ...string) (shas []string) {
+	out := testGit(t, repo, "", append([]string{"rev-list", "--objects"}, revs...)...)
+	for _, line := range strings.Split(out, "\n") {
+		shas = append(shas, strings.Fields(line)[0])
+	}
+	sort.Strings(shas)
+
+	return
+}
+
+func TestReadPackStream(t *testing.T) {
+	_, bare := testGitRepo(t)
+
+	tests := []struct {
+		name string
+		args []string
+		revs string
+		have bool // the repository reading the pack already has master~1
+		want []string
+	}{
+		{"ofs-delta", []string{"--all", "--delta-base-offset"}, "", false, []string{"--all"}},
+		{"ref-delta", []string{"--all"}, "", false, []string{"--all"}},
+		{"thin", []string{"--thin", "--delta-base-offset"}, "feature\n^master~1\n", true, []string{"feature", "^master~1"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := append([]string{"pack-objects", "-q", "--revs", "--stdout", "--window=50", "--depth=50"}, test.args...)
+			pack := testGit(t, bare, test.revs, args...)
+
+			repo, err := initGitRepo(filepath.Join(t.TempDir(), "mirror"), bare)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer repo.close()
+			if test.have {
+				repo.close()
+				repo, err = openGitRepo(bare)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			objects, err := readPackStream(bufio.NewReader(strings.NewReader(pack)), repo)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := sortedObjects(objects)
+			want := allObjects(t, bare, test.want...)
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("got %d objects, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+func TestReadPackStreamErrors(t *testing.T) {
+	_, bare := testGitRepo(t)
+
+	repo, err := initGitRepo(filepath.Join(t.TempDir(), "mirror"), bare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.close()
+
+	thin := testGit(t, bare, "feature\n^master~1\n", "pack-objects", "-q", "--revs", "--stdout", "--thin")
+	tests := map[string]string{
+		"not a pack":   "PAKC\x00\x00\x00\x02\x00\x00\x00\x01",
+		"truncated":    thin[:len(thin)/2],
+		"missing base": thin,
+	}
+
+	for name, pack := range tests {
+		if _, err := readPackStream(bufio.NewReader(strings.NewReader(pack)), repo); err == nil {
+			t.Errorf("%s: read the pack", name)
+		}
+	}
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("hello, world")
+
+	tests := []struct {
+		name  string
+		delta []byte
+		want  string
+	}{
+		// sizes, then copy 7 bytes from offset 0 and insert "there"
+		{"copy and insert", []byte{12, 12, 0x91, 0, 7, 5, 't', 'h', 'e', 'r', 'e'}, "hello, there"},
+		{"insert only", []byte{12, 3, 3, 'a', 'b', 'c'}, "abc"},
+		{"copy with offset", []byte{12, 5, 0x91, 7, 5}, "world"},
+	}
+
+	for _, test := range tests {
+		got, err := applyDelta(base, test.delta)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	bad := map[string][]byte{
+		"wrong base size":   {11, 5, 0x91, 7, 5},
+		"copy past the end": {12, 6, 0x91, 7, 6},
+		"wrong result size": {12, 6, 0x91, 7, 5},
+		"short insert":      {12, 3, 5, 'a'},
+		"zero opcode":       {12, 0, 0},
+	}
+	for name, delta := range bad {
+		if _, err := applyDelta(base, delta); err == nil {
+			t.Errorf("%s: applied the delta", name)
+		}
+	}
+}
+
+func TestReadPktLine(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("000ahello\n00000004"))
+
+	line, flush, err := readPktLine(r)
+	if err != nil || flush || string(line) != "hello\n" {
+		t.Errorf("got %q, %v, %v", line, flush, err)
+	}
+	line, flush, err = readPktLine(r)
+	if err != nil || !flush || line != nil {
+		t.Errorf("got %q, %v, %v for a flush", line, flush, err)
+	}
+	line, flush, err = readPktLine(r)
+	if err != nil || flush || len(line) != 0 {
+		t.Errorf("got %q, %v, %v for an empty line", line, flush, err)
+	}
+
+	for _, bad := range []string{"zzzz", "0003", "0010short"} {
+		if _, _, err := readPktLine(bufio.NewReader(strings.NewReader(bad))); err == nil {
+			t.Errorf("read %q", bad)
+		}
+	}
+
+	if got := pktLine("want abc\n"); got != "000dwant abc\n" {
+		t.Errorf("pktLine: got %q", got)
+	}
+}
+
+// serveGit serves the repositories in root over smart HTTP, with git's own
+// http-backend
+func serveGit(t *testing.T, root string) *httptest.Server {
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git is not installed")
+	}
+	backend := filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")
+	if _, err := os.Stat(backend); err != nil {
+		t.Skip("git-http-backend is not installed")
+	}
+
+	server := httptest.NewServer(&cgi.Handler{
+		Path:   backend,
+		Env:    []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+		Stderr: ioutil.Discard,
+	})
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func checkMirror(t *testing.T, mirror string, bare string) {
+	t.Helper()
+
+	testGit(t, mirror, "", "fsck", "--strict", "--no-dangling")
+
+	refs := "for-each-ref --format=%(refname) %(objectname)"
+	got := testGit(t, mirror, "", strings.Fields(refs)...)
+	want := testGit(t, bare, "", strings.Fields(refs)...)
+	if got != want {
+		t.Errorf("mirror has refs\n%s\nwant\n%s", got, want)
+	}
+	if got, want := testGit(t, mirror, "", "symbolic-ref", "HEAD"), testGit(t, bare, "", "symbolic-ref", "HEAD"); got != want {
+		t.Errorf("mirror HEAD is %s, want %s", got, want)
+	}
+}
+
+func TestNativeGitMirror(t *testing.T) {
+	work, bare := testGitRepo(t)
+	server := serveGit(t, filepath.Dir(bare))
+
+	urls := map[string]string{
+		"path": bare,
+		"file": "file://" + filepath.ToSlash(bare),
+		"http": server.URL + "/" + filepath.Base(bare),
+	}
+
+	// the transports take turns changing the repository
+	for _, name := range []string{"path", "file", "http"} {
+		t.Run(name, func(t *testing.T) {
+			mirror := filepath.Join(t.TempDir(), "mirror")
+			err := nativeGit{}.cloneMirror(urls[name], mirror)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMirror(t, mirror, bare)
+
+			// new commits arrive as loose objects, and are fetched
+			// against what the mirror has
+			commitFiles(t, work, "more from "+name, map[string]string{"big.txt": bigFile(30), name: name})
+			testGit(t, work, "", "push", "-q", bare, "master")
+			testGit(t, work, "", "push", "-q", bare, ":refs/heads/feature")
+
+			err = nativeGit{}.fetchMirror(urls[name], mirror)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkMirror(t, mirror, bare)
+			testGit(t, work, "", "push", "-q", bare, "feature:feature")
+
+			repo, err := openGitRepo(mirror)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer repo.close()
+
+			commit, err := repo.resolve("master")
+			if err != nil {
+				t.Fatal(err)
+			}
+			target := filepath.Join(t.TempDir(), "checkout")
+			err = repo.checkout(commit, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, file := range []string{"big.txt", "lib/index.js", "package.json", name} {
+				got, err := ioutil.ReadFile(filepath.Join(target, filepath.FromSlash(file)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := testGit(t, bare, "", "show", "master:"+file); strings.TrimSpace(string(got)) != want {
+					t.Errorf("checked out %s differs from git's", file)
+				}
+			}
+		})
+	}
+}
+
+func TestOpenGitRemote(t *testing.T) {
+	tests := []struct {
+		url  string
+		want gitRemote
+	}{
+		{"https://example.com/u/repo.git/", httpGitRemote{url: "https://example.com/u/repo.git"}},
+		{"http://example.com/u/repo.git", httpGitRemote{url: "http://example.com/u/repo.git"}},
+		{"file:///srv/repo.git", fileGitRemote{dir: filepath.FromSlash("/srv/repo.git")}},
+	}
+
+	for _, test := range tests {
+		got, err := openGitRemote(test.url)
+		if err != nil {
+			t.Errorf("%s: %v", test.url, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %#v, want %#v", test.url, got, test.want)
+		}
+	}
+
+	for _, url := range []string{"ssh://git@example.com/u/repo.git", "git://example.com/u/repo.git", "git@example.com:u/repo.git"} {
+		if _, err := openGitRemote(url); err == nil {
+			t.Errorf("%s: no error for a URL that needs git", url)
+		}
+	}
+}
@@ -0,0 +1,1070 @@
+package npm
+
+// just enough of git's repository format to fetch into and check out from
+// bare repositories without the git binary: loose objects, packfiles with
+// version 2 indexes, and loose and packed refs. Fetched objects are written
+// as a new pack, whose index is renamed into place last, so an interrupted
+// fetch never leaves a commit behind without the objects it refers to.
+// see https://git-scm.com/docs/gitformat-pack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type gitObjectType int
+
+const (
+	gitCommit   gitObjectType = 1
+	gitTree     gitObjectType = 2
+	gitBlob     gitObjectType = 3
+	gitTag      gitObjectType = 4
+	gitOfsDelta gitObjectType = 6
+	gitRefDelta gitObjectType = 7
+)
+
+var gitTypeNames = map[gitObjectType]string{gitCommit: "commit", gitTree: "tree", gitBlob: "blob", gitTag: "tag"}
+
+type gitObject struct {
+	kind gitObjectType
+	data []byte
+}
+
+func (o gitObject) hash() string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", gitTypeNames[o.kind], len(o.data))
+	h.Write(o.data)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type gitRepo struct {
+	dir   string
+	packs []*gitPack
+}
+
+// openGitRepo opens the bare repository in dir, or the one in dir/.git
+func openGitRepo(dir string) (r *gitRepo, err error) {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		dir = filepath.Join(dir, ".git")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "objects")); err != nil {
+		return nil, fmt.Errorf("%s is not a git repository", dir)
+	}
+
+	r = &gitRepo{dir: dir}
+	indexes, err := filepath.Glob(filepath.Join(dir, "objects", "pack", "pack-*.idx"))
+	if err != nil {
+		return
+	}
+
+	for _, index := range indexes {
+		err = r.addPack(index)
+		if err != nil {
+			r.close()
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// initGitRepo creates a bare repository in dir to mirror the remote at url,
+// set up so that the git binary can fetch into it as well
+func initGitRepo(dir string, url string) (r *gitRepo, err error) {
+	for _, sub := range []string{"objects/pack", "refs/heads", "refs/tags"} {
+		err = os.MkdirAll(filepath.Join(dir, filepath.FromSlash(sub)), 0755)
+		if err != nil {
+			return
+		}
+	}
+
+	config := "[core]\n\trepositoryformatversion = 0\n\tbare = true\n" +
+		fmt.Sprintf("[remote \"origin\"]\n\turl = %s\n\tfetch = +refs/*:refs/*\n\tmirror = true\n", url)
+	err = ioutil.WriteFile(filepath.Join(dir, "config"), []byte(config), 0644)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "HEAD"), []byte("ref: refs/heads/master\n"), 0644)
+	if err != nil {
+		return
+	}
+
+	return openGitRepo(dir)
+}
+
+func (r *gitRepo) close() {
+	for _, p := range r.packs {
+		p.file.Close()
+	}
+	r.packs = nil
+}
+
+func (r *gitRepo) addPack(index string) (err error) {
+	p, err := openGitPack(index)
+	if err != nil {
+		return
+	}
+
+	r.packs = append(r.packs, p)
+	return
+}
+
+func (r *gitRepo) loosePath(sha string) string {
+	return filepath.Join(r.dir, "objects", sha[:2], sha[2:])
+}
+
+func (r *gitRepo) has(sha string) bool {
+	if len(sha) != 40 {
+		return false
+	}
+
+	name, err := hex.DecodeString(sha)
+	if err != nil {
+		return false
+	}
+	for _, p := range r.packs {
+		if _, ok := p.find(name); ok {
+			return true
+		}
+	}
+
+	_, err = os.Stat(r.loosePath(sha))
+	return err == nil
+}
+
+func (r *gitRepo) read(sha string) (obj gitObject, err error) {
+	name, err := hex.DecodeString(sha)
+	if err != nil || len(name) != sha1.Size {
+		return obj, fmt.Errorf("invalid object name %s", sha)
+	}
+
+	for _, p := range r.packs {
+		if offset, ok := p.find(name); ok {
+			return p.readAt(r, offset)
+		}
+	}
+
+	f, err := os.Open(r.loosePath(sha))
+	if os.IsNotExist(err) {
+		return obj, fmt.Errorf("object %s is missing from %s", sha, r.dir)
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return readLooseObject(f)
+}
+
+func readLooseObject(f io.Reader) (obj gitObject, err error) {
+	z, err := zlib.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	content, err := ioutil.ReadAll(z)
+	if err != nil {
+		return
+	}
+
+	nul := bytes.IndexByte(content, 0)
+	if nul < 0 {
+		return obj, errors.New("corrupt loose object")
+	}
+
+	fields := strings.Fields(string(content[:nul]))
+	if len(fields) != 2 {
+		return obj, errors.New("corrupt loose object")
+	}
+	for kind, name := range gitTypeNames {
+		if name == fields[0] {
+			obj.kind = kind
+		}
+	}
+	if obj.kind == 0 {
+		return obj, fmt.Errorf("unknown object type %s", fields[0])
+	}
+
+	obj.data = content[nul+1:]
+	return
+}
+
+// findPrefix lists the objects whose names start with prefix
+func (r *gitRepo) findPrefix(prefix string) (shas []string) {
+	prefix = strings.ToLower(prefix)
+	seen := make(map[string]bool)
+
+	for _, p := range r.packs {
+		for _, sha := range p.findPrefix(prefix) {
+			seen[sha] = true
+		}
+	}
+
+	if len(prefix) >= 2 {
+		names, _ := readDirNames(filepath.Join(r.dir, "objects", prefix[:2]))
+		for _, name := range names {
+			if strings.HasPrefix(prefix[:2]+name, prefix) {
+				seen[prefix[:2]+name] = true
+			}
+		}
+	}
+
+	for sha := range seen {
+		shas = append(shas, sha)
+	}
+	sort.Strings(shas)
+
+	return
+}
+
+// refs lists the repository's refs, loose refs taking precedence over
+// packed ones
+func (r *gitRepo) refs() (refs map[string]string, err error) {
+	refs = make(map[string]string)
+
+	packed, err := ioutil.ReadFile(filepath.Join(r.dir, "packed-refs"))
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		// peeled tags follow their tag on a line starting with ^
+		fields := strings.Fields(line)
+		if len(fields) == 2 && len(fields[0]) == 40 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	refsDir := filepath.Join(r.dir, "refs")
+	err = filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(r.dir, path)
+		if err != nil {
+			return err
+		}
+
+		if sha := strings.TrimSpace(string(content)); len(sha) == 40 {
+			refs[filepath.ToSlash(rel)] = sha
+		}
+		return nil
+	})
+
+	return
+}
+
+// head returns the ref HEAD points to, or "" if it's detached, and the
+// commit it is at
+func (r *gitRepo) head(refs map[string]string) (ref string, sha string, err error) {
+	content, err := ioutil.ReadFile(filepath.Join(r.dir, "HEAD"))
+	if err != nil {
+		return
+	}
+
+	head := strings.TrimSpace(string(content))
+	if strings.HasPrefix(head, "ref: ") {
+		ref = strings.TrimPrefix(head, "ref: ")
+		return ref, refs[ref], nil
+	}
+
+	return "", head, nil
+}
+
+// writeRefs replaces all the repository's refs with refs, HEAD pointing to
+// head
+func (r *gitRepo) writeRefs(refs map[string]string, head string) (err error) {
+	for _, sub := range []string{"heads", "tags"} {
+		dir := filepath.Join(r.dir, "refs", sub)
+		err = os.RemoveAll(dir)
+		if err == nil {
+			err = os.MkdirAll(dir, 0755)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var packed bytes.Buffer
+	packed.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for _, name := range names {
+		fmt.Fprintf(&packed, "%s %s\n", refs[name], name)
+	}
+
+	err = writeFileAtomic(filepath.Join(r.dir, "packed-refs"), packed.Bytes())
+	if err != nil || head == "" {
+		return
+	}
+
+	return writeFileAtomic(filepath.Join(r.dir, "HEAD"), []byte("ref: "+head+"\n"))
+}
+
+func writeFileAtomic(path string, content []byte) (err error) {
+	partial := path + ".lock"
+	err = ioutil.WriteFile(partial, content, 0644)
+	if err != nil {
+		return
+	}
+
+	return os.Rename(partial, path)
+}
+
+// resolve finds the commit a ref, tag, branch or (possibly abbreviated)
+// commit name refers to, like git rev-parse name^{commit}
+func (r *gitRepo) resolve(name string) (commit string, err error) {
+	refs, err := r.refs()
+	if err != nil {
+		return
+	}
+
+	sha := ""
+	if name == "HEAD" {
+		_, sha, err = r.head(refs)
+		if err != nil {
+			return
+		}
+	}
+	for _, candidate := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name} {
+		if sha != "" {
+			break
+		}
+		sha = refs[candidate]
+	}
+
+	if sha == "" && commitRe.MatchString(name) {
+		matches := r.findPrefix(name)
+		if len(matches) > 1 {
+			return "", fmt.Errorf("%s is ambiguous", name)
+		}
+		if len(matches) == 1 {
+			sha = matches[0]
+		}
+	}
+
+	if sha == "" {
+		return "", fmt.Errorf("no commit %s", name)
+	}
+
+	return r.peel(sha)
+}
+
+// peel follows tags to the commit they're for
+func (r *gitRepo) peel(sha string) (commit string, err error) {
+	for {
+		obj, err := r.read(sha)
+		if err != nil {
+			return "", err
+		}
+
+		switch obj.kind {
+		case gitCommit:
+			return sha, nil
+		case gitTag:
+			sha = objectHeader(obj.data, "object")
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", sha, gitTypeNames[obj.kind])
+		}
+	}
+}
+
+// objectHeader returns the first value of a header field of a commit or tag
+func objectHeader(data []byte, field string) string {
+	values := objectHeaders(data, field)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func objectHeaders(data []byte, field string) (values []string) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			// the message follows the headers
+			break
+		}
+		if strings.HasPrefix(line, field+" ") {
+			values = append(values, strings.TrimPrefix(line, field+" "))
+		}
+	}
+
+	return
+}
+
+type gitTreeEntry struct {
+	mode string
+	name string
+	sha  string
+}
+
+func parseGitTree(data []byte) (entries []gitTreeEntry, err error) {
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || len(data) < nul+1+sha1.Size {
+			return nil, errors.New("corrupt tree")
+		}
+
+		entries = append(entries, gitTreeEntry{
+			mode: string(data[:space]),
+			name: string(data[space+1 : nul]),
+			sha:  hex.EncodeToString(data[nul+1 : nul+1+sha1.Size]),
+		})
+		data = data[nul+1+sha1.Size:]
+	}
+
+	return
+}
+
+// links lists the objects an object refers to, submodules aside
+func (o gitObject) links() (shas []string, err error) {
+	switch o.kind {
+	case gitCommit:
+		shas = append(shas, objectHeader(o.data, "tree"))
+		shas = append(shas, objectHeaders(o.data, "parent")...)
+	case gitTag:
+		shas = append(shas, objectHeader(o.data, "object"))
+	case gitTree:
+		entries, err := parseGitTree(o.data)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.mode != "160000" {
+				shas = append(shas, entry.sha)
+			}
+		}
+	}
+
+	return
+}
+
+// checkout writes the files of commit into target, replacing whatever was
+// there, as git archive would
+func (r *gitRepo) checkout(commit string, target string) (err error) {
+	tree, err := r.commitTree(commit)
+	if err != nil {
+		return
+	}
+
+	err = os.RemoveAll(target)
+	if err != nil {
+		return
+	}
+
+	return r.checkoutTree(tree, target)
+}
+
+func (r *gitRepo) checkoutTree(sha string, dir string) (err error) {
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+
+	obj, err := r.read(sha)
+	if err != nil {
+		return
+	}
+	entries, err := parseGitTree(obj.data)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.name == "" || entry.name == "." || entry.name == ".." || strings.ContainsAny(entry.name, `/\`) {
+			return fmt.Errorf("unsafe path %q in tree %s", entry.name, sha)
+		}
+		path := filepath.Join(dir, entry.name)
+
+		switch entry.mode {
+		case "40000":
+			err = r.checkoutTree(entry.sha, path)
+		case "160000":
+			// submodules are left empty, as git archive does
+			err = os.MkdirAll(path, 0755)
+		case "120000":
+			blob, readErr := r.read(entry.sha)
+			if readErr != nil {
+				return readErr
+			}
+			err = os.Symlink(string(blob.data), path)
+		default:
+			blob, readErr := r.read(entry.sha)
+			if readErr != nil {
+				return readErr
+			}
+			mode := os.FileMode(0644)
+			if entry.mode == "100755" {
+				mode = 0755
+			}
+			err = ioutil.WriteFile(path, blob.data, mode)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// commitTree returns the root tree of a commit
+func (r *gitRepo) commitTree(commit string) (tree string, err error) {
+	obj, err := r.read(commit)
+	if err != nil {
+		return
+	}
+	if obj.kind != gitCommit {
+		return "", fmt.Errorf("%s is not a commit", commit)
+	}
+
+	return objectHeader(obj.data, "tree"), nil
+}
+
+// readPath returns the content of the file at the slash-separated path in
+// commit
+func (r *gitRepo) readPath(commit string, path string) (content []byte, err error) {
+	sha, err := r.commitTree(commit)
+	if err != nil {
+		return
+	}
+
+	for _, name := range strings.Split(path, "/") {
+		obj, err := r.read(sha)
+		if err != nil {
+			return nil, err
+		}
+		if obj.kind != gitTree {
+			return nil, fmt.Errorf("no %s in %s", path, commit)
+		}
+		entries, err := parseGitTree(obj.data)
+		if err != nil {
+			return nil, err
+		}
+
+		sha = ""
+		for _, entry := range entries {
+			if entry.name == name {
+				sha = entry.sha
+			}
+		}
+		if sha == "" {
+			return nil, fmt.Errorf("no %s in %s", path, commit)
+		}
+	}
+
+	obj, err := r.read(sha)
+	if err != nil {
+		return
+	}
+	if obj.kind != gitBlob {
+		return nil, fmt.Errorf("%s is not a file in %s", path, commit)
+	}
+
+	return obj.data, nil
+}
+
+// gitlinks lists the commits of the submodules in commit, by path
+func (r *gitRepo) gitlinks(commit string) (links map[string]string, err error) {
+	tree, err := r.commitTree(commit)
+	if err != nil {
+		return
+	}
+
+	links = make(map[string]string)
+	var walk func(sha string, dir string) error
+	walk = func(sha string, dir string) error {
+		obj, err := r.read(sha)
+		if err != nil {
+			return err
+		}
+		entries, err := parseGitTree(obj.data)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			path := entry.name
+			if dir != "" {
+				path = dir + "/" + entry.name
+			}
+
+			switch entry.mode {
+			case "160000":
+				links[path] = entry.sha
+			case "40000":
+				err = walk(entry.sha, path)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return links, walk(tree, "")
+}
+
+// gitPack is a packfile, looked up through its index
+type gitPack struct {
+	file    *os.File
+	names   []byte // sorted 20-byte object names
+	offsets []int64
+	fanout  [256]uint32
+
+	// recently read objects, which delta chains often share
+	cache map[int64]gitObject
+}
+
+const gitPackCacheSize = 1024
+
+func openGitPack(index string) (p *gitPack, err error) {
+	idx, err := ioutil.ReadFile(index)
+	if err != nil {
+		return
+	}
+
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte("\xfftOc")) || binary.BigEndian.Uint32(idx[4:]) != 2 {
+		return nil, fmt.Errorf("%s: unsupported pack index", index)
+	}
+
+	p = &gitPack{cache: make(map[int64]gitObject)}
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(idx[8+4*i:])
+	}
+
+	count := int(p.fanout[255])
+	namesAt := 8 + 256*4
+	offsetsAt := namesAt + count*sha1.Size + count*4
+	largeAt := offsetsAt + count*4
+	if len(idx) < largeAt {
+		return nil, fmt.Errorf("%s: truncated pack index", index)
+	}
+
+	p.names = idx[namesAt : namesAt+count*sha1.Size]
+	p.offsets = make([]int64, count)
+	for i := range p.offsets {
+		offset := binary.BigEndian.Uint32(idx[offsetsAt+4*i:])
+		if offset&0x80000000 == 0 {
+			p.offsets[i] = int64(offset)
+			continue
+		}
+
+		large := largeAt + 8*int(offset&0x7fffffff)
+		if len(idx) < large+8 {
+			return nil, fmt.Errorf("%s: truncated pack index", index)
+		}
+		p.offsets[i] = int64(binary.BigEndian.Uint64(idx[large:]))
+	}
+
+	p.file, err = os.Open(strings.TrimSuffix(index, ".idx") + ".pack")
+	return
+}
+
+func (p *gitPack) name(i int) []byte {
+	return p.names[i*sha1.Size : (i+1)*sha1.Size]
+}
+
+func (p *gitPack) find(name []byte) (offset int64, ok bool) {
+	lo := 0
+	if name[0] > 0 {
+		lo = int(p.fanout[name[0]-1])
+	}
+	hi := int(p.fanout[name[0]])
+
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.name(lo+i), name) >= 0
+	})
+	if i < hi && bytes.Equal(p.name(i), name) {
+		return p.offsets[i], true
+	}
+
+	return 0, false
+}
+
+func (p *gitPack) findPrefix(prefix string) (shas []string) {
+	for i := range p.offsets {
+		if sha := hex.EncodeToString(p.name(i)); strings.HasPrefix(sha, prefix) {
+			shas = append(shas, sha)
+		}
+	}
+
+	return
+}
+
+func (p *gitPack) readAt(r *gitRepo, offset int64) (obj gitObject, err error) {
+	if obj, ok := p.cache[offset]; ok {
+		return obj, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+	kind, size, err := readPackObjectHeader(reader)
+	if err != nil {
+		return
+	}
+
+	var base gitObject
+	switch kind {
+	case gitOfsDelta:
+		distance, err := readOfsDeltaDistance(reader)
+		if err != nil {
+			return obj, err
+		}
+		base, err = p.readAt(r, offset-distance)
+		if err != nil {
+			return obj, err
+		}
+	case gitRefDelta:
+		name := make([]byte, sha1.Size)
+		_, err = io.ReadFull(reader, name)
+		if err != nil {
+			return
+		}
+		base, err = r.read(hex.EncodeToString(name))
+		if err != nil {
+			return
+		}
+	}
+
+	data, err := inflate(reader, size)
+	if err != nil {
+		return
+	}
+
+	obj = gitObject{kind: kind, data: data}
+	if kind == gitOfsDelta || kind == gitRefDelta {
+		obj.kind = base.kind
+		obj.data, err = applyDelta(base.data, data)
+		if err != nil {
+			return
+		}
+	}
+
+	if len(p.cache) >= gitPackCacheSize {
+		p.cache = make(map[int64]gitObject)
+	}
+	p.cache[offset] = obj
+
+	return
+}
+
+// readPackObjectHeader reads the type and inflated size of a pack entry
+func readPackObjectHeader(r io.ByteReader) (kind gitObjectType, size int64, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	kind = gitObjectType(b >> 4 & 7)
+	size = int64(b & 0x0f)
+	for shift := uint(4); b&0x80 != 0; shift += 7 {
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		size |= int64(b&0x7f) << shift
+	}
+
+	return
+}
+
+// readOfsDeltaDistance reads how far before an ofs-delta its base starts
+func readOfsDeltaDistance(r io.ByteReader) (distance int64, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+
+	distance = int64(b & 0x7f)
+	for b&0x80 != 0 {
+		b, err = r.ReadByte()
+		if err != nil {
+			return
+		}
+		distance = (distance+1)<<7 | int64(b&0x7f)
+	}
+
+	return
+}
+
+// inflate reads a zlib stream of size bytes, up to its end, so that r is
+// left at whatever follows it
+func inflate(r io.Reader, size int64) (data []byte, err error) {
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return
+	}
+	defer z.Close()
+
+	data = make([]byte, 0, size)
+	buf := bytes.NewBuffer(data)
+	_, err = io.Copy(buf, z)
+	if err != nil {
+		return
+	}
+	if int64(buf.Len()) != size {
+		return nil, fmt.Errorf("pack entry is %d bytes, expected %d", buf.Len(), size)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// applyDelta rebuilds an object from its base and a delta against it
+func applyDelta(base []byte, delta []byte) (result []byte, err error) {
+	readSize := func() (size int) {
+		for shift := uint(0); len(delta) > 0; shift += 7 {
+			b := delta[0]
+			delta = delta[1:]
+			size |= int(b&0x7f) << shift
+			if b&0x80 == 0 {
+				break
+			}
+		}
+		return
+	}
+
+	if readSize() != len(base) {
+		return nil, errors.New("delta doesn't match its base")
+	}
+	result = make([]byte, 0, readSize())
+
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		if op&0x80 == 0 {
+			// insert the next op bytes
+			if op == 0 || int(op) > len(delta) {
+				return nil, errors.New("corrupt delta")
+			}
+			result = append(result, delta[:op]...)
+			delta = delta[op:]
+			continue
+		}
+
+		// copy from the base, with the offset and size bytes present
+		// flagged in op
+		var offset, size int
+		for i := uint(0); i < 7; i++ {
+			if op&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, errors.New("corrupt delta")
+			}
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				size |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if offset+size > len(base) {
+			return nil, errors.New("corrupt delta")
+		}
+		result = append(result, base[offset:offset+size]...)
+	}
+
+	if len(result) != cap(result) {
+		return nil, errors.New("delta produced the wrong size")
+	}
+
+	return
+}
+
+// writePack adds objects to the repository as a new, undeltified pack
+func (r *gitRepo) writePack(objects []gitObject) (err error) {
+	if len(objects) == 0 {
+		return
+	}
+
+	packDir := filepath.Join(r.dir, "objects", "pack")
+	err = os.MkdirAll(packDir, 0755)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(packDir, "tmp_pack_")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	type indexEntry struct {
+		name   []byte
+		crc    uint32
+		offset int64
+	}
+	entries := make([]indexEntry, 0, len(objects))
+
+	packHash := sha1.New()
+	w := bufio.NewWriter(io.MultiWriter(tmp, packHash))
+	offset := int64(12)
+
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	w.Write(header)
+
+	for _, obj := range objects {
+		var entry bytes.Buffer
+		size := len(obj.data)
+		b := byte(obj.kind)<<4 | byte(size&0x0f)
+		size >>= 4
+		for size > 0 {
+			entry.WriteByte(b | 0x80)
+			b = byte(size & 0x7f)
+			size >>= 7
+		}
+		entry.WriteByte(b)
+
+		z := zlib.NewWriter(&entry)
+		z.Write(obj.data)
+		err = z.Close()
+		if err != nil {
+			return
+		}
+
+		name, _ := hex.DecodeString(obj.hash())
+		entries = append(entries, indexEntry{name: name, crc: crc32.ChecksumIEEE(entry.Bytes()), offset: offset})
+		offset += int64(entry.Len())
+
+		_, err = w.Write(entry.Bytes())
+		if err != nil {
+			return
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return
+	}
+	packSum := packHash.Sum(nil)
+	_, err = tmp.Write(packSum)
+	if err != nil {
+		return
+	}
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].name, entries[j].name) < 0 })
+
+	var idx bytes.Buffer
+	idx.WriteString("\xfftOc")
+	binary.Write(&idx, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, e := range entries {
+		for i := int(e.name[0]); i < 256; i++ {
+			fanout[i]++
+		}
+	}
+	binary.Write(&idx, binary.BigEndian, fanout)
+
+	for _, e := range entries {
+		idx.Write(e.name)
+	}
+	for _, e := range entries {
+		binary.Write(&idx, binary.BigEndian, e.crc)
+	}
+
+	var large []int64
+	for _, e := range entries {
+		if e.offset < 0x80000000 {
+			binary.Write(&idx, binary.BigEndian, uint32(e.offset))
+			continue
+		}
+		binary.Write(&idx, binary.BigEndian, uint32(0x80000000|len(large)))
+		large = append(large, e.offset)
+	}
+	for _, offset := range large {
+		binary.Write(&idx, binary.BigEndian, uint64(offset))
+	}
+
+	idx.Write(packSum)
+	idxSum := sha1.Sum(idx.Bytes())
+	idx.Write(idxSum[:])
+
+	base := filepath.Join(packDir, "pack-"+hex.EncodeToString(packSum))
+	err = os.Rename(tmp.Name(), base+".pack")
+	if err != nil {
+		return
+	}
+
+	// the pack isn't seen until its index is in place
+	err = writeFileAtomic(base+".idx", idx.Bytes())
+	if err != nil {
+		return
+	}
+
+	return r.addPack(base + ".idx")
+}
+
+// missingObjects lists the objects reachable from wants that r doesn't have
+// yet, reading them from source. A repository having an object is taken to
+// mean it has everything that object refers to as well.
+func (r *gitRepo) missingObjects(source func(sha string) (gitObject, error), wants []string) (objects []gitObject, err error) {
+	seen := make(map[string]bool)
+	stack := append([]string(nil), wants...)
+
+	for len(stack) > 0 {
+		sha := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[sha] || r.has(sha) {
+			continue
+		}
+		seen[sha] = true
+
+		obj, err := source(sha)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+
+		links, err := obj.links()
+		if err != nil {
+			return nil, err
+		}
+		stack = append(stack, links...)
+	}
+
+	return
+}
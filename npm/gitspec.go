@@ -0,0 +1,156 @@
+package npm
+
+// git dependency specs, in all the forms npm accepts:
+//
+//	git+ssh://git@host/user/repo.git#ref   git+https://, git+http://, git+file://
+//	git+ssh://git@host:user/repo.git#ref   scp-style paths
+//	git://host/user/repo.git#ref
+//	git@host:user/repo.git#ref
+//	github:user/repo#ref                   also gitlab:, bitbucket: and gist:
+//	user/repo#ref                          GitHub
+//
+// where the ref is a branch, tag or commit, `semver:<range>` for the highest
+// tag matching the range, or missing for the remote's default branch.
+// see https://docs.npmjs.com/cli/configuring-npm/package-json#git-urls-as-dependencies
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type GitUrl struct {
+	Url   string // what to clone
+	Ref   string // a branch, tag or commit; empty for the default branch
+	Range string // from #semver:, the range of tags to pick the highest of
+}
+
+// clone URLs of the hosts npm has shorthands for
+var hostedGitUrls = map[string]string{
+	"github":    "https://github.com/%s.git",
+	"gitlab":    "https://gitlab.com/%s.git",
+	"bitbucket": "https://bitbucket.org/%s.git",
+	"gist":      "https://gist.github.com/%s.git",
+}
+
+var (
+	hostedShorthandRe = regexp.MustCompile(`^(github|gitlab|bitbucket|gist):([^#]+)$`)
+	githubShorthandRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*/[A-Za-z0-9_.-]+$`)
+	scpLikeRe         = regexp.MustCompile(`^[A-Za-z0-9_.-]+@[A-Za-z0-9_.-]+:[^/]`)
+	sshScpPathRe      = regexp.MustCompile(`^ssh://([^/]+@)?([^/:]+):([^0-9/][^/]*/.*)$`)
+	commitRe          = regexp.MustCompile(`^[0-9a-fA-F]{7,40}$`)
+)
+
+func GitUrlFromString(str string) (gitUrl GitUrl, err error) {
+	spec, fragment := str, ""
+	if hash := strings.Index(str, "#"); hash >= 0 {
+		spec, fragment = str[:hash], str[hash+1:]
+	}
+
+	switch {
+	case strings.HasPrefix(spec, "git+"):
+		gitUrl.Url = strings.TrimPrefix(spec, "git+")
+		// git+ssh://git@host:user/repo is scp syntax behind a URL scheme
+		if groups := sshScpPathRe.FindStringSubmatch(gitUrl.Url); groups != nil {
+			gitUrl.Url = groups[1] + groups[2] + ":" + groups[3]
+		}
+	case strings.HasPrefix(spec, "git://"), scpLikeRe.MatchString(spec):
+		gitUrl.Url = spec
+	case hostedShorthandRe.MatchString(spec):
+		groups := hostedShorthandRe.FindStringSubmatch(spec)
+		gitUrl.Url = fmt.Sprintf(hostedGitUrls[groups[1]], strings.TrimSuffix(groups[2], ".git"))
+	case githubShorthandRe.MatchString(spec):
+		gitUrl.Url = fmt.Sprintf(hostedGitUrls["github"], strings.TrimSuffix(spec, ".git"))
+	default:
+		return gitUrl, errors.New("gitUrl: not a valid git url: " + str)
+	}
+
+	// the fragment holds a committish or semver: range, possibly with other
+	// ::-separated options, which we don't support
+	for _, part := range strings.Split(fragment, "::") {
+		switch {
+		case part == "":
+		case strings.HasPrefix(part, "semver:"):
+			gitUrl.Range, err = url.PathUnescape(strings.TrimPrefix(part, "semver:"))
+			if err != nil {
+				return gitUrl, fmt.Errorf("gitUrl: bad semver range in %s: %v", str, err)
+			}
+		case strings.Contains(part, ":"):
+			return gitUrl, fmt.Errorf("gitUrl: unsupported option %q in %s", part, str)
+		default:
+			gitUrl.Ref = part
+		}
+	}
+
+	if gitUrl.Ref != "" && gitUrl.Range != "" {
+		return gitUrl, fmt.Errorf("gitUrl: %s has both a ref and a semver range", str)
+	}
+
+	return
+}
+
+// IsCommit reports whether the ref looks like a commit SHA rather than the
+// name of a branch or tag
+func (g GitUrl) IsCommit() bool {
+	return commitRe.MatchString(g.Ref)
+}
+
+func (g GitUrl) String() string {
+	switch {
+	case g.Range != "":
+		return fmt.Sprintf("%s#semver:%s", g.Url, g.Range)
+	case g.Ref != "":
+		return fmt.Sprintf("%s#%s", g.Url, g.Ref)
+	}
+
+	return g.Url
+}
+
+// dirName names the checkout of the module name at this ref
+func (g GitUrl) dirName(name string) string {
+	ref := g.Ref
+	if g.Range != "" {
+		ref = "semver-" + g.Range
+	} else if ref == "" {
+		ref = "HEAD"
+	}
+
+	return fmt.Sprintf("%s__%s", name, url.PathEscape(ref))
+}
+
+// GitSpec returns the git URL of a module installed from git. npm records it
+// in resolved, or, for older shrinkwraps and hosted shorthands, in version.
+// When the lockfile records the commit anywhere, the URL is pinned to it, so
+// a branch that has moved on since doesn't change what gets installed.
+func (m Module) GitSpec() (spec GitUrl, ok bool) {
+	for _, s := range []string{m.Resolved, m.Version} {
+		if gitUrl, err := GitUrlFromString(s); err == nil {
+			spec, ok = gitUrl, true
+			break
+		}
+	}
+	if !ok || spec.IsCommit() {
+		return
+	}
+
+	if commits := m.lockedCommits(); len(commits) > 0 {
+		spec.Ref, spec.Range = commits[0], ""
+	}
+
+	return
+}
+
+// lockedCommits lists the commits the lockfile records for m: older npm
+// shrinkwraps keep the branch in from or resolved and the commit it
+// resolved to in version
+func (m Module) lockedCommits() (commits []string) {
+	for _, s := range []string{m.Resolved, m.Version, m.From} {
+		if gitUrl, err := GitUrlFromString(s); err == nil && gitUrl.IsCommit() {
+			commits = append(commits, strings.ToLower(gitUrl.Ref))
+		}
+	}
+
+	return
+}
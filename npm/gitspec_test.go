@@ -0,0 +1,204 @@
+package npm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGitUrlFromString(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+
+	tests := []struct {
+		spec string
+		want GitUrl
+	}{
+		// git+ URLs
+		{"git+https://github.com/user/repo.git", GitUrl{Url: "https://github.com/user/repo.git"}},
+		{"git+https://github.com/user/repo.git#v1.0.0", GitUrl{Url: "https://github.com/user/repo.git", Ref: "v1.0.0"}},
+		{"git+http://example.com/repo.git#" + sha, GitUrl{Url: "http://example.com/repo.git", Ref: sha}},
+		{"git+file:///srv/repo.git#main", GitUrl{Url: "file:///srv/repo.git", Ref: "main"}},
+		{"git+ssh://git@github.com/user/repo.git#dev", GitUrl{Url: "ssh://git@github.com/user/repo.git", Ref: "dev"}},
+		{"git+ssh://git@github.com:2222/user/repo.git", GitUrl{Url: "ssh://git@github.com:2222/user/repo.git"}},
+
+		// scp-style paths, behind a scheme or not
+		{"git+ssh://git@github.com:user/repo.git#dev", GitUrl{Url: "git@github.com:user/repo.git", Ref: "dev"}},
+		{"git+ssh://github.com:user/repo.git", GitUrl{Url: "github.com:user/repo.git"}},
+		{"git@github.com:user/repo.git#dev", GitUrl{Url: "git@github.com:user/repo.git", Ref: "dev"}},
+		{"git@gitlab.example.com:group/sub/repo", GitUrl{Url: "git@gitlab.example.com:group/sub/repo"}},
+
+		{"git://github.com/user/repo.git#v2", GitUrl{Url: "git://github.com/user/repo.git", Ref: "v2"}},
+
+		// hosted shorthands
+		{"github:user/repo", GitUrl{Url: "https://github.com/user/repo.git"}},
+		{"github:user/repo.git#main", GitUrl{Url: "https://github.com/user/repo.git", Ref: "main"}},
+		{"gitlab:group/repo#v1", GitUrl{Url: "https://gitlab.com/group/repo.git", Ref: "v1"}},
+		{"bitbucket:team/repo", GitUrl{Url: "https://bitbucket.org/team/repo.git"}},
+		{"gist:abc123", GitUrl{Url: "https://gist.github.com/abc123.git"}},
+		{"user/repo", GitUrl{Url: "https://github.com/user/repo.git"}},
+		{"user/repo.js#" + sha[:7], GitUrl{Url: "https://github.com/user/repo.js.git", Ref: sha[:7]}},
+		{"user-name/repo_name.git", GitUrl{Url: "https://github.com/user-name/repo_name.git"}},
+
+		// semver ranges and other fragment parts
+		{"github:user/repo#semver:^1.2.0", GitUrl{Url: "https://github.com/user/repo.git", Range: "^1.2.0"}},
+		{"github:user/repo#semver:%3E%3D1.0.0%20%3C2", GitUrl{Url: "https://github.com/user/repo.git", Range: ">=1.0.0 <2"}},
+		{"user/repo#", GitUrl{Url: "https://github.com/user/repo.git"}},
+	}
+
+	for _, tt := range tests {
+		got, err := GitUrlFromString(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestGitUrlFromStringErrors(t *testing.T) {
+	tests := []string{
+		// registry versions, ranges and tarballs
+		"",
+		"1.2.3",
+		"^1.2.3",
+		">=1.0.0 <2.0.0",
+		"latest",
+		"https://registry.npmjs.org/a/-/a-1.0.0.tgz",
+		"http://127.0.0.1:8765/a-1.0.0.tgz",
+		"https://github.com/user/repo/archive/main.tar.gz",
+		"@scope/name",
+		"npm:other@1.0.0",
+		"file:../local",
+		"link:packages/a",
+		"user/repo/extra",
+		"/srv/repo.git",
+
+		// fragments
+		"github:user/repo#semver:^1::main",
+		"github:user/repo#path:packages/a",
+		"github:user/repo#semver:%zz",
+	}
+
+	for _, spec := range tests {
+		if got, err := GitUrlFromString(spec); err == nil {
+			t.Errorf("%q = %+v, want an error", spec, got)
+		}
+	}
+}
+
+func TestGitUrlIsCommit(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want bool
+	}{
+		{"0123456789abcdef0123456789abcdef01234567", true},
+		{"0123456789ABCDEF0123456789ABCDEF01234567", true},
+		{"0123456", true},
+		{"012345", false},
+		{"0123456789abcdef0123456789abcdef012345678", false},
+		{"deadbeef", true},
+		{"v1.0.0", false},
+		{"main", false},
+		{"feature/abcdef0", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := (GitUrl{Ref: tt.ref}).IsCommit(); got != tt.want {
+			t.Errorf("IsCommit(%q) = %v, want %v", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestGitSpec(t *testing.T) {
+	const sha = "0123456789abcdef0123456789abcdef01234567"
+	const url = "https://github.com/user/repo.git"
+
+	tests := []struct {
+		name   string
+		module Module
+		want   GitUrl
+		ok     bool
+		locked []string
+	}{
+		{
+			name:   "resolved commit",
+			module: Module{Version: "github:user/repo#main", Resolved: "git+" + url + "#" + sha},
+			want:   GitUrl{Url: url, Ref: sha},
+			ok:     true,
+			locked: []string{sha},
+		},
+		{
+			name:   "branch in resolved, commit in version",
+			module: Module{Version: "git+" + url + "#" + sha, Resolved: "git+" + url + "#main"},
+			want:   GitUrl{Url: url, Ref: sha},
+			ok:     true,
+			locked: []string{sha},
+		},
+		{
+			name:   "semver range in from, upper case commit in version",
+			module: Module{Version: "git+" + url + "#ABCDEF0", From: "github:user/repo#semver:^1"},
+			want:   GitUrl{Url: url, Ref: "ABCDEF0"},
+			ok:     true,
+			locked: []string{"abcdef0"},
+		},
+		{
+			name:   "range pinned by version",
+			module: Module{Version: "git+" + url + "#" + sha, Resolved: "git+" + url + "#semver:^1"},
+			want:   GitUrl{Url: url, Ref: sha},
+			ok:     true,
+			locked: []string{sha},
+		},
+		{
+			name:   "unpinned branch",
+			module: Module{Version: "github:user/repo#main"},
+			want:   GitUrl{Url: url, Ref: "main"},
+			ok:     true,
+		},
+		{
+			name:   "shorthand in version only",
+			module: Module{Version: "user/repo"},
+			want:   GitUrl{Url: url},
+			ok:     true,
+		},
+		{
+			name:   "registry tarball",
+			module: Module{Version: "1.0.0", Resolved: "https://registry.npmjs.org/a/-/a-1.0.0.tgz"},
+		},
+		{
+			name:   "local directory",
+			module: Module{Version: "file:../a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.module.GitSpec()
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("GitSpec() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.ok)
+			}
+			if locked := tt.module.lockedCommits(); !reflect.DeepEqual(locked, tt.locked) {
+				t.Errorf("lockedCommits() = %q, want %q", locked, tt.locked)
+			}
+		})
+	}
+}
+
+func TestGitUrlDirName(t *testing.T) {
+	tests := []struct {
+		gitUrl GitUrl
+		want   string
+	}{
+		{GitUrl{Url: "u"}, "pkg__HEAD"},
+		{GitUrl{Url: "u", Ref: "v1.0.0"}, "pkg__v1.0.0"},
+		{GitUrl{Url: "u", Ref: "feature/x"}, "pkg__feature%2Fx"},
+		{GitUrl{Url: "u", Range: "^1.2.0"}, "pkg__semver-%5E1.2.0"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.gitUrl.dirName("pkg"); got != tt.want {
+			t.Errorf("%+v.dirName = %q, want %q", tt.gitUrl, got, tt.want)
+		}
+	}
+}
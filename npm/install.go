@@ -11,205 +11,337 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-func (a *App) InstallFromTmpdir(tmpdir string, targetDir string) (err error) {
+// InstallOptions controls how InstallFromTmpdir builds the module tree
+type InstallOptions struct {
+	Scripts *ScriptPolicy
+
+	// ScriptConcurrency caps the number of lifecycle scripts running at
+	// once; zero means one per CPU
+	ScriptConcurrency int
+
+	// ScriptLogDir, if set, receives a log file for every script run
+	ScriptLogDir string
+
+	// ScriptTimeout limits how long a single lifecycle script may run;
+	// scripts running past it are killed along with their children
+	ScriptTimeout time.Duration
+
+	// ScriptPhaseTimeout limits the wall-clock time of the whole script
+	// phase
+	ScriptPhaseTimeout time.Duration
+
+	// BaseDir is the directory of the shrinkwrap, which file: and link:
+	// dependencies are relative to
+	BaseDir string
+
+	// LinkLocalDirs installs file: directories as symlinks instead of
+	// copies
+	LinkLocalDirs bool
+
+	// LinkPrefix, if set, also receives links to the bins (in bin/) and man
+	// pages (in share/man/) of top-level packages, as in a global install
+	LinkPrefix string
+
+	// BinWrappers writes bins as wrapper scripts that run the interpreter
+	// from the script's shebang, instead of symlinking them
+	BinWrappers bool
+
+	// BinShims also writes .cmd and .ps1 shims next to each wrapper
+	BinShims bool
+
+	// Report collects the timing and outcome of every script run
+	Report *ScriptReport
+}
+
+func (a *App) InstallFromTmpdir(tmpdir string, targetDir string, opts InstallOptions) (err error) {
 	npmbin, err := exec.LookPath("npm")
 	if err != nil {
 		log.Fatal("cannot find npm in $PATH")
 	}
 
+	// scripts run concurrently, so every path handed to them must be
+	// independent of the working directory
+	tmpdir, err = filepath.Abs(tmpdir)
+	if err != nil {
+		return err
+	}
+	targetDir, err = filepath.Abs(targetDir)
+	if err != nil {
+		return err
+	}
+
+	opts.BaseDir, err = filepath.Abs(opts.BaseDir)
+	if err != nil {
+		return err
+	}
+
+	if opts.LinkPrefix != "" {
+		opts.LinkPrefix, err = filepath.Abs(opts.LinkPrefix)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = os.MkdirAll(targetDir, 0755)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if a.Graph != nil {
+		nodes, err := a.Graph.install(tmpdir, targetDir, opts)
+		if err != nil {
+			return err
+		}
+
+		return runScripts(nodes, targetDir, npmbin, opts)
+	}
+
+	var nodes []*scriptNode
 	for _, module := range a.Dependencies {
-		err = installModule(module, tmpdir, targetDir, npmbin)
+		node, err := installModule(module, tmpdir, targetDir, opts)
 		if err != nil {
 			return err
 		}
+		if node != nil {
+			nodes = append(nodes, node)
+		}
+	}
+
+	links, workspaces, err := a.installWorkspaces(tmpdir, targetDir, opts, nodes)
+	if err != nil {
+		return err
+	}
+	nodes = append(nodes, links...)
+	nodes = append(nodes, workspaces...)
+
+	err = linkTree(nodes, targetDir, opts)
+	if err != nil {
+		return err
+	}
+
+	return runScripts(nodes, targetDir, npmbin, opts)
+}
+
+// installModule lays out m and its nested dependencies under targetDir,
+// returning the node used to schedule their lifecycle scripts. Optional
+// modules that fail to install are skipped, returning a nil node.
+func installModule(m Module, tmpdir string, targetDir string, opts InstallOptions) (node *scriptNode, err error) {
+	outputDir := filepath.Join(targetDir, m.Name)
+
+	node, err = extractModule(m, tmpdir, outputDir, opts)
+	if err != nil && m.Optional {
+		log.Printf("[WARN] skipping optional dependency %s@%s: %v\n", m.Name, m.Version, err)
+		return nil, os.RemoveAll(outputDir)
 	}
 
 	return
 }
 
-func installModule(m Module, tmpdir string, targetDir string, npmbin string) (err error) {
-	var isGitModule bool
-	if strings.HasPrefix(m.Resolved, "git+") {
-		isGitModule = true
+func extractModule(m Module, tmpdir string, outputDir string, opts InstallOptions) (node *scriptNode, err error) {
+	_, isGitModule := m.GitSpec()
+
+	localPath, isLink, isLocal := m.LocalSpec()
+	if isLocal && !filepath.IsAbs(localPath) {
+		localPath = filepath.Join(opts.BaseDir, localPath)
+	}
+
+	if isLocal && (isLink || opts.LinkLocalDirs) {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			return linkLocalModule(m, localPath, outputDir)
+		}
+	}
+
+	// a link left by an earlier install points into the source tree: copying
+	// or extracting through it would overwrite the source
+	err = removeLink(outputDir)
+	if err != nil {
+		return nil, err
 	}
 
-	outputDir := filepath.Join(targetDir, m.Name)
 	err = os.MkdirAll(outputDir, 0755)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if isGitModule {
-		err = copyGitModule(m, tmpdir, outputDir)
+	if isLocal {
+		err = copyLocalModule(localPath, outputDir)
+	} else if isGitModule {
+		var tarball string
+		tarball, err = packGitModule(m, tmpdir, opts)
+		if err == nil {
+			err = extractTarball(tarball, outputDir)
+		}
 	} else {
 		err = decompress(m, tmpdir, outputDir)
 	}
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	node = &scriptNode{name: m.Name, dir: outputDir, optional: m.Optional}
+
+	node.pkg, err = ReadPackageJSON(outputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the shrinkwrap doesn't always record os, cpu and engines; when its
+	// engines don't match either, SkipIncompatible has already warned
+	reason, isEngine := node.pkg.checkPackage()
+	if reason != "" && isEngine && !m.Optional {
+		if checkEngines(m.Engines) == "" {
+			log.Printf("[WARN] %s@%s: %s\n", m.Name, m.Version, reason)
+		}
+	} else if reason != "" {
+		return nil, fmt.Errorf("unwrap: %s@%s: %s", m.Name, m.Version, reason)
 	}
 
 	if len(m.Dependencies) > 0 {
 		nodeModulesDir := filepath.Join(outputDir, "node_modules")
 		err = os.MkdirAll(nodeModulesDir, 0755)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
+		bundled := node.pkg.BundledDependencies()
+
 		for _, module := range m.Dependencies {
-			err = installModule(module, tmpdir, nodeModulesDir, npmbin)
+			var dep *scriptNode
+			if module.Bundled || bundled[module.Name] {
+				dep, err = bundledModule(module, nodeModulesDir)
+			} else {
+				dep, err = installModule(module, tmpdir, nodeModulesDir, opts)
+			}
 			if err != nil {
-				return err
+				return nil, err
+			}
+			if dep != nil {
+				node.deps = append(node.deps, dep)
 			}
 		}
 	}
 
-	pkg, err := ReadPackageJSON(outputDir)
-	if err != nil {
-		return err
-	}
+	return
+}
 
-	err = pkg.runInstallScripts(npmbin, outputDir)
-	if err != nil {
-		return err
-	}
+// bundledModule returns the node for a module shipped in its parent's
+// tarball. It is left as shipped: only its bins are linked.
+func bundledModule(m Module, targetDir string) (node *scriptNode, err error) {
+	dir := filepath.Join(targetDir, m.Name)
 
-	err = pkg.linkBinScripts(npmbin, outputDir)
+	pkg, err := ReadPackageJSON(dir)
+	if os.IsNotExist(err) {
+		log.Printf("[WARN] bundled dependency %s is missing from %s\n", m.Name, targetDir)
+		return nil, nil
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return
+	return &scriptNode{name: m.Name, dir: dir, pkg: pkg, bundled: true}, nil
 }
 
-func decompress(m Module, tmpdir string, outputDir string) (err error) {
-	var basePath string
-	if m.Resolved == "" {
-		basePath = path.Base(fmt.Sprintf("%s-%s.tgz", m.Name, m.Version))
-	} else {
-		basePath = path.Base(m.Resolved)
+// linkLocalModule installs a link: dependency (or a file: directory, when
+// linking local directories) as a relative symlink to its source
+func linkLocalModule(m Module, source string, outputDir string) (node *scriptNode, err error) {
+	if len(m.Dependencies) > 0 {
+		log.Printf("[WARN] not installing nested dependencies of linked package %s into %s\n", m.Name, source)
 	}
 
-	expectedArchive := filepath.Join(tmpdir, basePath)
-
-	tgz, err := os.Open(expectedArchive)
-	if os.IsNotExist(err) {
-		log.Fatalf("No file at %s\n", expectedArchive)
-	}
+	err = os.RemoveAll(outputDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer tgz.Close()
 
-	err = uncompressAndExtract(tgz, outputDir)
+	err = os.MkdirAll(filepath.Dir(outputDir), 0755)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return
-}
-
-func (pkg PackageJSON) linkBinScripts(npmbin string, directory string) (err error) {
-	binScripts, err := pkg.BinScripts()
+	target, err := filepath.Rel(filepath.Dir(outputDir), source)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if len(binScripts) == 0 {
-		return
+	err = os.Symlink(target, outputDir)
+	if err != nil {
+		return nil, err
 	}
 
-	binDir := filepath.Join(directory, "../.bin")
-	err = os.MkdirAll(binDir, 0755)
+	pkg, err := ReadPackageJSON(outputDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	oldDir, err := os.Getwd()
+	return &scriptNode{name: m.Name, dir: outputDir, pkg: pkg, linked: true}, nil
+}
+
+// removeLink removes path if it is a symlink (or, on windows, a junction)
+func removeLink(path string) (err error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	os.Chdir(binDir)
-	for scriptName, scriptPath := range binScripts {
-		attemptedPath := filepath.Join(binDir, scriptName)
-		source := filepath.Join(directory, scriptPath)
-
-		target, err := filepath.Rel(binDir, source)
-		if err != nil {
-			return err
-		}
-
-		// bin scripts must always be executable
-		// see https://github.com/npm/npm/blob/2.x/lib/build.js#L190
-		err = os.Chmod(target, 0777)
-		if err != nil {
-			log.Printf("[FATAL] %s is not executable\n", attemptedPath)
-			return err
-		}
-
-		err = os.Symlink(target, scriptName)
-		if os.IsExist(err) {
-			log.Printf("[WARN] symlink: %s already exists\n", attemptedPath)
-			err = nil
-		}
-		if err != nil {
-			log.Printf("[FATAL] could not link %s to %s\n", scriptName, target)
-			return err
-		}
+	if info.Mode()&os.ModeSymlink == 0 && info.Mode()&os.ModeIrregular == 0 {
+		return nil
 	}
-	os.Chdir(oldDir)
 
-	return
+	return os.Remove(path)
 }
 
-func (pkg PackageJSON) runInstallScripts(npmbin string, directory string) (err error) {
-	runInstall := []string{"npm", "run-script", "install", "--production"}
-
-	pkgName, err := pkg.Name()
+// copyLocalModule installs a file: dependency, either a local tarball or a
+// copy of a directory (without its own node_modules)
+func copyLocalModule(source string, outputDir string) (err error) {
+	info, err := os.Stat(source)
 	if err != nil {
-		return
+		return err
 	}
 
-	hasInstall, err := pkg.HasInstallScript()
-	if err != nil {
-		return
+	if !info.IsDir() {
+		return extractTarball(source, outputDir)
 	}
 
-	// check for binding.gyp
-	var hasBindingGyp bool
-	_, err = os.Stat(filepath.Join(directory, "binding.gyp"))
-	if os.IsNotExist(err) {
-		err = nil
-		hasBindingGyp = false
-	} else if err != nil {
-		return
+	return copyTree(source, outputDir, func(relativePath string, info os.FileInfo) bool {
+		return info.IsDir() && (relativePath == "node_modules" || info.Name() == ".git")
+	})
+}
+
+func decompress(m Module, tmpdir string, outputDir string) (err error) {
+	var basePath string
+	if m.Resolved == "" {
+		basePath = path.Base(fmt.Sprintf("%s-%s.tgz", m.Name, m.Version))
 	} else {
-		hasBindingGyp = true
+		basePath = path.Base(m.Resolved)
 	}
 
-	if hasInstall || hasBindingGyp {
-		fmt.Printf("run '%s install' for %s\n", npmbin, directory)
-		cmd := exec.Cmd{
-			Path: npmbin,
-			Args: runInstall,
-			Dir: directory,
-			Stdout: os.Stdout,
-			Stderr: os.Stderr,
-		}
-		err = cmd.Start()
-		if err != nil {
-			return
-		}
+	return extractTarball(filepath.Join(tmpdir, basePath), outputDir)
+}
+
+func extractTarball(archive string, outputDir string) (err error) {
+	tgz, err := os.Open(archive)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("unwrap: no file at %s", archive)
+	}
+	if err != nil {
+		return err
+	}
+	defer tgz.Close()
 
-		cmd.Wait()
+	err = uncompressAndExtract(tgz, outputDir)
+	if err != nil {
+		return err
 	}
 
 	return
@@ -0,0 +1,110 @@
+package npm
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTarball(t *testing.T, file string, files map[string]string) {
+	out, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for name, contents := range files {
+		err = tw.WriteHeader(&tar.Header{Name: "package/" + name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a file: directory installed with --link-local once is a symlink into its
+// source; installing it again must not copy or extract through that link
+func TestExtractModuleReplacesOldLink(t *testing.T) {
+	source := map[string]string{
+		"package.json": `{"name":"shared-lib","version":"1.0.0"}`,
+		"index.js":     "module.exports = 1\n",
+	}
+
+	tests := []struct {
+		name   string
+		module Module
+	}{
+		{"file directory", Module{Name: "shared-lib", Version: "file:shared-lib"}},
+		{"file tarball", Module{Name: "shared-lib", Version: "file:shared-lib-1.0.0.tgz"}},
+		{"registry tarball", Module{Name: "shared-lib", Version: "1.0.0", Resolved: "https://registry.example/shared-lib/-/shared-lib-1.0.0.tgz"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := ioutil.TempDir("", "unwrap-install")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(base)
+
+			tmpdir := filepath.Join(base, "tmp")
+			writeTree(t, filepath.Join(base, "shared-lib"), source)
+			if err = os.MkdirAll(tmpdir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			writeTarball(t, filepath.Join(base, "shared-lib-1.0.0.tgz"), map[string]string{
+				"package.json": source["package.json"],
+				"index.js":     "module.exports = 2\n",
+			})
+			writeTarball(t, filepath.Join(tmpdir, "shared-lib-1.0.0.tgz"), map[string]string{
+				"package.json": source["package.json"],
+				"index.js":     "module.exports = 2\n",
+			})
+
+			outputDir := filepath.Join(base, "app", "node_modules", "shared-lib")
+			opts := InstallOptions{BaseDir: base, LinkLocalDirs: true}
+			linked := Module{Name: "shared-lib", Version: "file:shared-lib"}
+			if _, err = extractModule(linked, tmpdir, outputDir, opts); err != nil {
+				t.Fatal(err)
+			}
+			if info, err := os.Lstat(outputDir); err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Fatalf("%s is not a link after --link-local (%v)", outputDir, err)
+			}
+
+			opts.LinkLocalDirs = false
+			if _, err = extractModule(tt.module, tmpdir, outputDir, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Lstat(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.IsDir() {
+				t.Errorf("%s is still a link", outputDir)
+			}
+			for name, contents := range source {
+				got, err := ioutil.ReadFile(filepath.Join(base, "shared-lib", name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != contents {
+					t.Errorf("source %s = %q, want %q", name, got, contents)
+				}
+			}
+		})
+	}
+}
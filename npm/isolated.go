@@ -0,0 +1,217 @@
+package npm
+
+// pnpm's isolated node_modules layout: every package in a PackageGraph is
+// extracted once, to node_modules/.pnpm/<id>/node_modules/<name>, next to
+// symlinks to exactly the packages it depends on. Projects only see their
+// direct dependencies, linked from their own node_modules, while every
+// package name is also linked from node_modules/.pnpm/node_modules, where
+// node looks last - pnpm's default hoisting.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// install lays the graph out under targetDir, and returns the nodes to run
+// lifecycle scripts for
+func (g *PackageGraph) install(tmpdir string, targetDir string, opts InstallOptions) (nodes []*scriptNode, err error) {
+	store := filepath.Join(targetDir, ".pnpm")
+
+	ids := g.ids()
+	installed := make(map[string]*scriptNode)
+	for _, id := range ids {
+		p := g.Packages[id]
+		dir := filepath.Join(store, pnpmDirName(id, p.Module.Name, p.Module.Version), "node_modules")
+
+		node, err := installModule(p.Module, tmpdir, dir, opts)
+		if err != nil {
+			return nil, err
+		}
+		if node != nil {
+			installed[id] = node
+		}
+	}
+
+	var claims []linkClaim
+	hoisted := make(map[string]bool)
+
+	for _, id := range ids {
+		node, ok := installed[id]
+		if !ok {
+			continue
+		}
+
+		deps := g.Packages[id].Deps
+		for _, name := range sortedKeys(deps) {
+			dep, ok := installed[deps[name]]
+			if !ok {
+				// a skipped optional dependency
+				continue
+			}
+
+			linkPath := filepath.Join(nodeModulesDir(node.dir), name)
+			if linkPath == node.dir {
+				// a package depending on itself finds itself anyway
+				continue
+			}
+
+			err = linkPackage(linkPath, dep.dir)
+			if err != nil {
+				return nil, err
+			}
+
+			depClaims, err := dep.linkClaims(filepath.Join(node.dir, "node_modules", ".bin"), false, targetDir, "")
+			if err != nil {
+				return nil, err
+			}
+			claims = append(claims, depClaims...)
+		}
+
+		name := g.Packages[id].Module.Name
+		if !hoisted[name] {
+			hoisted[name] = true
+			err = linkPackage(filepath.Join(store, "node_modules", name), node.dir)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	nodes = g.scriptOrder(ids, installed)
+
+	importerPaths := make([]string, 0, len(g.Importers))
+	for path := range g.Importers {
+		importerPaths = append(importerPaths, path)
+	}
+	sort.Strings(importerPaths)
+
+	for _, path := range importerPaths {
+		importer := g.Importers[path]
+		dir := filepath.Join(opts.BaseDir, filepath.FromSlash(path))
+		nodeModules := filepath.Join(dir, "node_modules")
+		if path == "." {
+			nodeModules = targetDir
+		}
+
+		var direct []*scriptNode
+		for _, name := range sortedKeys(importer.Dependencies) {
+			ref := importer.Dependencies[name]
+
+			var dep *scriptNode
+			if strings.HasPrefix(ref, "link:") {
+				// another workspace, or any other linked directory
+				source := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(ref, "link:")))
+				pkg, err := ReadPackageJSON(source)
+				if err != nil {
+					return nil, err
+				}
+				dep = &scriptNode{name: name, dir: source, pkg: pkg, linked: true}
+			} else if dep = installed[ref]; dep == nil {
+				continue
+			} else {
+				direct = append(direct, dep)
+			}
+
+			err = linkPackage(filepath.Join(nodeModules, name), dep.dir)
+			if err != nil {
+				return nil, err
+			}
+
+			depClaims, err := dep.linkClaims(filepath.Join(nodeModules, ".bin"), path == ".", targetDir, opts.LinkPrefix)
+			if err != nil {
+				return nil, err
+			}
+			claims = append(claims, depClaims...)
+		}
+
+		if path == "." {
+			continue
+		}
+
+		pkg, err := ReadPackageJSON(dir)
+		if err != nil {
+			return nil, err
+		}
+		name, err := pkg.Name()
+		if err != nil {
+			name = path
+		}
+		nodes = append(nodes, &scriptNode{name: name, dir: dir, pkg: pkg, workspace: true, deps: direct})
+	}
+
+	err = applyClaims(claims, opts)
+	return
+}
+
+// scriptOrder makes every installed package wait for the scripts of the
+// packages it depends on. Dependency cycles are cut where they close, as
+// their scripts can't all run after each other.
+func (g *PackageGraph) scriptOrder(ids []string, installed map[string]*scriptNode) (nodes []*scriptNode) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = visiting
+
+		node := installed[id]
+		deps := g.Packages[id].Deps
+		for _, name := range sortedKeys(deps) {
+			depID := deps[name]
+			dep, ok := installed[depID]
+			if !ok || state[depID] == visiting {
+				continue
+			}
+			if state[depID] == 0 {
+				visit(depID)
+			}
+			node.deps = append(node.deps, dep)
+		}
+
+		state[id] = visited
+	}
+
+	for _, id := range ids {
+		node, ok := installed[id]
+		if !ok {
+			continue
+		}
+		if state[id] == 0 {
+			visit(id)
+		}
+		nodes = append(nodes, node)
+	}
+
+	return
+}
+
+// linkPackage links a package's directory into a node_modules directory,
+// creating the @scope directory for scoped packages. Like pnpm, it replaces
+// whatever else is in the way, such as a package left by a hoisted install.
+func linkPackage(linkPath string, source string) (err error) {
+	err = os.MkdirAll(filepath.Dir(linkPath), 0755)
+	if err != nil {
+		return
+	}
+
+	if info, statErr := os.Lstat(linkPath); statErr == nil && info.Mode()&os.ModeSymlink == 0 {
+		if linkPath == source {
+			return fmt.Errorf("unwrap: cannot link %s to itself", linkPath)
+		}
+
+		log.Printf("[WARN] replacing %s with a link to %s\n", linkPath, source)
+		err = os.RemoveAll(linkPath)
+		if err != nil {
+			return
+		}
+	}
+
+	return linkFile(filepath.Dir(linkPath), filepath.Base(linkPath), source, func(string) bool { return true })
+}
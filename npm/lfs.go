@@ -0,0 +1,340 @@
+package npm
+
+// Git LFS keeps large files out of repositories, leaving small pointer files
+// in their place, which git archive exports as they are. Installing those
+// would break packages in confusing ways, so pointers are an error unless
+// GitLFS is set, in which case the files are downloaded from the remote's
+// LFS server (or, for repositories on disk, their lfs/objects) and kept in
+// the mirror for next time.
+// see https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md and
+// https://github.com/git-lfs/git-lfs/blob/main/docs/api/batch.md
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GitLFS downloads the Git LFS files of git dependencies, rather than
+// failing on them
+var GitLFS = false
+
+// pointers are small, and start with their spec's version
+const lfsPointerMaxSize = 1024
+
+var (
+	lfsVersionRe = regexp.MustCompile(`^version https://(git-lfs\.github\.com|hawser\.github\.com)/spec/v1\n`)
+	lfsOidRe     = regexp.MustCompile(`(?m)^oid sha256:([0-9a-f]{64})$`)
+	lfsSizeRe    = regexp.MustCompile(`(?m)^size (\d+)$`)
+)
+
+type lfsPointer struct {
+	path string
+	oid  string
+	size int64
+}
+
+// findLFSPointers lists the LFS pointer files below dir
+func findLFSPointers(dir string) (pointers []lfsPointer, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Size() > lfsPointerMaxSize {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !lfsVersionRe.Match(content) {
+			return nil
+		}
+
+		oid := lfsOidRe.FindSubmatch(content)
+		size := lfsSizeRe.FindSubmatch(content)
+		if oid == nil || size == nil {
+			return nil
+		}
+
+		pointer := lfsPointer{path: path, oid: string(oid[1])}
+		pointer.size, _ = strconv.ParseInt(string(size[1]), 10, 64)
+		pointers = append(pointers, pointer)
+		return nil
+	})
+
+	return
+}
+
+// resolveLFSPointers replaces the LFS pointers in dir, exported from the
+// mirror of the remote at url, with the files they point to
+func resolveLFSPointers(dir string, url string, mirror string) (err error) {
+	pointers, err := findLFSPointers(dir)
+	if err != nil || len(pointers) == 0 {
+		return
+	}
+
+	if !GitLFS {
+		rel, _ := filepath.Rel(dir, pointers[0].path)
+		return fmt.Errorf("%s uses Git LFS for %d files, like %s; install with --git-lfs to download them", url, len(pointers), filepath.ToSlash(rel))
+	}
+
+	store := lfsStore{url: url, cache: filepath.Join(mirror, "lfs", "objects")}
+	var missing []lfsPointer
+	for _, pointer := range pointers {
+		if _, err := os.Stat(store.cachePath(pointer.oid)); err != nil {
+			missing = append(missing, pointer)
+		}
+	}
+
+	if len(missing) > 0 {
+		fmt.Printf("downloading %d Git LFS files from %s\n", len(missing), url)
+		err = store.download(missing)
+		if err != nil {
+			return
+		}
+	}
+
+	for _, pointer := range pointers {
+		err = store.replace(pointer)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+type lfsStore struct {
+	url   string
+	cache string
+}
+
+func (s lfsStore) cachePath(oid string) string {
+	return filepath.Join(s.cache, oid[:2], oid[2:4], oid)
+}
+
+// replace writes the file a pointer points to over it
+func (s lfsStore) replace(pointer lfsPointer) (err error) {
+	info, err := os.Stat(pointer.path)
+	if err != nil {
+		return
+	}
+
+	source, err := os.Open(s.cachePath(pointer.oid))
+	if err != nil {
+		return
+	}
+	defer source.Close()
+
+	output, err := os.OpenFile(pointer.path, os.O_WRONLY|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return
+	}
+	defer output.Close()
+
+	_, err = io.Copy(output, source)
+	return
+}
+
+// download adds the objects of pointers to the cache
+func (s lfsStore) download(pointers []lfsPointer) (err error) {
+	switch {
+	case strings.HasPrefix(s.url, "http://"), strings.HasPrefix(s.url, "https://"):
+		return s.downloadHTTP(pointers)
+	case strings.HasPrefix(s.url, "file://"), filepath.IsAbs(s.url):
+		return s.copyLocal(pointers)
+	}
+
+	return fmt.Errorf("can't download Git LFS files from %s: only http(s) and file URLs are supported", s.url)
+}
+
+// copyLocal copies objects from the LFS store of a repository on disk
+func (s lfsStore) copyLocal(pointers []lfsPointer) (err error) {
+	dir := s.url
+	if strings.HasPrefix(dir, "file://") {
+		u, err := url.Parse(dir)
+		if err != nil {
+			return err
+		}
+		dir = filepath.FromSlash(u.Path)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		dir = filepath.Join(dir, ".git")
+	}
+
+	for _, pointer := range pointers {
+		source := filepath.Join(dir, "lfs", "objects", pointer.oid[:2], pointer.oid[2:4], pointer.oid)
+		f, err := os.Open(source)
+		if err != nil {
+			return fmt.Errorf("Git LFS object %s is missing from %s", pointer.oid, dir)
+		}
+
+		err = s.store(pointer, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+type lfsBatchResponse struct {
+	Objects []struct {
+		Oid     string `json:"oid"`
+		Actions struct {
+			Download *struct {
+				Href   string            `json:"href"`
+				Header map[string]string `json:"header"`
+			} `json:"download"`
+		} `json:"actions"`
+		Error *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"objects"`
+	Message string `json:"message"`
+}
+
+// lfsEndpoint is where the LFS server of the remote at url is, by default
+func lfsEndpoint(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	if !strings.HasSuffix(url, ".git") {
+		url += ".git"
+	}
+
+	return url + "/info/lfs"
+}
+
+// downloadHTTP asks the remote's LFS server where pointers' objects are, in
+// one batch request, and downloads them
+func (s lfsStore) downloadHTTP(pointers []lfsPointer) (err error) {
+	type object struct {
+		Oid  string `json:"oid"`
+		Size int64  `json:"size"`
+	}
+	request := struct {
+		Operation string   `json:"operation"`
+		Transfers []string `json:"transfers"`
+		Objects   []object `json:"objects"`
+	}{Operation: "download", Transfers: []string{"basic"}}
+
+	byOid := make(map[string]lfsPointer)
+	for _, pointer := range pointers {
+		if _, ok := byOid[pointer.oid]; !ok {
+			request.Objects = append(request.Objects, object{pointer.oid, pointer.size})
+		}
+		byOid[pointer.oid] = pointer
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+
+	endpoint := lfsEndpoint(s.url) + "/objects/batch"
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/vnd.git-lfs+json")
+	req.Header.Set("Content-Type", "application/vnd.git-lfs+json")
+
+	resp, err := Registries.clientFor(endpoint).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var batch lfsBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s %s", endpoint, resp.Status, batch.Message)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", endpoint, err)
+	}
+
+	for _, obj := range batch.Objects {
+		if obj.Error != nil {
+			return fmt.Errorf("Git LFS object %s: %d %s", obj.Oid, obj.Error.Code, obj.Error.Message)
+		}
+		if obj.Actions.Download == nil {
+			return fmt.Errorf("%s has no download for Git LFS object %s", endpoint, obj.Oid)
+		}
+
+		err = s.fetchObject(byOid[obj.Oid], obj.Actions.Download.Href, obj.Actions.Download.Header)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s lfsStore) fetchObject(pointer lfsPointer, href string, header map[string]string) (err error) {
+	req, err := http.NewRequest("GET", href, nil)
+	if err != nil {
+		return
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := Registries.clientFor(href).Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Git LFS object %s: %s", pointer.oid, resp.Status)
+	}
+
+	return s.store(pointer, resp.Body)
+}
+
+// store adds an object to the cache, making sure it is what the pointer
+// says it is
+func (s lfsStore) store(pointer lfsPointer, r io.Reader) (err error) {
+	target := s.cachePath(pointer.oid)
+	err = os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return
+	}
+
+	partial := target + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return
+	}
+	defer os.Remove(partial)
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != pointer.oid || size != pointer.size {
+		return fmt.Errorf("Git LFS object %s arrived as %d bytes with sha256 %s", pointer.oid, size, sum)
+	}
+
+	return os.Rename(partial, target)
+}
@@ -0,0 +1,464 @@
+package npm
+
+// lifecycle scripts are scheduled as a DAG over the installed module tree: a
+// package's scripts only run once the scripts of all of its nested
+// dependencies have finished, mirroring the order of a recursive install. In
+// an isolated layout the DAG is the package graph, with any cycles broken.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type scriptNode struct {
+	name     string
+	dir      string
+	pkg      PackageJSON
+	optional bool
+	bundled  bool
+	linked   bool
+	deps     []*scriptNode
+	done     chan struct{}
+
+	// the bin and man page links planned for the package, wherever they go
+	claims []linkClaim
+
+	// workspaces live in the project rather than in node_modules, and also
+	// wait for the nodes in after, which are not their own dependencies
+	workspace bool
+	after     []*scriptNode
+}
+
+// ScriptReport collects the outcome of every lifecycle script run during an
+// install. A nil report records nothing.
+type ScriptReport struct {
+	mu   sync.Mutex
+	runs []ScriptRun
+}
+
+type ScriptRun struct {
+	Path    string // relative to node_modules, or to the project for workspaces
+	Event   string
+	Elapsed time.Duration
+	LogFile string
+	Err     error
+}
+
+func (r *ScriptReport) record(run ScriptRun) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.runs = append(r.runs, run)
+}
+
+// Runs lists the scripts that were run, slowest first
+func (r *ScriptReport) Runs() []ScriptRun {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	runs := make([]ScriptRun, len(r.runs))
+	copy(runs, r.runs)
+	sort.Sort(bySlowest(runs))
+
+	return runs
+}
+
+type bySlowest []ScriptRun
+
+func (s bySlowest) Len() int           { return len(s) }
+func (s bySlowest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySlowest) Less(i, j int) bool { return s[i].Elapsed > s[j].Elapsed }
+
+type scriptScheduler struct {
+	npmbin  string
+	rootDir string
+	opts    InstallOptions
+	slots   chan struct{}
+
+	outMu sync.Mutex
+
+	// when the whole script phase must be finished by, if limited
+	deadline time.Time
+
+	errMu sync.Mutex
+	err   error
+}
+
+func runScripts(roots []*scriptNode, rootDir string, npmbin string, opts InstallOptions) (err error) {
+	concurrency := opts.ScriptConcurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	if opts.ScriptLogDir != "" {
+		err = os.MkdirAll(opts.ScriptLogDir, 0755)
+		if err != nil {
+			return
+		}
+	}
+
+	s := &scriptScheduler{
+		npmbin:  npmbin,
+		rootDir: rootDir,
+		opts:    opts,
+		slots:   make(chan struct{}, concurrency),
+	}
+
+	if opts.ScriptPhaseTimeout > 0 {
+		s.deadline = time.Now().Add(opts.ScriptPhaseTimeout)
+	}
+
+	// a node must come after everything it waits for in roots, so that
+	// their done channels exist before it starts waiting
+	var wg sync.WaitGroup
+	var schedule func(nodes []*scriptNode)
+	schedule = func(nodes []*scriptNode) {
+		for _, n := range nodes {
+			if n.done != nil {
+				// already reached through another package, in an
+				// isolated layout
+				continue
+			}
+			n.done = make(chan struct{})
+			schedule(n.deps)
+
+			wg.Add(1)
+			go func(n *scriptNode) {
+				defer wg.Done()
+				defer close(n.done)
+
+				for _, dep := range n.deps {
+					<-dep.done
+				}
+				for _, dep := range n.after {
+					<-dep.done
+				}
+
+				if s.failed() {
+					return
+				}
+
+				s.slots <- struct{}{}
+				err := s.runNode(n)
+				<-s.slots
+
+				if err != nil && n.optional {
+					log.Printf("[WARN] removing failed optional dependency %s: %v\n", n.dir, err)
+					err = n.unlink()
+					if err == nil {
+						err = os.RemoveAll(n.dir)
+					}
+				}
+				if err != nil {
+					s.fail(err)
+				}
+			}(n)
+		}
+	}
+	schedule(roots)
+
+	wg.Wait()
+
+	return s.err
+}
+
+func (s *scriptScheduler) failed() bool {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+
+	return s.err != nil
+}
+
+func (s *scriptScheduler) fail(err error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *scriptScheduler) runNode(n *scriptNode) (err error) {
+	if n.bundled || n.linked {
+		// bundled dependencies are used as shipped, and linked ones as
+		// they are on disk
+		return
+	}
+
+	pkgName, err := n.pkg.Name()
+	if err != nil {
+		return
+	}
+
+	// a missing version only matters to packages the policy lists with a
+	// range, which it can't satisfy
+	pkgVersion, _ := n.pkg.Version()
+
+	events, err := n.pkg.lifecycleEvents(n.dir)
+	if err != nil {
+		return
+	}
+
+	if len(events) > 0 && !s.opts.Scripts.Allows(pkgName, pkgVersion) {
+		fmt.Printf("skipping install scripts for %s\n", n.dir)
+		for _, ev := range events {
+			s.opts.Scripts.skip(SkippedScript{Name: pkgName, Version: pkgVersion, Path: n.dir, Script: ev.script})
+		}
+		events = nil
+	}
+
+	for _, ev := range events {
+		err = s.runScript(n, ev)
+		if err != nil {
+			return err
+		}
+	}
+
+	// bins were linked before any script ran, but may only just have
+	// been generated
+	return n.pkg.makeBinsExecutable(n.dir)
+}
+
+// runs a single lifecycle event for n, capturing its output in memory and,
+// if configured, in a log file
+func (s *scriptScheduler) runScript(n *scriptNode, ev lifecycleEvent) (err error) {
+	var output bytes.Buffer
+	var w io.Writer = &output
+
+	// workspaces and their dependencies are outside of node_modules
+	relDir := s.rootDir
+	if !isWithin(n.dir, s.rootDir) {
+		relDir = s.opts.BaseDir
+	}
+	relPath, err := filepath.Rel(relDir, n.dir)
+	if err != nil {
+		return
+	}
+
+	var logFile string
+	if s.opts.ScriptLogDir != "" {
+		logFile = filepath.Join(s.opts.ScriptLogDir, scriptLogName(relPath, ev.name))
+		f, err := os.Create(logFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w = io.MultiWriter(&output, f)
+	}
+
+	fmt.Fprintf(w, "run '%s %s' for %s\n", s.npmbin, ev.name, n.dir)
+	cmd := exec.Cmd{
+		Path:   s.npmbin,
+		Args:   []string{"npm", "run-script", ev.name, "--production"},
+		Dir:    n.dir,
+		Stdout: w,
+		Stderr: w,
+	}
+
+	if s.opts.Scripts != nil && s.opts.Scripts.Sandbox {
+		tmpdir, err := ioutil.TempDir("", "unwrap-script-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpdir)
+
+		// everything outside the package and tmpdir is read-only, so point
+		// npm's own caches and logs at tmpdir as well
+		cmd.Env = append(os.Environ(), "TMPDIR="+tmpdir, "HOME="+tmpdir, "npm_config_cache="+filepath.Join(tmpdir, ".npm"))
+
+		pkgName, _ := n.pkg.Name()
+		pkgVersion, _ := n.pkg.Version()
+		err = sandboxCommand(&cmd, []string{n.dir, tmpdir}, s.opts.Scripts.AllowsNetwork(pkgName, pkgVersion))
+		if err != nil {
+			return err
+		}
+	}
+
+	setProcessGroup(&cmd)
+
+	// processes left running in the background (or surviving a kill) can
+	// hold the output pipes open, and would keep Wait from returning
+	cmd.WaitDelay = scriptWaitDelay
+
+	start := time.Now()
+	timeout, reason := s.scriptTimeout(start)
+	if timeout <= 0 {
+		return fmt.Errorf("unwrap: not running %s script for %s: %s", ev.name, relPath, reason)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	timedOut := false
+	timer := time.NewTimer(timeout)
+	select {
+	case err = <-done:
+		timer.Stop()
+		if err == exec.ErrWaitDelay {
+			// the script succeeded, but left something running
+			log.Printf("[WARN] %s script for %s left processes running in the background", ev.name, relPath)
+			err = nil
+		}
+	case <-timer.C:
+		timedOut = true
+		killProcessGroup(&cmd)
+		<-done
+		err = fmt.Errorf("killed: %s", reason)
+	}
+	elapsed := time.Since(start)
+
+	s.opts.Report.record(ScriptRun{Path: relPath, Event: ev.name, Elapsed: elapsed, LogFile: logFile, Err: err})
+	tail := tailLines(output.String(), scriptErrorTail)
+	s.flushOutput(n.name, &output)
+
+	if err != nil {
+		msg := fmt.Sprintf("unwrap: %s script for %s failed after %s: %v", ev.name, relPath, elapsed.Round(time.Millisecond), err)
+		if timedOut {
+			msg = fmt.Sprintf("unwrap: %s script for %s was killed after %s: %s", ev.name, relPath, elapsed.Round(time.Millisecond), reason)
+		}
+		if logFile != "" {
+			msg += fmt.Sprintf(" (full log in %s)", logFile)
+		}
+		return fmt.Errorf("%s\n%s", msg, tail)
+	}
+
+	return
+}
+
+// scriptTimeout returns how long a script started at start may run for, and
+// which limit applies
+func (s *scriptScheduler) scriptTimeout(start time.Time) (timeout time.Duration, reason string) {
+	timeout = time.Duration(math.MaxInt64)
+	reason = "no timeout"
+
+	if s.opts.ScriptTimeout > 0 {
+		timeout = s.opts.ScriptTimeout
+		reason = fmt.Sprintf("exceeded the %s script timeout", s.opts.ScriptTimeout)
+	}
+
+	if !s.deadline.IsZero() {
+		remaining := s.deadline.Sub(start)
+		if remaining < timeout {
+			timeout = remaining
+			reason = fmt.Sprintf("the script phase exceeded its %s limit", s.opts.ScriptPhaseTimeout)
+		}
+	}
+
+	return
+}
+
+// writes the buffered output of a package's scripts in one block, with each
+// line prefixed by the package name
+func (s *scriptScheduler) flushOutput(name string, output *bytes.Buffer) {
+	if output.Len() == 0 {
+		return
+	}
+
+	s.outMu.Lock()
+	defer s.outMu.Unlock()
+
+	writePrefixed(os.Stdout, name, output)
+}
+
+func writePrefixed(w io.Writer, prefix string, r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fmt.Fprintf(w, "[%s] %s\n", prefix, scanner.Text())
+	}
+}
+
+// the number of output lines included in the error of a failed script
+const scriptErrorTail = 20
+
+// how long to wait for a script's output once it has exited, or was killed
+const scriptWaitDelay = 10 * time.Second
+
+func tailLines(output string, n int) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// log files are named after the package's path below node_modules, e.g.
+// node_modules/a/node_modules/@s/b -> a__@s%2fb.install.log
+func scriptLogName(relPath string, event string) string {
+	name := filepath.ToSlash(relPath)
+	name = strings.Replace(name, "/node_modules/", "__", -1)
+	name = strings.Replace(name, "/", "%2f", -1)
+
+	return fmt.Sprintf("%s.%s.log", name, event)
+}
+
+type lifecycleEvent struct {
+	name   string
+	script string
+}
+
+// lifecycleEvents lists the scripts to run for the package in directory.
+// `npm run-script install` also runs preinstall and postinstall, so those are
+// only run on their own when there is no install step.
+func (pkg PackageJSON) lifecycleEvents(directory string) (events []lifecycleEvent, err error) {
+	hasInstall, err := pkg.HasInstallScript()
+	if err != nil {
+		return
+	}
+
+	// check for binding.gyp
+	var hasBindingGyp bool
+	_, err = os.Stat(filepath.Join(directory, "binding.gyp"))
+	if os.IsNotExist(err) {
+		err = nil
+		hasBindingGyp = false
+	} else if err != nil {
+		return
+	} else {
+		hasBindingGyp = true
+	}
+
+	if hasInstall {
+		return []lifecycleEvent{{"install", pkg.Script("install")}}, nil
+	} else if hasBindingGyp {
+		return []lifecycleEvent{{"install", "node-gyp rebuild"}}, nil
+	}
+
+	for _, event := range []string{"preinstall", "postinstall"} {
+		if script := pkg.Script(event); script != "" {
+			events = append(events, lifecycleEvent{event, script})
+		}
+	}
+
+	return
+}
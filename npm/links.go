@@ -0,0 +1,367 @@
+package npm
+
+// bin and man page linking. All links for a tree are planned up front, so
+// that names claimed by more than one package resolve the same way on every
+// install: as in npm, the shallowest package (then the first by path) keeps
+// the name, and every other claim is reported as a conflict.
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type linkClaim struct {
+	dir    string // .bin, prefix/bin or prefix/share/man/manN
+	name   string
+	source string // absolute path of the linked file
+	owner  string // directory of the package claiming the name
+	isBin  bool
+
+	// whether an existing link to target may be replaced; links in a
+	// prefix are only replaced when they point into our own tree
+	replace func(target string) bool
+}
+
+type byClaim []linkClaim
+
+func (c byClaim) Len() int      { return len(c) }
+func (c byClaim) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byClaim) Less(i, j int) bool {
+	if c[i].dir != c[j].dir {
+		return c[i].dir < c[j].dir
+	}
+	if c[i].name != c[j].name {
+		return c[i].name < c[j].name
+	}
+	if di, dj := packageDepth(c[i].owner), packageDepth(c[j].owner); di != dj {
+		return di < dj
+	}
+	return c[i].owner < c[j].owner
+}
+
+func packageDepth(dir string) int {
+	return strings.Count(filepath.ToSlash(dir), "/node_modules/")
+}
+
+var manSectionRe = regexp.MustCompile(`\.([0-9]+)(\.gz)?$`)
+
+// linkTree links the bin scripts of every package under rootDir into the
+// .bin directory next to it, as symlinks or wrapper scripts. If a link prefix
+// is set, the bins of top-level packages are also linked into prefix/bin and
+// their man pages into prefix/share/man, like a global npm install.
+func linkTree(roots []*scriptNode, rootDir string, opts InstallOptions) (err error) {
+	var claims []linkClaim
+
+	var walk func(nodes []*scriptNode) error
+	walk = func(nodes []*scriptNode) error {
+		for _, n := range nodes {
+			if !n.workspace {
+				// workspaces are linked from node_modules like any other
+				// package
+				binDir := filepath.Join(nodeModulesDir(n.dir), ".bin")
+				topLevel := nodeModulesDir(n.dir) == rootDir
+
+				nodeClaims, err := n.linkClaims(binDir, topLevel, rootDir, opts.LinkPrefix)
+				if err != nil {
+					return err
+				}
+				claims = append(claims, nodeClaims...)
+			}
+
+			err := walk(n.deps)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err = walk(roots)
+	if err != nil {
+		return
+	}
+
+	return applyClaims(claims, opts)
+}
+
+// linkClaims lists the links n needs: its bins in binDir and, for top-level
+// packages when there is a link prefix, its bins and man pages in the prefix.
+// n keeps them, to remove the links if the package is removed.
+func (n *scriptNode) linkClaims(binDir string, topLevel bool, rootDir string, prefix string) (claims []linkClaim, err error) {
+	defer func() {
+		n.claims = append(n.claims, claims...)
+	}()
+
+	always := func(string) bool { return true }
+	ours := func(target string) bool { return isWithin(target, rootDir) }
+
+	bins, err := n.pkg.binScriptsIn(n.dir)
+	if err != nil {
+		return
+	}
+
+	for name, scriptPath := range bins {
+		source := filepath.Join(n.dir, scriptPath)
+		if !isWithin(source, n.dir) {
+			log.Printf("[WARN] bin script %s points outside of %s\n", name, n.dir)
+			continue
+		}
+
+		claims = append(claims, linkClaim{binDir, name, source, n.dir, true, always})
+
+		if prefix != "" && topLevel {
+			claims = append(claims, linkClaim{filepath.Join(prefix, "bin"), name, source, n.dir, true, ours})
+		}
+	}
+
+	if prefix == "" || !topLevel {
+		return
+	}
+
+	manPages, err := n.pkg.manPagesIn(n.dir)
+	if err != nil {
+		return
+	}
+
+	for _, page := range manPages {
+		section := manSectionRe.FindStringSubmatch(page)
+		if section == nil {
+			log.Printf("[WARN] man page %s has no section number\n", page)
+			continue
+		}
+
+		manDir := filepath.Join(prefix, "share", "man", "man"+section[1])
+		claims = append(claims, linkClaim{manDir, filepath.Base(page), page, n.dir, false, ours})
+	}
+
+	return
+}
+
+// applyClaims creates the links for every name the first claim in sort order
+// wins, reporting the rest as conflicts
+func applyClaims(claims []linkClaim, opts InstallOptions) (err error) {
+	sort.Sort(byClaim(claims))
+
+	conflicts := 0
+	for i, claim := range claims {
+		if i > 0 && claims[i-1].dir == claim.dir && claims[i-1].name == claim.name {
+			// the winning claim for this name sorts first
+			winner := i - 1
+			for winner > 0 && claims[winner-1].dir == claim.dir && claims[winner-1].name == claim.name {
+				winner--
+			}
+
+			log.Printf("[WARN] %s is claimed by both %s and %s; keeping %s\n",
+				filepath.Join(claim.dir, claim.name), claims[winner].owner, claim.owner, claims[winner].owner)
+			conflicts++
+			continue
+		}
+
+		if claim.isBin {
+			err = makeExecutable(claim.source)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.MkdirAll(claim.dir, 0755)
+		if err != nil {
+			return err
+		}
+
+		if claim.isBin && opts.BinWrappers {
+			err = wrapBin(claim.dir, claim.name, claim.source, claim.replace, opts.BinShims)
+		} else {
+			err = linkFile(claim.dir, claim.name, claim.source, claim.replace)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if conflicts > 0 {
+		log.Printf("[WARN] %d conflicting bin or man page names\n", conflicts)
+	}
+
+	return
+}
+
+// unlink removes the links made for n's claims, before n is removed. Names
+// another package won are left alone.
+func (n *scriptNode) unlink() (err error) {
+	for _, claim := range n.claims {
+		err = unlinkFile(claim.dir, claim.name, claim.source)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// unlinkFile removes dir/name, and any shims next to it, if it is a link to
+// or wrapper of source
+func unlinkFile(dir string, name string, source string) (err error) {
+	linkPath := filepath.Join(dir, name)
+
+	target, readErr := os.Readlink(linkPath)
+	if readErr == nil {
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(dir, target)
+		}
+		if filepath.Clean(target) != source {
+			return
+		}
+		return os.Remove(linkPath)
+	}
+
+	if wrapperTarget(linkPath) != source {
+		return
+	}
+
+	err = os.Remove(linkPath)
+	if err != nil {
+		return
+	}
+
+	return removeShims(dir, name)
+}
+
+// bin scripts must always be executable
+// see https://github.com/npm/npm/blob/2.x/lib/build.js#L190
+//
+// scripts that are generated by the package's own install script do not
+// exist yet while linking; they are made executable once it has run
+func makeExecutable(source string) (err error) {
+	err = os.Chmod(source, 0777)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("[FATAL] %s is not executable\n", source)
+	}
+
+	return
+}
+
+func (pkg PackageJSON) makeBinsExecutable(directory string) (err error) {
+	bins, err := pkg.binScriptsIn(directory)
+	if err != nil {
+		return
+	}
+
+	for name, scriptPath := range bins {
+		source := filepath.Join(directory, scriptPath)
+		if !isWithin(source, directory) {
+			continue
+		}
+
+		if _, statErr := os.Stat(source); os.IsNotExist(statErr) {
+			log.Printf("[WARN] bin script %s does not exist at %s\n", name, source)
+			continue
+		}
+
+		err = makeExecutable(source)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// linkFile creates dir/name as a relative symlink to source. An existing
+// link pointing somewhere else is replaced if replace allows it.
+func linkFile(dir string, name string, source string, replace func(target string) bool) (err error) {
+	linkPath := filepath.Join(dir, name)
+
+	target, err := filepath.Rel(dir, source)
+	if err != nil {
+		return err
+	}
+
+	existing, err := os.Readlink(linkPath)
+	if err == nil {
+		if existing == target {
+			return
+		}
+
+		if !filepath.IsAbs(existing) {
+			existing = filepath.Join(dir, existing)
+		}
+		if !replace(existing) {
+			log.Printf("[WARN] %s already links to %s, not replacing it\n", linkPath, existing)
+			return nil
+		}
+
+		log.Printf("[WARN] symlink: replacing %s -> %s with %s\n", linkPath, existing, target)
+		err = os.Remove(linkPath)
+		if err != nil {
+			return err
+		}
+	} else if _, statErr := os.Lstat(linkPath); statErr == nil {
+		log.Printf("[WARN] %s already exists and is not a symlink\n", linkPath)
+		return nil
+	}
+
+	err = os.Symlink(target, linkPath)
+	if err != nil {
+		log.Printf("[FATAL] could not link %s to %s\n", linkPath, target)
+		return err
+	}
+
+	return
+}
+
+// nodeModulesDir returns the node_modules directory that contains the
+// package in directory, skipping over the @scope directory of scoped packages
+func nodeModulesDir(directory string) string {
+	parent := filepath.Dir(directory)
+	if strings.HasPrefix(filepath.Base(parent), "@") {
+		parent = filepath.Dir(parent)
+	}
+
+	return parent
+}
+
+func isWithin(path string, directory string) bool {
+	rel, err := filepath.Rel(directory, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// manPagesIn returns the absolute paths of the package's man pages, from
+// either the man field or the files in directories.man
+func (pkg PackageJSON) manPagesIn(directory string) (pages []string, err error) {
+	switch man := pkg["man"].(type) {
+	case string:
+		pages = append(pages, man)
+	case []interface{}:
+		for _, m := range man {
+			page, ok := m.(string)
+			if !ok {
+				return nil, fmt.Errorf("unwrap: wrong format for man pages in %s", directory)
+			}
+			pages = append(pages, page)
+		}
+	default:
+		pages, err = pkg.directoryFiles(directory, "man")
+		if err != nil {
+			return
+		}
+	}
+
+	for i, page := range pages {
+		pages[i] = filepath.Join(directory, page)
+		if !isWithin(pages[i], directory) {
+			return nil, fmt.Errorf("unwrap: man page %s is outside of %s", page, directory)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,115 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// listDir lists the names in dir, or nothing if it doesn't exist
+func listDir(t *testing.T, dir string) (names []string) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+
+	return
+}
+
+// linkedTo returns what the link or wrapper at path runs
+func linkedTo(path string) string {
+	if target, err := os.Readlink(path); err == nil {
+		return filepath.Join(filepath.Dir(path), target)
+	}
+
+	return wrapperTarget(path)
+}
+
+// a failed optional package takes its bin and man page links with it, but
+// not the names other packages won
+func TestUnlinkNode(t *testing.T) {
+	tests := []struct {
+		name string
+		opts InstallOptions
+		bins []string
+	}{
+		{name: "symlinks", bins: []string{"other", "shared"}},
+		{name: "wrappers", opts: InstallOptions{BinWrappers: true}, bins: []string{"other", "shared"}},
+		{name: "shims", opts: InstallOptions{BinWrappers: true, BinShims: true}, bins: []string{"other", "other.cmd", "other.ps1", "shared", "shared.cmd", "shared.ps1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			rootDir := filepath.Join(dir, "node_modules")
+			prefix := filepath.Join(dir, "prefix")
+			writeTree(t, rootDir, map[string]string{
+				"zed/package.json":                   `{"name": "zed", "bin": {"zed": "cli.js", "shared": "shared.js"}, "man": "zed.1"}`,
+				"zed/cli.js":                         "#!/usr/bin/env node\n",
+				"zed/shared.js":                      "#!/usr/bin/env node\n",
+				"zed/zed.1":                          ".TH ZED 1\n",
+				"other/package.json":                 `{"name": "other", "bin": {"other": "cli.js", "shared": "shared.js"}}`,
+				"other/cli.js":                       "#!/usr/bin/env node\n",
+				"other/shared.js":                    "#!/usr/bin/env node\n",
+				"host/package.json":                  `{"name": "host"}`,
+				"host/node_modules/zed/package.json": `{"name": "zed", "bin": "cli.js"}`,
+				"host/node_modules/zed/cli.js":       "#!/usr/bin/env node\n",
+			})
+
+			node := func(dir string, optional bool) *scriptNode {
+				pkg, err := ReadPackageJSON(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return &scriptNode{name: filepath.Base(dir), dir: dir, pkg: pkg, optional: optional}
+			}
+			zed := node(filepath.Join(rootDir, "zed"), true)
+			other := node(filepath.Join(rootDir, "other"), false)
+			host := node(filepath.Join(rootDir, "host"), false)
+			nested := node(filepath.Join(rootDir, "host", "node_modules", "zed"), true)
+			host.deps = []*scriptNode{nested}
+
+			tt.opts.LinkPrefix = prefix
+			if err := linkTree([]*scriptNode{zed, other, host}, rootDir, tt.opts); err != nil {
+				t.Fatal(err)
+			}
+
+			binDir := filepath.Join(rootDir, ".bin")
+			prefixBin := filepath.Join(prefix, "bin")
+			manDir := filepath.Join(prefix, "share", "man", "man1")
+			nestedBin := filepath.Join(rootDir, "host", "node_modules", ".bin")
+			if len(listDir(t, binDir)) == len(tt.bins) || len(listDir(t, manDir)) != 1 || len(listDir(t, nestedBin)) == 0 {
+				t.Fatalf("zed's links are missing: .bin = %q", listDir(t, binDir))
+			}
+
+			for _, n := range []*scriptNode{zed, nested} {
+				if err := n.unlink(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, bin := range []string{binDir, prefixBin} {
+				if got := listDir(t, bin); !reflect.DeepEqual(got, tt.bins) {
+					t.Errorf("%s = %q, want %q", bin, got, tt.bins)
+				}
+				if got, want := linkedTo(filepath.Join(bin, "shared")), filepath.Join(other.dir, "shared.js"); got != want {
+					t.Errorf("%s/shared runs %s, want %s", bin, got, want)
+				}
+			}
+			if got := listDir(t, manDir); len(got) != 0 {
+				t.Errorf("man pages = %q, want none", got)
+			}
+			if got := listDir(t, nestedBin); len(got) != 0 {
+				t.Errorf("nested .bin = %q, want nothing", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package npm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// the lockfiles LoadApp understands, in order of preference
+var lockfiles = []string{"npm-shrinkwrap.json", "package-lock.json", "yarn.lock", "pnpm-lock.yaml"}
+
+// LoadApp reads the dependency tree of the project in dir from whichever
+// lockfile it has, returning the name of the lockfile used
+func LoadApp(dir string) (app App, lockfile string, err error) {
+	for _, name := range lockfiles {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return app, name, err
+		}
+
+		app, err = LoadLockfile(filepath.Join(dir, name))
+		return app, name, err
+	}
+
+	return app, "", fmt.Errorf("unwrap: no lockfile found (looked for %s)", strings.Join(lockfiles, ", "))
+}
+
+// LoadLockfile reads the dependency tree recorded in the lockfile at path,
+// telling the formats apart by its name
+func LoadLockfile(path string) (app App, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	switch name := filepath.Base(path); {
+	case strings.HasSuffix(name, ".lock"):
+		return ParseYarnApp(f, filepath.Dir(path))
+	case strings.HasSuffix(name, ".yaml"), strings.HasSuffix(name, ".yml"):
+		return ParsePnpmApp(f)
+	}
+
+	return ParseApp(f)
+}
@@ -0,0 +1,251 @@
+package npm
+
+// git dependencies are installed the way npm installs them: from the tarball
+// `npm pack` would make of the checkout, extracted like any registry package.
+// Packages with prepack, prepare or postpack scripts are built first, in a
+// copy of the checkout with all of their dependencies, devDependencies
+// included, installed.
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// the scripts npm pack runs, in order
+var packScripts = []string{"prepack", "prepare", "postpack"}
+
+// npm gives every file in a package the same date, so that packing the same
+// files always makes the same tarball
+var packTime = time.Date(1985, time.October, 26, 8, 15, 0, 0, time.UTC)
+
+// packGitModule packs the checkout of m in tmpdir, returning the path of the
+// tarball. The tarball is reused by later copies of the same checkout.
+func packGitModule(m Module, tmpdir string, opts InstallOptions) (tarball string, err error) {
+	gitUrl, ok := m.GitSpec()
+	if !ok {
+		return "", fmt.Errorf("unwrap: %s is not a git dependency", m.Name)
+	}
+
+	checkout := filepath.Join(tmpdir, gitUrl.dirName(m.Name))
+	tarball = checkout + ".tgz"
+
+	// another install sharing the cache may be packing it too
+	unlock, err := lockCacheEntry(tmpdir, gitUrl.dirName(m.Name))
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	if _, err := os.Stat(tarball); err == nil {
+		return tarball, nil
+	}
+
+	pkg, err := ReadPackageJSON(checkout)
+	if err != nil {
+		return
+	}
+
+	source := checkout
+	if events := pkg.packEvents(); len(events) > 0 {
+		name, _ := pkg.Name()
+		version, _ := pkg.Version()
+
+		if opts.Scripts.Allows(name, version) {
+			source = filepath.Join(tmpdir, "git-build", gitUrl.dirName(m.Name))
+			defer os.RemoveAll(source)
+
+			err = prepareGitModule(m, checkout, source, events, tmpdir, opts)
+			if err != nil {
+				return
+			}
+
+			// the scripts may have changed what gets published
+			pkg, err = ReadPackageJSON(source)
+			if err != nil {
+				return
+			}
+		} else {
+			fmt.Printf("skipping prepare scripts for %s\n", m.Name)
+			for _, ev := range events {
+				opts.Scripts.skip(SkippedScript{Name: name, Version: version, Path: checkout, Script: ev.script})
+			}
+		}
+	}
+
+	files, err := packList(source, pkg)
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("packing %s (%d files)\n", m.Name, len(files))
+	return tarball, writePackTarball(tarball, source, files)
+}
+
+// packEvents lists the scripts npm pack would run for the package
+func (pkg PackageJSON) packEvents() (events []lifecycleEvent) {
+	for _, event := range packScripts {
+		if script := pkg.Script(event); script != "" {
+			events = append(events, lifecycleEvent{event, script})
+		}
+	}
+
+	return
+}
+
+// prepareGitModule copies the checkout to workDir, installs its dependencies
+// there and runs its pack scripts
+func prepareGitModule(m Module, checkout string, workDir string, events []lifecycleEvent, tmpdir string, opts InstallOptions) (err error) {
+	npmbin, err := exec.LookPath("npm")
+	if err != nil {
+		return fmt.Errorf("unwrap: cannot find npm in $PATH to prepare %s", m.Name)
+	}
+
+	err = os.RemoveAll(workDir)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(workDir, 0755)
+	if err != nil {
+		return
+	}
+	err = copyTree(checkout, workDir, func(string, os.FileInfo) bool { return false })
+	if err != nil {
+		return
+	}
+
+	err = installPackDependencies(m, workDir, npmbin, opts)
+	if err != nil {
+		return
+	}
+
+	s := &scriptScheduler{npmbin: npmbin, rootDir: tmpdir, opts: opts}
+	node := &scriptNode{name: m.Name, dir: workDir}
+	node.pkg, err = ReadPackageJSON(workDir)
+	if err != nil {
+		return
+	}
+
+	for _, ev := range events {
+		err = s.runScript(node, ev)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// installPackDependencies installs every dependency of the package in dir,
+// from its own lockfile when it has one. Without a lockfile, npm resolves
+// them, without running their scripts.
+func installPackDependencies(m Module, dir string, npmbin string, opts InstallOptions) (err error) {
+	app, lockfile, err := LoadApp(dir)
+	if lockfile == "" {
+		log.Printf("[WARN] %s has no lockfile; installing its dependencies with npm, without their scripts\n", m.Name)
+		return execCommand(npmbin, []string{"npm", "install", "--no-package-lock", "--no-save", "--ignore-scripts"}, dir)
+	}
+	if err != nil {
+		return fmt.Errorf("unwrap: %s: %s: %v", m.Name, lockfile, err)
+	}
+
+	log.Printf("installing dependencies of %s from its %s\n", m.Name, lockfile)
+
+	err = app.SkipIncompatible()
+	if err != nil {
+		return
+	}
+
+	depOpts := opts
+	depOpts.BaseDir = dir
+	depOpts.LinkPrefix = ""
+
+	downloadDir := app.DownloadDependencies()
+	return app.InstallFromTmpdir(downloadDir, filepath.Join(dir, "node_modules"), depOpts)
+}
+
+func execCommand(bin string, args []string, wd string) (err error) {
+	cmd := exec.Cmd{
+		Path:   bin,
+		Args:   args,
+		Dir:    wd,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	return cmd.Run()
+}
+
+// writePackTarball writes files, relative to dir, into a gzipped tarball
+// laid out like the ones in the registry
+func writePackTarball(tarball string, dir string, files []string) (err error) {
+	partial := tarball + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return
+	}
+	defer os.Remove(partial)
+
+	compressor := gzip.NewWriter(f)
+	tarWriter := tar.NewWriter(compressor)
+
+	for _, file := range files {
+		err = addPackFile(tarWriter, dir, file)
+		if err != nil {
+			f.Close()
+			return
+		}
+	}
+
+	err = tarWriter.Close()
+	if err == nil {
+		err = compressor.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+
+	return os.Rename(partial, tarball)
+}
+
+func addPackFile(tarWriter *tar.Writer, dir string, file string) (err error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(file)))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	// like npm, only whether a file is executable survives packing
+	mode := int64(0644)
+	if info.Mode()&0111 != 0 {
+		mode = 0755
+	}
+
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:     "package/" + file,
+		Mode:     mode,
+		Size:     info.Size(),
+		ModTime:  packTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(tarWriter, f)
+	return
+}
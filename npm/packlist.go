@@ -0,0 +1,373 @@
+package npm
+
+// which files of a package directory `npm pack` would publish, following
+// npm-packlist: the files field picks what goes in, .npmignore (or, failing
+// that, .gitignore) files leave things out, a few files are always left out
+// and a few, like package.json, are always kept
+// see https://docs.npmjs.com/cli/configuring-npm/package-json#files
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// files and directories never published
+var (
+	packIgnoredDirs  = map[string]bool{".git": true, "CVS": true, ".svn": true, ".hg": true, "node_modules": true}
+	packIgnoredFiles = map[string]bool{
+		".npmrc": true, ".npmignore": true, ".gitignore": true, "npm-debug.log": true,
+		".DS_Store": true, ".lock-wscript": true, "config.gypi": true,
+	}
+	packIgnoredRe = regexp.MustCompile(`^(\._.*|\..*\.swp|\.wafpickle-\d+|.*\.orig)$`)
+	// lockfiles only mean something at the root of a project
+	packIgnoredRootFiles = map[string]bool{"package-lock.json": true, "yarn.lock": true, "pnpm-lock.yaml": true}
+)
+
+// files at the root published whatever the rules say
+var packAlwaysRe = regexp.MustCompile(`(?i)^(readme|license|licence|copying)(\..*)?$`)
+
+// ignoreRule is a line of a .gitignore-style file, or an entry of the files
+// field
+type ignoreRule struct {
+	base     string // the directory the rule was read in, relative to the package
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func parseIgnoreRule(base string, line string) (rule ignoreRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+
+	rule.base = base
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// patterns with a slash anywhere but the end match from the base,
+	// others match a name at any depth
+	rule.anchored = strings.Contains(line, "/")
+	rule.pattern = strings.TrimPrefix(line, "/")
+
+	return rule, rule.pattern != ""
+}
+
+// matches reports whether the rule applies to rel, a slash-separated path
+// relative to the package
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+
+	return matchGlob(r.pattern, path.Base(rel))
+}
+
+// matchGlob matches a slash-separated path against a pattern whose segments
+// are path.Match patterns, or ** for any number of segments
+func matchGlob(pattern string, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// ignored applies rules in order, the last one matching winning
+func ignored(rules []ignoreRule, rel string, isDir bool) (ignore bool) {
+	for _, r := range rules {
+		if r.matches(rel, isDir) {
+			ignore = !r.negate
+		}
+	}
+
+	return
+}
+
+// readIgnoreRules reads the .npmignore in dir, or its .gitignore if it has
+// none
+func readIgnoreRules(root string, dir string) (rules []ignoreRule, err error) {
+	for _, name := range []string{".npmignore", ".gitignore"} {
+		f, err := os.Open(filepath.Join(root, filepath.FromSlash(dir), name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if rule, ok := parseIgnoreRule(dir, scanner.Text()); ok {
+				rules = append(rules, rule)
+			}
+		}
+
+		return rules, scanner.Err()
+	}
+
+	return
+}
+
+type packWalker struct {
+	root    string
+	files   []ignoreRule // from the files field; nil to publish everything
+	bundled map[string]bool
+	list    []string
+}
+
+// packList lists the files of the package in root that npm would publish,
+// as sorted slash-separated paths relative to root
+func packList(root string, pkg PackageJSON) (files []string, err error) {
+	w := &packWalker{root: root, bundled: pkg.BundledDependencies()}
+
+	if _, ok := pkg["files"]; ok {
+		w.files = []ignoreRule{}
+		for _, entry := range pkg.stringList("files") {
+			if rule, ok := parseIgnoreRule("", entry); ok {
+				// entries are relative to the package, whatever they contain
+				rule.anchored = true
+				w.files = append(w.files, rule)
+			}
+		}
+	}
+
+	err = w.walk("", nil)
+	if err != nil {
+		return
+	}
+
+	err = w.addAlwaysIncluded(pkg)
+	if err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, file := range w.list {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	return
+}
+
+func (w *packWalker) walk(dir string, rules []ignoreRule) (err error) {
+	// with a files field, the root's ignore files don't apply, but those
+	// further down still do
+	if dir != "" || w.files == nil {
+		dirRules, err := readIgnoreRules(w.root, dir)
+		if err != nil {
+			return err
+		}
+		rules = append(rules[:len(rules):len(rules)], dirRules...)
+	}
+
+	entries, err := readDirNames(filepath.Join(w.root, filepath.FromSlash(dir)))
+	if err != nil {
+		return
+	}
+
+	for _, name := range entries {
+		rel := path.Join(dir, name)
+		info, err := os.Lstat(filepath.Join(w.root, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+
+		if rel == "node_modules" && info.IsDir() {
+			err = w.walkBundled()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if packIgnored(rel, name, info.IsDir()) || ignored(rules, rel, info.IsDir()) {
+			continue
+		}
+
+		switch {
+		case info.IsDir():
+			err = w.walk(rel, rules)
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			if w.inFiles(rel) {
+				w.list = append(w.list, rel)
+			}
+		default:
+			// npm doesn't publish symlinks
+		}
+	}
+
+	return
+}
+
+func packIgnored(rel string, name string, isDir bool) bool {
+	if isDir {
+		return packIgnoredDirs[name]
+	}
+
+	return packIgnoredFiles[name] || packIgnoredRe.MatchString(name) || (rel == name && packIgnoredRootFiles[name])
+}
+
+// inFiles reports whether the files field, if any, includes rel, either
+// directly or through one of its directories
+func (w *packWalker) inFiles(rel string) (included bool) {
+	if w.files == nil {
+		return true
+	}
+
+	for _, r := range w.files {
+		matched := r.matches(rel, false)
+		for dir := path.Dir(rel); !matched && dir != "."; dir = path.Dir(dir) {
+			matched = r.matches(dir, true)
+		}
+		if matched {
+			included = !r.negate
+		}
+	}
+
+	return
+}
+
+// walkBundled publishes bundled dependencies as they are installed
+func (w *packWalker) walkBundled() (err error) {
+	for name := range w.bundled {
+		dir := filepath.Join(w.root, "node_modules", filepath.FromSlash(name))
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			continue
+		}
+
+		err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(w.root, p)
+			if err != nil {
+				return err
+			}
+			w.list = append(w.list, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// addAlwaysIncluded adds package.json, the readme and license, and the files
+// main and bin point to
+func (w *packWalker) addAlwaysIncluded(pkg PackageJSON) (err error) {
+	candidates := []string{"package.json"}
+
+	names, err := readDirNames(w.root)
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		if packAlwaysRe.MatchString(name) {
+			candidates = append(candidates, name)
+		}
+	}
+
+	if main, ok := pkg["main"].(string); ok {
+		candidates = append(candidates, main)
+	}
+
+	if _, ok := pkg["bin"]; ok {
+		bins, err := pkg.BinScripts()
+		if err != nil {
+			return err
+		}
+		for _, bin := range bins {
+			candidates = append(candidates, bin)
+		}
+	}
+
+	for _, candidate := range candidates {
+		rel := path.Clean(filepath.ToSlash(candidate))
+		if strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+			continue
+		}
+
+		info, err := os.Lstat(filepath.Join(w.root, filepath.FromSlash(rel)))
+		if err == nil && info.Mode().IsRegular() {
+			w.list = append(w.list, rel)
+		}
+	}
+
+	return nil
+}
+
+func readDirNames(dir string) (names []string, err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	names, err = f.Readdirnames(-1)
+	sort.Strings(names)
+
+	return
+}
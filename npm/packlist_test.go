@@ -0,0 +1,185 @@
+package npm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRuleMatches(t *testing.T) {
+	tests := []struct {
+		base  string
+		line  string
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"", "*.log", "debug.log", false, true},
+		{"", "*.log", "lib/deep/debug.log", false, true},
+		{"", "/*.log", "lib/debug.log", false, false},
+		{"", "/*.log", "debug.log", false, true},
+		{"", "test/", "test", true, true},
+		{"", "test/", "test", false, false},
+		{"", "test/", "lib/test", true, true},
+		{"", "lib/*.js", "lib/a.js", false, true},
+		{"", "lib/*.js", "lib/sub/a.js", false, false},
+		{"", "lib/**/*.js", "lib/sub/deep/a.js", false, true},
+		{"", "lib/**/*.js", "lib/a.js", false, true},
+		{"", "**/fixtures", "a/b/fixtures", true, true},
+		{"", `\#notes`, "#notes", false, true},
+		{"lib", "*.map", "lib/a.js.map", false, true},
+		{"lib", "*.map", "a.js.map", false, false},
+		{"lib", "/x.js", "lib/x.js", false, true},
+		{"lib", "/x.js", "lib/sub/x.js", false, false},
+	}
+
+	for _, test := range tests {
+		rule, ok := parseIgnoreRule(test.base, test.line)
+		if !ok {
+			t.Errorf("parseIgnoreRule(%q) failed", test.line)
+			continue
+		}
+		if got := rule.matches(test.rel, test.isDir); got != test.want {
+			t.Errorf("%q in %q matches %s: got %v, want %v", test.line, test.base, test.rel, got, test.want)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok := parseIgnoreRule("", line); ok {
+			t.Errorf("parseIgnoreRule(%q) should give no rule", line)
+		}
+	}
+}
+
+func TestIgnoredLastRuleWins(t *testing.T) {
+	var rules []ignoreRule
+	for _, line := range []string{"*.js", "!keep.js", "lib/keep.js"} {
+		rule, _ := parseIgnoreRule("", line)
+		rules = append(rules, rule)
+	}
+
+	tests := map[string]bool{"a.js": true, "keep.js": false, "lib/keep.js": true, "a.ts": false}
+	for rel, want := range tests {
+		if got := ignored(rules, rel, false); got != want {
+			t.Errorf("ignored(%s) = %v, want %v", rel, got, want)
+		}
+	}
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, contents := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPackList(t *testing.T) {
+	tests := []struct {
+		name  string
+		pkg   string
+		files map[string]string
+		want  []string
+	}{
+		{
+			name: "npmignore",
+			pkg:  `{"name": "p"}`,
+			files: map[string]string{
+				".npmignore":            "test/\n*.log\n",
+				".gitignore":            "lib/\n",
+				"index.js":              "",
+				"lib/a.js":              "",
+				"lib/yarn.lock":         "",
+				"test/a.test.js":        "",
+				"debug.log":             "",
+				"package-lock.json":     "",
+				".DS_Store":             "",
+				"lib/a.js.orig":         "",
+				".git/HEAD":             "",
+				"node_modules/x/x.js":   "",
+				"README.md":             "",
+				"docs/.npmignore":       "*.png\n!logo.png\n",
+				"docs/shot.png":         "",
+				"docs/logo.png":         "",
+				"docs/guide/shot-2.png": "",
+			},
+			want: []string{"README.md", "docs/logo.png", "index.js", "lib/a.js", "lib/yarn.lock", "package.json"},
+		},
+		{
+			name: "gitignore",
+			pkg:  `{"name": "p"}`,
+			files: map[string]string{
+				".gitignore":   "dist\n/coverage\n",
+				"index.js":     "",
+				"dist/out.js":  "",
+				"coverage/x":   "",
+				"src/coverage": "",
+			},
+			want: []string{"index.js", "package.json", "src/coverage"},
+		},
+		{
+			name: "files field",
+			pkg:  `{"name": "p", "main": "main.js", "bin": {"p": "cli/p.js"}, "files": ["lib", "types/*.d.ts", "!lib/**/*.test.js"]}`,
+			files: map[string]string{
+				".npmignore":        "lib/\n",
+				"main.js":           "",
+				"cli/p.js":          "",
+				"cli/other.js":      "",
+				"lib/a.js":          "",
+				"lib/a.test.js":     "",
+				"lib/sub/b.js":      "",
+				"lib/sub/b.test.js": "",
+				"lib/.npmignore":    "*.map\n",
+				"lib/a.js.map":      "",
+				"types/index.d.ts":  "",
+				"types/util.ts":     "",
+				"src/a.ts":          "",
+				"LICENSE":           "",
+				"Readme.markdown":   "",
+				"CHANGELOG.md":      "",
+			},
+			want: []string{"LICENSE", "Readme.markdown", "cli/p.js", "lib/a.js", "lib/sub/b.js", "main.js", "package.json", "types/index.d.ts"},
+		},
+		{
+			name: "bundled dependencies",
+			pkg:  `{"name": "p", "files": ["index.js"], "bundledDependencies": ["@s/dep"]}`,
+			files: map[string]string{
+				"index.js":                       "",
+				"node_modules/@s/dep/index.js":   "",
+				"node_modules/@s/dep/.git/HEAD":  "",
+				"node_modules/@s/dep/.npmignore": "*",
+				"node_modules/other/index.js":    "",
+			},
+			want: []string{"index.js", "node_modules/@s/dep/.npmignore", "node_modules/@s/dep/index.js", "package.json"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := t.TempDir()
+			test.files["package.json"] = test.pkg
+			writeTree(t, root, test.files)
+
+			var pkg PackageJSON
+			if err := json.Unmarshal([]byte(test.pkg), &pkg); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := packList(root, pkg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
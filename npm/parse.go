@@ -7,7 +7,11 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 func populateModule(m *Module, dec *json.Decoder) (error error) {
@@ -57,10 +61,54 @@ func populateModule(m *Module, dec *json.Decoder) (error error) {
 				if n, ok := next.(string); ok {
 					m.Resolved = n
 				}
+			case "integrity":
+				next, _ := dec.Token()
+				// check errors
+				if n, ok := next.(string); ok {
+					m.Integrity = n
+				}
+			case "optional":
+				next, _ := dec.Token()
+				// check errors
+				if n, ok := next.(bool); ok {
+					m.Optional = n
+				}
+			case "dev":
+				next, _ := dec.Token()
+				// check errors
+				if n, ok := next.(bool); ok {
+					m.Dev = n
+				}
+			case "bundled":
+				next, _ := dec.Token()
+				// check errors
+				if n, ok := next.(bool); ok {
+					m.Bundled = n
+				}
+			case "os", "cpu", "engines":
+				var value interface{}
+				err = dec.Decode(&value)
+				if err != nil {
+					return err
+				}
+
+				switch t {
+				case "os":
+					m.OS = toStringList(value)
+				case "cpu":
+					m.CPU = toStringList(value)
+				case "engines":
+					m.Engines = toStringMap(value)
+				}
 			case "dependencies":
 				deps, _ := mkDependencies(dec)
 				// check errors
 				m.Dependencies = deps
+			default:
+				err = skipValue(dec)
+				if err != nil {
+					return err
+				}
 			}
 		case json.Delim:
 			if t == '}' {
@@ -118,12 +166,51 @@ func mkDependencies(dec *json.Decoder) (deps []Module, error error) {
 	}
 }
 
+// skipValue discards the value of a field we don't use, however deeply
+// nested it is
+func skipValue(dec *json.Decoder) error {
+	var ignored json.RawMessage
+	return dec.Decode(&ignored)
+}
+
+// os and cpu fields may hold a single string or a list of them
+func toStringList(value interface{}) (list []string) {
+	switch v := value.(type) {
+	case string:
+		list = []string{v}
+	case []interface{}:
+		for _, entry := range v {
+			if s, ok := entry.(string); ok {
+				list = append(list, s)
+			}
+		}
+	}
+
+	return
+}
+
+// old packages list engines as an array of strings; those are ignored
+func toStringMap(value interface{}) (m map[string]string) {
+	if v, ok := value.(map[string]interface{}); ok {
+		m = make(map[string]string)
+		for key, entry := range v {
+			if s, ok := entry.(string); ok {
+				m[key] = s
+			}
+		}
+	}
+
+	return
+}
+
 // ParseApp reads the npm-shrinkwrap.json data from r, and returns an App object that can be
 // traversed to find all dependencies
 func ParseApp(r io.Reader) (app App, error error) {
 	dec := json.NewDecoder(r)
 	app = App{}
 
+	var packages map[string]lockPackage
+
 	// read first token = if not '{', exit
 	init, err := dec.Token()
 	if err != nil {
@@ -170,6 +257,16 @@ func ParseApp(r io.Reader) (app App, error error) {
 				deps, _ := mkDependencies(dec)
 				// check errors
 				app.Dependencies = deps
+			case "packages":
+				err = dec.Decode(&packages)
+				if err != nil {
+					return app, err
+				}
+			default:
+				err = skipValue(dec)
+				if err != nil {
+					return app, err
+				}
 			}
 		case json.Delim:
 			if t == '}' {
@@ -180,9 +277,110 @@ func ParseApp(r io.Reader) (app App, error error) {
 		}
 	}
 
+	// newer lockfiles keep the dependencies section for older npms only;
+	// the packages map is the complete tree
+	if packages != nil {
+		app.Dependencies = packageTree(packages, "")
+		app.Workspaces = workspaceTrees(packages)
+	}
+
 	return app, nil
 }
 
+// lockPackage is an entry of the packages map in lockfileVersion 2 and 3
+// lockfiles, which is keyed by install path, e.g. node_modules/a/node_modules/b
+type lockPackage struct {
+	Version     string      `json:"version"`
+	Resolved    string      `json:"resolved"`
+	Integrity   string      `json:"integrity"`
+	Link        bool        `json:"link"`
+	Dev         bool        `json:"dev"`
+	Optional    bool        `json:"optional"`
+	DevOptional bool        `json:"devOptional"`
+	InBundle    bool        `json:"inBundle"`
+	Workspaces  interface{} `json:"workspaces"`
+	OS          interface{} `json:"os"`
+	CPU         interface{} `json:"cpu"`
+	Engines     interface{} `json:"engines"`
+}
+
+// packageTree rebuilds the nested modules installed in dir/node_modules from
+// the flat packages map
+func packageTree(packages map[string]lockPackage, dir string) (deps []Module) {
+	prefix := "node_modules/"
+	if dir != "" {
+		prefix = dir + "/node_modules/"
+	}
+
+	var names []string
+	for key := range packages {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, prefix)
+		if strings.Contains(name, "/node_modules/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := packages[prefix+name]
+
+		m := Module{
+			Name:      name,
+			Version:   p.Version,
+			Resolved:  p.Resolved,
+			Integrity: p.Integrity,
+			// devOptional packages are needed by dev and optional
+			// dependencies only
+			Optional: p.Optional || p.DevOptional,
+			Dev:      p.Dev,
+			Bundled:  p.InBundle,
+			OS:       toStringList(p.OS),
+			CPU:      toStringList(p.CPU),
+			Engines:  toStringMap(p.Engines),
+		}
+
+		// links (to workspaces, mostly) resolve to a path from the root
+		if p.Link {
+			m.Resolved = "link:" + p.Resolved
+		}
+
+		m.Dependencies = packageTree(packages, prefix+name)
+		deps = append(deps, m)
+	}
+
+	return
+}
+
+// workspaceTrees finds the packages recorded outside of node_modules that
+// the root package's workspaces globs take in. The others are the targets of
+// file: and link: dependencies.
+func workspaceTrees(packages map[string]lockPackage) (workspaces []Workspace) {
+	patterns := workspacePatterns(packages[""].Workspaces)
+
+	var paths []string
+	for key := range packages {
+		if key == "" || strings.HasPrefix(key, "node_modules/") || strings.Contains(key, "/node_modules/") {
+			continue
+		}
+		if !matchWorkspace(patterns, key) {
+			continue
+		}
+		paths = append(paths, key)
+	}
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		workspaces = append(workspaces, Workspace{Path: p, Dependencies: packageTree(packages, p)})
+	}
+
+	return
+}
+
 func ReadPackageJSON(directory string) (pkg PackageJSON, err error) {
 	pkgFile, err := ioutil.ReadFile(filepath.Join(directory, "package.json"))
 	if err != nil {
@@ -224,6 +422,49 @@ func (pkg PackageJSON) HasInstallScript() (hasScript bool, err error) {
 	return
 }
 
+// Script returns the command for the given lifecycle event, or "" if the
+// package does not define one
+func (pkg PackageJSON) Script(event string) string {
+	scripts, ok := pkg["scripts"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	script, _ := scripts[event].(string)
+	return script
+}
+
+// BundledDependencies returns the names of the dependencies the package
+// ships in its own node_modules. bundleDependencies may also be true, to
+// bundle every dependency.
+func (pkg PackageJSON) BundledDependencies() (bundled map[string]bool) {
+	bundled = make(map[string]bool)
+
+	field, ok := pkg["bundleDependencies"]
+	if !ok {
+		field = pkg["bundledDependencies"]
+	}
+
+	if all, ok := field.(bool); ok && all {
+		if deps, ok := pkg["dependencies"].(map[string]interface{}); ok {
+			for name := range deps {
+				bundled[name] = true
+			}
+		}
+		return
+	}
+
+	for _, name := range toStringList(field) {
+		bundled[name] = true
+	}
+
+	return
+}
+
+func (pkg PackageJSON) stringList(field string) []string {
+	return toStringList(pkg[field])
+}
+
 func (pkg PackageJSON) Name() (name string, err error) {
 	nameField := pkg["name"]
 
@@ -235,6 +476,17 @@ func (pkg PackageJSON) Name() (name string, err error) {
 	}
 }
 
+func (pkg PackageJSON) Version() (version string, err error) {
+	versionField := pkg["version"]
+
+	switch val := versionField.(type) {
+	case string:
+		return val, err
+	default:
+		return "", errors.New("unwrap: no version field in package.json")
+	}
+}
+
 func (pkg PackageJSON) BinScripts() (binScripts map[string]string, err error) {
 	binScripts = make(map[string]string)
 	nameVal, err := pkg.Name()
@@ -246,12 +498,14 @@ func (pkg PackageJSON) BinScripts() (binScripts map[string]string, err error) {
 	bin := pkg["bin"]
 	switch binVal := bin.(type) {
 	case string:
-		binScripts[nameVal] = binVal
+		// scoped packages link their bin without the scope
+		binScripts[path.Base(nameVal)] = binVal
 	case map[string]interface{}:
 		for k, v := range binVal {
 			switch innerVal := v.(type) {
 				case string:
-					binScripts[k] = innerVal
+					// names can't be used to escape the .bin directory
+					binScripts[path.Base(k)] = innerVal
 				default:
 					return binScripts, errors.New("wrong format for bin script")
 			}
@@ -260,3 +514,58 @@ func (pkg PackageJSON) BinScripts() (binScripts map[string]string, err error) {
 
 	return
 }
+
+// binScriptsIn returns the bin scripts of the package installed in
+// directory. As in npm, packages without a bin field can instead list a
+// directories.bin folder, every file of which is linked under its own name.
+func (pkg PackageJSON) binScriptsIn(directory string) (binScripts map[string]string, err error) {
+	binScripts, err = pkg.BinScripts()
+	if err != nil || len(binScripts) > 0 {
+		return
+	}
+
+	files, err := pkg.directoryFiles(directory, "bin")
+	for _, file := range files {
+		binScripts[filepath.Base(file)] = file
+	}
+
+	return
+}
+
+// directoryFiles lists the files below one of the package's directories
+// (e.g. directories.bin), relative to the package directory
+func (pkg PackageJSON) directoryFiles(directory string, kind string) (files []string, err error) {
+	directories, ok := pkg["directories"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	dir, ok := directories[kind].(string)
+	if !ok || dir == "" {
+		return
+	}
+
+	root := filepath.Join(directory, dir)
+	err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(directory, file)
+		if err != nil {
+			return err
+		}
+		files = append(files, rel)
+
+		return nil
+	})
+	if os.IsNotExist(err) {
+		log.Printf("[WARN] directories.%s %s does not exist in %s\n", kind, dir, directory)
+		err = nil
+	}
+
+	return
+}
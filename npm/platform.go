@@ -0,0 +1,184 @@
+package npm
+
+// checks of the os, cpu and engines fields, as in npm's install checks
+// see https://github.com/npm/npm-install-checks
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// node's names for GOOS and GOARCH values, where they differ
+var nodePlatforms = map[string]string{
+	"windows": "win32",
+}
+
+var nodeArchs = map[string]string{
+	"amd64":   "x64",
+	"386":     "ia32",
+	"ppc64le": "ppc64",
+}
+
+func nodePlatform() string {
+	if platform, ok := nodePlatforms[runtime.GOOS]; ok {
+		return platform
+	}
+	return runtime.GOOS
+}
+
+func nodeArch() string {
+	if arch, ok := nodeArchs[runtime.GOARCH]; ok {
+		return arch
+	}
+	return runtime.GOARCH
+}
+
+var (
+	nodeVersionOnce sync.Once
+	nodeVersion     string
+)
+
+// installedNodeVersion returns the version of the node on $PATH, or "" if
+// there is none
+func installedNodeVersion() string {
+	nodeVersionOnce.Do(func() {
+		out, err := exec.Command("node", "--version").Output()
+		if err != nil {
+			log.Printf("[WARN] cannot determine node version, not checking engines: %v\n", err)
+			return
+		}
+		nodeVersion = strings.TrimPrefix(strings.TrimSpace(string(out)), "v")
+	})
+
+	return nodeVersion
+}
+
+// a list of allowed values, where entries starting with ! are blocked
+// instead; an empty list allows everything
+func checkList(value string, list []string) bool {
+	if len(list) == 0 || (len(list) == 1 && list[0] == "any") {
+		return true
+	}
+
+	match := false
+	blocked := 0
+	for _, entry := range list {
+		if strings.HasPrefix(entry, "!") {
+			if entry[1:] == value {
+				return false
+			}
+			blocked++
+		} else if entry == value {
+			match = true
+		}
+	}
+
+	return match || blocked == len(list)
+}
+
+// checkPlatform reports why a package with the given os and cpu fields can't
+// be installed here, or "" if it can
+func checkPlatform(osList []string, cpuList []string) string {
+	if !checkList(nodePlatform(), osList) {
+		return fmt.Sprintf("unsupported platform %s (wants os %s)", nodePlatform(), strings.Join(osList, ","))
+	}
+	if !checkList(nodeArch(), cpuList) {
+		return fmt.Sprintf("unsupported cpu %s (wants cpu %s)", nodeArch(), strings.Join(cpuList, ","))
+	}
+
+	return ""
+}
+
+// checkEngines reports why a package with the given engines field does not
+// support the installed node, or "" if it does
+func checkEngines(engines map[string]string) string {
+	wanted, ok := engines["node"]
+	if !ok {
+		return ""
+	}
+
+	version := installedNodeVersion()
+	if version == "" {
+		return ""
+	}
+
+	matches, err := satisfies(version, wanted)
+	if err != nil || matches {
+		return ""
+	}
+
+	return fmt.Sprintf("unsupported engine node %s (wants %s)", version, wanted)
+}
+
+// SkipIncompatible removes the packages that can't be installed on this
+// platform (per the os, cpu and engines fields in the shrinkwrap) from the
+// tree. Nested dependencies of optional packages are optional too. As in
+// npm, an incompatible platform is an error for required packages, while an
+// unsupported engine is only a warning.
+func (a *App) SkipIncompatible() (err error) {
+	a.Dependencies, err = skipIncompatible(a.Dependencies, false)
+	if err != nil {
+		return
+	}
+
+	for i := range a.Workspaces {
+		a.Workspaces[i].Dependencies, err = skipIncompatible(a.Workspaces[i].Dependencies, false)
+		if err != nil {
+			return
+		}
+	}
+
+	if a.Graph != nil {
+		err = a.Graph.skipIncompatible()
+	}
+
+	return
+}
+
+func skipIncompatible(deps []Module, optional bool) (kept []Module, err error) {
+	for _, m := range deps {
+		m.Optional = m.Optional || optional
+
+		reason := checkPlatform(m.OS, m.CPU)
+		if reason != "" && !m.Optional {
+			return nil, fmt.Errorf("unwrap: %s@%s: %s", m.Name, m.Version, reason)
+		}
+
+		if reason == "" {
+			reason = checkEngines(m.Engines)
+			if reason != "" && !m.Optional {
+				log.Printf("[WARN] %s@%s: %s\n", m.Name, m.Version, reason)
+				reason = ""
+			}
+		}
+
+		if reason != "" {
+			log.Printf("[WARN] skipping optional dependency %s@%s: %s\n", m.Name, m.Version, reason)
+			continue
+		}
+
+		m.Dependencies, err = skipIncompatible(m.Dependencies, m.Optional)
+		if err != nil {
+			return nil, err
+		}
+
+		kept = append(kept, m)
+	}
+
+	return
+}
+
+// checkPackage repeats the platform checks against the package.json of an
+// extracted package, for shrinkwraps that don't record them
+func (pkg PackageJSON) checkPackage() (reason string, isEngine bool) {
+	reason = checkPlatform(pkg.stringList("os"), pkg.stringList("cpu"))
+	if reason != "" {
+		return reason, false
+	}
+
+	return checkEngines(toStringMap(pkg["engines"])), true
+}
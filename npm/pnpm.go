@@ -0,0 +1,364 @@
+package npm
+
+// pnpm-lock.yaml support. pnpm lockfiles are a flat graph of packages, each
+// listing the exact packages it depends on, plus the direct dependencies of
+// every project in the workspace (the "importers"). Versions 5.x, 6.0 and 9.0
+// of the format differ mostly in how packages are named:
+//
+//	5.x: /name/1.0.0_peer@2.0.0
+//	6.0: /name@1.0.0(peer@2.0.0)
+//	9.0: name@1.0.0(peer@2.0.0), with the dependencies in a separate
+//	     snapshots section
+//
+// The graph is installed in pnpm's isolated layout, see installGraph.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// where pnpm lockfiles expect packages without a tarball URL to come from
+const defaultRegistry = "https://registry.npmjs.org/"
+
+// PackageGraph is a lockfile's packages as a graph rather than a tree: every
+// package is installed once, and linked to from everything depending on it
+type PackageGraph struct {
+	Packages  map[string]*GraphPackage // by package ID
+	Importers map[string]*Importer     // by path from the lockfile; "." for the root
+}
+
+type GraphPackage struct {
+	ID     string
+	Module Module            // without Dependencies
+	Deps   map[string]string // name -> package ID
+}
+
+// Importer is a project in the workspace, and what it depends on directly
+type Importer struct {
+	Dependencies map[string]string // name -> package ID, or link:path
+	Dev          map[string]bool
+}
+
+// ParsePnpmApp reads a pnpm-lock.yaml from r
+func ParsePnpmApp(r io.Reader) (app App, err error) {
+	doc, err := parseYAML(r)
+	if err != nil {
+		return app, fmt.Errorf("unwrap: pnpm-lock.yaml: %v", err)
+	}
+
+	lockfile, ok := doc.(map[string]interface{})
+	if !ok {
+		return app, fmt.Errorf("unwrap: pnpm-lock.yaml is not a mapping")
+	}
+
+	lockfileVersion, _ := lockfile["lockfileVersion"].(string)
+	version, err := strconv.ParseFloat(lockfileVersion, 64)
+	if err != nil {
+		return app, fmt.Errorf("unwrap: pnpm-lock.yaml: bad lockfileVersion %q", lockfileVersion)
+	}
+	major := int(version)
+	if major < 5 || major > 9 {
+		return app, fmt.Errorf("unwrap: pnpm-lock.yaml: unsupported lockfileVersion %s", lockfileVersion)
+	}
+
+	packages := yamlMap(lockfile["packages"])
+	snapshots := yamlMap(lockfile["snapshots"])
+
+	g := &PackageGraph{
+		Packages:  make(map[string]*GraphPackage),
+		Importers: make(map[string]*Importer),
+	}
+
+	// version 9 keeps the metadata of a package once, without peer suffix,
+	// and what each peer variant depends on in snapshots
+	ids := packages
+	if major >= 9 {
+		ids = snapshots
+	}
+
+	for id := range ids {
+		entry := yamlMap(ids[id])
+		meta := entry
+		if major >= 9 {
+			meta = yamlMap(packages[stripPeerSuffix(id)])
+		}
+
+		p := &GraphPackage{ID: id, Module: pnpmModule(id, meta, entry, major), Deps: make(map[string]string)}
+		g.Packages[id] = p
+
+		for _, field := range []string{"dependencies", "optionalDependencies"} {
+			for name, ref := range yamlMap(entry[field]) {
+				p.Deps[name] = fmt.Sprint(ref)
+			}
+		}
+	}
+
+	// resolve the references between packages to IDs
+	for _, p := range g.Packages {
+		for name, ref := range p.Deps {
+			id, ok := g.resolveRef(name, ref)
+			if !ok {
+				return app, fmt.Errorf("unwrap: pnpm-lock.yaml: %s depends on %s %s, which is not in the lockfile", p.ID, name, ref)
+			}
+			p.Deps[name] = id
+		}
+	}
+
+	importers := yamlMap(lockfile["importers"])
+	if len(importers) == 0 {
+		// single projects keep their importer at the top level
+		importers = map[string]interface{}{".": lockfile}
+	}
+
+	for path, value := range importers {
+		importer := &Importer{Dependencies: make(map[string]string), Dev: make(map[string]bool)}
+		g.Importers[path] = importer
+
+		block := yamlMap(value)
+		for _, field := range []string{"dependencies", "optionalDependencies", "devDependencies"} {
+			for name, dep := range yamlMap(block[field]) {
+				// {specifier, version} since 6.0, only the version before
+				ref, ok := dep.(string)
+				if !ok {
+					ref = fmt.Sprint(yamlMap(dep)["version"])
+				}
+
+				if !strings.HasPrefix(ref, "link:") {
+					id, ok := g.resolveRef(name, ref)
+					if !ok {
+						return app, fmt.Errorf("unwrap: pnpm-lock.yaml: %s depends on %s %s, which is not in the lockfile", path, name, ref)
+					}
+					ref = id
+				}
+
+				importer.Dependencies[name] = ref
+				importer.Dev[name] = field == "devDependencies"
+			}
+		}
+	}
+
+	g.markDev()
+	app.Graph = g
+
+	return
+}
+
+// resolveRef finds the package a dependency's reference points to: a version
+// (with any peer suffix), or the full ID of an aliased or non-registry package
+func (g *PackageGraph) resolveRef(name string, ref string) (id string, ok bool) {
+	for _, candidate := range []string{ref, "/" + name + "@" + ref, "/" + name + "/" + ref, name + "@" + ref} {
+		if _, ok := g.Packages[candidate]; ok {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+// markDev flags the packages that only devDependencies lead to
+func (g *PackageGraph) markDev() {
+	prod := make(map[string]bool)
+
+	var visit func(id string)
+	visit = func(id string) {
+		if prod[id] {
+			return
+		}
+		prod[id] = true
+		for _, dep := range g.Packages[id].Deps {
+			visit(dep)
+		}
+	}
+
+	for _, importer := range g.Importers {
+		for name, ref := range importer.Dependencies {
+			if _, ok := g.Packages[ref]; ok && !importer.Dev[name] {
+				visit(ref)
+			}
+		}
+	}
+
+	for id, p := range g.Packages {
+		p.Module.Dev = !prod[id]
+	}
+}
+
+func pnpmModule(id string, meta map[string]interface{}, entry map[string]interface{}, major int) (m Module) {
+	m.Name, m.Version = pnpmNameVersion(id, major)
+	if name, ok := meta["name"].(string); ok {
+		m.Name = name
+	}
+	if version, ok := meta["version"].(string); ok {
+		m.Version = version
+	}
+
+	m.Optional = entry["optional"] == "true" || meta["optional"] == "true"
+	m.OS = toStringList(meta["os"])
+	m.CPU = toStringList(meta["cpu"])
+	m.Engines = yamlStringMap(meta["engines"])
+
+	resolution := yamlMap(meta["resolution"])
+	m.Integrity, _ = resolution["integrity"].(string)
+	tarball, _ := resolution["tarball"].(string)
+	directory, _ := resolution["directory"].(string)
+	repo, _ := resolution["repo"].(string)
+
+	switch {
+	case directory != "":
+		m.Resolved = "file:" + directory
+	case repo != "":
+		if !strings.HasPrefix(repo, "git+") {
+			repo = "git+" + repo
+		}
+		m.Resolved = fmt.Sprintf("%s#%s", repo, resolution["commit"])
+	case tarball != "":
+		m.Resolved = tarball
+	default:
+		m.Resolved = registryTarballURL(m.Name, m.Version)
+	}
+
+	return
+}
+
+func registryTarballURL(name string, version string) string {
+	base := name
+	if slash := strings.LastIndex(name, "/"); slash >= 0 {
+		base = name[slash+1:]
+	}
+
+	return fmt.Sprintf("%s%s/-/%s-%s.tgz", defaultRegistry, name, base, version)
+}
+
+// pnpmNameVersion splits a package ID into the package's name and version
+func pnpmNameVersion(id string, major int) (name string, version string) {
+	s := strings.TrimPrefix(stripPeerSuffix(id), "/")
+
+	sep := strings.LastIndex(s, "@")
+	if major < 6 {
+		sep = strings.LastIndex(s, "/")
+	}
+	if sep <= 0 {
+		return s, ""
+	}
+
+	name, version = s[:sep], s[sep+1:]
+	if major < 6 {
+		// semver versions never contain an underscore
+		if underscore := strings.Index(version, "_"); underscore >= 0 {
+			version = version[:underscore]
+		}
+	}
+
+	return
+}
+
+func stripPeerSuffix(id string) string {
+	if paren := strings.Index(id, "("); paren > 0 {
+		return id[:paren]
+	}
+
+	return id
+}
+
+// pnpmDirName is the directory under node_modules/.pnpm a package goes in,
+// named from its ID as pnpm does: name@version with peers after underscores,
+// / replaced by +, and long names shortened with a hash
+func pnpmDirName(id string, name string, version string) string {
+	s := strings.TrimPrefix(id, "/")
+	if !strings.HasPrefix(s, name+"@") && version != "" && strings.HasPrefix(s, name+"/"+version) {
+		// 5.x IDs
+		s = name + "@" + strings.TrimPrefix(s, name+"/")
+	}
+
+	s = strings.Replace(s, ")(", "_", -1)
+	s = strings.Replace(s, "(", "_", -1)
+	s = strings.Replace(s, ")", "", -1)
+	for _, c := range []string{"/", "\\", ":", "*", "?", "\"", "<", ">", "|"} {
+		s = strings.Replace(s, c, "+", -1)
+	}
+
+	if len(s) > 120 {
+		sum := sha256.Sum256([]byte(s))
+		s = s[:87] + "_" + hex.EncodeToString(sum[:])[:32]
+	}
+
+	return s
+}
+
+// DependencyList lists every package in the graph, for downloading
+func (g *PackageGraph) DependencyList() (deps []Module) {
+	for _, id := range g.ids() {
+		deps = append(deps, g.Packages[id].Module)
+	}
+
+	return
+}
+
+func (g *PackageGraph) ids() []string {
+	ids := make([]string, 0, len(g.Packages))
+	for id := range g.Packages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// omitDev drops the dev packages, and the importers' devDependencies
+func (g *PackageGraph) omitDev() {
+	for id, p := range g.Packages {
+		if p.Module.Dev {
+			delete(g.Packages, id)
+		}
+	}
+
+	for _, importer := range g.Importers {
+		for name := range importer.Dependencies {
+			if importer.Dev[name] {
+				delete(importer.Dependencies, name)
+			}
+		}
+	}
+}
+
+// skipIncompatible drops the optional packages that can't be installed here;
+// the links to them are left out when installing
+func (g *PackageGraph) skipIncompatible() (err error) {
+	for _, id := range g.ids() {
+		kept, err := skipIncompatible([]Module{g.Packages[id].Module}, false)
+		if err != nil {
+			return err
+		}
+		if len(kept) == 0 {
+			delete(g.Packages, id)
+		}
+	}
+
+	return
+}
+
+func yamlMap(value interface{}) map[string]interface{} {
+	if m, ok := value.(map[string]interface{}); ok {
+		return m
+	}
+
+	return nil
+}
+
+func yamlStringMap(value interface{}) (m map[string]string) {
+	for key, entry := range yamlMap(value) {
+		if s, ok := entry.(string); ok {
+			if m == nil {
+				m = make(map[string]string)
+			}
+			m[key] = s
+		}
+	}
+
+	return
+}
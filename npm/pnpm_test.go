@@ -0,0 +1,281 @@
+package npm
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPnpmNameVersion(t *testing.T) {
+	tests := []struct {
+		id      string
+		major   int
+		name    string
+		version string
+	}{
+		{"/alpha/1.0.0", 5, "alpha", "1.0.0"},
+		{"/@acme/scoped/1.0.0_alpha@1.0.0", 5, "@acme/scoped", "1.0.0"},
+		{"/beta/2.0.0-rc.1_alpha@1.0.0+gamma@1.2.3", 5, "beta", "2.0.0-rc.1"},
+		{"/alpha@1.0.0", 6, "alpha", "1.0.0"},
+		{"/@acme/scoped@1.0.0(alpha@1.0.0)(gamma@1.2.3)", 6, "@acme/scoped", "1.0.0"},
+		{"alpha@1.0.0", 9, "alpha", "1.0.0"},
+		{"@acme/scoped@1.0.0-beta.2(alpha@1.0.0)", 9, "@acme/scoped", "1.0.0-beta.2"},
+		{"noversion", 9, "noversion", ""},
+	}
+
+	for _, test := range tests {
+		name, version := pnpmNameVersion(test.id, test.major)
+		if name != test.name || version != test.version {
+			t.Errorf("pnpmNameVersion(%s, %d) = %s, %s; want %s, %s", test.id, test.major, name, version, test.name, test.version)
+		}
+	}
+}
+
+func TestPnpmDirName(t *testing.T) {
+	long := "/@acme/" + strings.Repeat("x", 60) + "@1.0.0(" + strings.Repeat("peer", 20) + "@2.0.0)"
+
+	tests := []struct {
+		id      string
+		name    string
+		version string
+		want    string
+	}{
+		{"/alpha/1.0.0", "alpha", "1.0.0", "alpha@1.0.0"},
+		{"/@acme/scoped/1.0.0_alpha@1.0.0", "@acme/scoped", "1.0.0", "@acme+scoped@1.0.0_alpha@1.0.0"},
+		{"/alpha@1.0.0", "alpha", "1.0.0", "alpha@1.0.0"},
+		{"/beta@2.0.0(alpha@1.0.0)(@acme/scoped@1.0.0)", "beta", "2.0.0", "beta@2.0.0_alpha@1.0.0_@acme+scoped@1.0.0"},
+		{"alpha@1.0.0", "alpha", "1.0.0", "alpha@1.0.0"},
+		{"pkg@https://codeload.github.com/u/pkg/tar.gz/abc", "pkg", "", "pkg@https+++codeload.github.com+u+pkg+tar.gz+abc"},
+		{"/@acme/" + strings.Repeat("x", 60) + "@1.0.0", "@acme/" + strings.Repeat("x", 60), "1.0.0", "@acme+" + strings.Repeat("x", 60) + "@1.0.0"},
+	}
+
+	for _, test := range tests {
+		if got := pnpmDirName(test.id, test.name, test.version); got != test.want {
+			t.Errorf("pnpmDirName(%s) = %s, want %s", test.id, got, test.want)
+		}
+	}
+
+	// long names are shortened, but stay distinct
+	got := pnpmDirName(long, "@acme/"+strings.Repeat("x", 60), "1.0.0")
+	other := pnpmDirName(strings.Replace(long, "2.0.0", "2.0.1", 1), "@acme/"+strings.Repeat("x", 60), "1.0.0")
+	if len(got) != 120 || !strings.HasPrefix(got, "@acme+xxx") || got == other {
+		t.Errorf("pnpmDirName of a long ID: got %s and %s", got, other)
+	}
+}
+
+const testPnpm5 = `lockfileVersion: 5.4
+
+specifiers:
+  alpha: ^1.0.0
+
+dependencies:
+  alpha: 1.0.0
+
+devDependencies:
+  '@acme/scoped': 1.0.0_alpha@1.0.0
+
+packages:
+
+  /alpha/1.0.0:
+    resolution: {integrity: sha512-abc}
+    dev: false
+
+  /@acme/scoped/1.0.0_alpha@1.0.0:
+    resolution: {integrity: sha512-x}
+    dependencies:
+      alpha: 1.0.0
+    dev: true
+`
+
+const testPnpm6 = `lockfileVersion: '6.0'
+
+importers:
+
+  .:
+    dependencies:
+      alpha:
+        specifier: ^1.0.0
+        version: 1.0.0
+    devDependencies:
+      beta:
+        specifier: 2.0.0
+        version: 2.0.0(alpha@1.0.0)
+    optionalDependencies:
+      fsev:
+        specifier: ^1
+        version: 1.0.0
+
+  packages/foo:
+    dependencies:
+      bar:
+        specifier: workspace:*
+        version: link:../bar
+
+packages:
+
+  /alpha@1.0.0:
+    resolution: {integrity: sha512-abc=, tarball: http://127.0.0.1:8765/alpha-1.0.0.tgz}
+    dependencies:
+      beta: 2.0.0(alpha@1.0.0)  # a cycle
+    dev: false
+
+  /beta@2.0.0(alpha@1.0.0):
+    resolution: {tarball: 'http://127.0.0.1:8765/beta-2.0.0.tgz'}
+    dependencies:
+      alpha: 1.0.0
+    dev: false
+
+  /fsev@1.0.0:
+    resolution: {integrity: sha512-f}
+    os: [darwin]
+    dev: false
+    optional: true
+`
+
+const testPnpm9 = `lockfileVersion: '9.0'
+
+importers:
+  .:
+    dependencies:
+      alpha:
+        specifier: ^1.0.0
+        version: 1.0.0
+      myalias:
+        specifier: npm:gamma@^1
+        version: gamma@1.2.3
+    devDependencies:
+      delta:
+        specifier: github:u/delta
+        version: https://codeload.github.com/u/delta/tar.gz/abc123
+
+packages:
+  alpha@1.0.0:
+    resolution: {integrity: sha512-abc}
+  '@acme/scoped@1.0.0':
+    resolution: {integrity: sha512-x}
+    engines: {node: '>=99'}
+  gamma@1.2.3:
+    resolution: {integrity: sha512-y}
+  delta@https://codeload.github.com/u/delta/tar.gz/abc123:
+    resolution: {tarball: https://codeload.github.com/u/delta/tar.gz/abc123}
+    version: 0.1.0
+
+snapshots:
+  alpha@1.0.0:
+    dependencies:
+      '@acme/scoped': 1.0.0(alpha@1.0.0)
+  '@acme/scoped@1.0.0(alpha@1.0.0)':
+    dependencies:
+      alpha: 1.0.0
+  gamma@1.2.3: {}
+  delta@https://codeload.github.com/u/delta/tar.gz/abc123: {}
+`
+
+// describePnpmGraph lists a graph's packages as id: name@version resolved [dev]
+// [optional] -> deps, and its importers as path: name=ref [dev]
+func describePnpmGraph(g *PackageGraph) (lines []string) {
+	for _, id := range g.ids() {
+		p := g.Packages[id]
+		line := id + ": " + p.Module.Name + "@" + p.Module.Version + " " + p.Module.Resolved
+		if p.Module.Dev {
+			line += " dev"
+		}
+		if p.Module.Optional {
+			line += " optional"
+		}
+		for _, name := range sortedKeys(p.Deps) {
+			line += " " + name + "=" + p.Deps[name]
+		}
+		lines = append(lines, line)
+	}
+
+	var paths []string
+	for path := range g.Importers {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		importer := g.Importers[path]
+		line := path + ":"
+		for _, name := range sortedKeys(importer.Dependencies) {
+			line += " " + name + "=" + importer.Dependencies[name]
+			if importer.Dev[name] {
+				line += " dev"
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	return
+}
+
+func TestParsePnpmApp(t *testing.T) {
+	tests := []struct {
+		name string
+		lock string
+		want []string
+	}{
+		{"5.4", testPnpm5, []string{
+			"/@acme/scoped/1.0.0_alpha@1.0.0: @acme/scoped@1.0.0 https://registry.npmjs.org/@acme/scoped/-/scoped-1.0.0.tgz dev alpha=/alpha/1.0.0",
+			"/alpha/1.0.0: alpha@1.0.0 https://registry.npmjs.org/alpha/-/alpha-1.0.0.tgz",
+			".: @acme/scoped=/@acme/scoped/1.0.0_alpha@1.0.0 dev alpha=/alpha/1.0.0",
+		}},
+		{"6.0", testPnpm6, []string{
+			"/alpha@1.0.0: alpha@1.0.0 http://127.0.0.1:8765/alpha-1.0.0.tgz beta=/beta@2.0.0(alpha@1.0.0)",
+			"/beta@2.0.0(alpha@1.0.0): beta@2.0.0 http://127.0.0.1:8765/beta-2.0.0.tgz alpha=/alpha@1.0.0",
+			"/fsev@1.0.0: fsev@1.0.0 https://registry.npmjs.org/fsev/-/fsev-1.0.0.tgz optional",
+			".: alpha=/alpha@1.0.0 beta=/beta@2.0.0(alpha@1.0.0) dev fsev=/fsev@1.0.0",
+			"packages/foo: bar=link:../bar",
+		}},
+		{"9.0", testPnpm9, []string{
+			"@acme/scoped@1.0.0(alpha@1.0.0): @acme/scoped@1.0.0 https://registry.npmjs.org/@acme/scoped/-/scoped-1.0.0.tgz alpha=alpha@1.0.0",
+			"alpha@1.0.0: alpha@1.0.0 https://registry.npmjs.org/alpha/-/alpha-1.0.0.tgz @acme/scoped=@acme/scoped@1.0.0(alpha@1.0.0)",
+			"delta@https://codeload.github.com/u/delta/tar.gz/abc123: delta@0.1.0 https://codeload.github.com/u/delta/tar.gz/abc123 dev",
+			"gamma@1.2.3: gamma@1.2.3 https://registry.npmjs.org/gamma/-/gamma-1.2.3.tgz",
+			".: alpha=alpha@1.0.0 delta=delta@https://codeload.github.com/u/delta/tar.gz/abc123 dev myalias=gamma@1.2.3",
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			app, err := ParsePnpmApp(strings.NewReader(test.lock))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := describePnpmGraph(app.Graph); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+
+	app, err := ParsePnpmApp(strings.NewReader(testPnpm9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scoped := app.Graph.Packages["@acme/scoped@1.0.0(alpha@1.0.0)"].Module
+	if scoped.Integrity != "sha512-x" || scoped.Engines["node"] != ">=99" {
+		t.Errorf("9.0 snapshots should use the metadata in packages, got %+v", scoped)
+	}
+}
+
+func TestParsePnpmAppErrors(t *testing.T) {
+	tests := []struct {
+		lock  string
+		error string
+	}{
+		{"lockfileVersion: 4.0\n", "unsupported lockfileVersion"},
+		{"lockfileVersion: latest\n", "bad lockfileVersion"},
+		{"- a\n- b\n", "not a mapping"},
+		{"lockfileVersion: '6.0'\npackages:\n  /a@1.0.0:\n    dependencies:\n      b: 2.0.0\n", "/a@1.0.0 depends on b 2.0.0"},
+		{"lockfileVersion: '6.0'\nimporters:\n  .:\n    dependencies:\n      b:\n        specifier: ^2\n        version: 2.0.0\n", ". depends on b 2.0.0"},
+	}
+
+	for _, test := range tests {
+		_, err := ParsePnpmApp(strings.NewReader(test.lock))
+		if err == nil || !strings.Contains(err.Error(), test.error) {
+			t.Errorf("got %v for %q, want an error about %s", err, test.lock, test.error)
+		}
+	}
+}
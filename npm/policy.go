@@ -0,0 +1,156 @@
+package npm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// ScriptPolicy decides which packages are allowed to run their lifecycle
+// scripts. A nil policy allows every script, like npm does.
+type ScriptPolicy struct {
+	// IgnoreAll disables every lifecycle script, like `npm install --ignore-scripts`
+	IgnoreAll bool
+
+	// Allowed maps package names to an optional semver range. When non-nil,
+	// only packages listed here may run scripts.
+	Allowed map[string]string
+
+	// Sandbox runs every script in a Linux namespace sandbox, with write
+	// access only to its own package directory and a temp dir, and no network
+	Sandbox bool
+
+	// AllowNetwork lists packages (name to optional semver range) whose
+	// sandboxed scripts keep network access, e.g. to download prebuilt binaries
+	AllowNetwork map[string]string
+
+	mu      sync.Mutex
+	skipped []SkippedScript
+}
+
+// SkippedScript records a package whose scripts were not run because of the
+// policy, so it can be reviewed after the install
+type SkippedScript struct {
+	Name    string
+	Version string
+	Path    string
+	Script  string
+}
+
+type scriptPolicyFile struct {
+	AllowScripts map[string]string `json:"allowScripts"`
+	AllowNetwork map[string]string `json:"allowNetwork"`
+}
+
+// LoadScriptPolicy reads allowlists of the form
+//
+//	{
+//	  "allowScripts": { "node-sass": "^4.0.0", "esbuild": "" },
+//	  "allowNetwork": { "esbuild": "" }
+//	}
+//
+// where an empty range allows every version of the package. Without
+// allowScripts, every package may run scripts.
+func LoadScriptPolicy(filename string) (policy *ScriptPolicy, err error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	var file scriptPolicyFile
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap: cannot parse %s: %v", filename, err)
+	}
+
+	policy = &ScriptPolicy{}
+
+	policy.Allowed, err = checkAllowlist(file.AllowScripts, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.AllowNetwork, err = checkAllowlist(file.AllowNetwork, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func checkAllowlist(list map[string]string, filename string) (map[string]string, error) {
+	for name, rng := range list {
+		_, err := parseRange(rng)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap: invalid range for %s in %s: %v", name, filename, err)
+		}
+	}
+
+	return list, nil
+}
+
+func listed(list map[string]string, name string, version string) bool {
+	rng, ok := list[name]
+	if !ok {
+		return false
+	}
+
+	// without a range, any version (or none, or a prerelease) will do
+	if strings.TrimSpace(rng) == "" {
+		return true
+	}
+
+	matches, err := satisfies(version, rng)
+	return err == nil && matches
+}
+
+// Allows reports whether the package name@version may run its scripts
+func (p *ScriptPolicy) Allows(name string, version string) bool {
+	if p == nil {
+		return true
+	}
+	if p.IgnoreAll {
+		return false
+	}
+	if p.Allowed == nil {
+		return true
+	}
+
+	return listed(p.Allowed, name, version)
+}
+
+// AllowsNetwork reports whether the sandboxed scripts of name@version may
+// access the network
+func (p *ScriptPolicy) AllowsNetwork(name string, version string) bool {
+	if p == nil || !p.Sandbox {
+		return true
+	}
+
+	return listed(p.AllowNetwork, name, version)
+}
+
+func (p *ScriptPolicy) skip(s SkippedScript) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.skipped = append(p.skipped, s)
+}
+
+// Skipped lists the packages whose scripts were skipped, in the order they
+// were skipped
+func (p *ScriptPolicy) Skipped() []SkippedScript {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.skipped
+}
@@ -0,0 +1,33 @@
+package npm
+
+import "testing"
+
+func TestListed(t *testing.T) {
+	list := map[string]string{
+		"esbuild":   "",
+		"node-sass": "^4.0.0",
+		"sharp":     " ",
+	}
+
+	tests := []struct {
+		name    string
+		version string
+		want    bool
+	}{
+		{"esbuild", "0.19.2", true},
+		{"esbuild", "1.0.0-beta.1", true},
+		{"esbuild", "", true},
+		{"sharp", "0.33.0-rc.2", true},
+		{"node-sass", "4.14.1", true},
+		{"node-sass", "5.0.0", false},
+		{"node-sass", "4.14.1-rc.1", false},
+		{"node-sass", "", false},
+		{"left-pad", "1.3.0", false},
+	}
+
+	for _, test := range tests {
+		if got := listed(list, test.name, test.version); got != test.want {
+			t.Errorf("listed(%s@%q) = %v, want %v", test.name, test.version, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package npm
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// scripts get their own process group, so that a timed out script can be
+// killed along with everything it spawned (node-gyp, make, compilers...)
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,20 @@
+package npm
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// windows has no process groups to signal, so kill the script's whole
+// process tree with taskkill (/T), falling back to just the script
+func killProcessGroup(cmd *exec.Cmd) error {
+	err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+	if err != nil {
+		return cmd.Process.Kill()
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package npm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registries decides where tarballs are downloaded from, and how
+var Registries = &RegistryConfig{}
+
+// RegistryConfig rewrites the tarball URLs in lockfiles to point at mirrors,
+// lists registries to fall back to when a download fails, and sets up the
+// HTTP connections to each host
+type RegistryConfig struct {
+	Rewrite  []RewriteRule
+	Fallback []string
+	Hosts    map[string]HostConfig
+
+	mu      sync.Mutex
+	clients map[string]*http.Client
+}
+
+// RewriteRule replaces the start of a tarball URL. From is a URL prefix, or,
+// without a scheme, a host (optionally followed by a path) on http or https.
+type RewriteRule struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// HostConfig sets up the connections to a host
+type HostConfig struct {
+	// KeepAlive reuses connections between requests (the default); some
+	// servers mishandle that
+	KeepAlive bool
+
+	// MaxConnections limits the connections open at once, if set
+	MaxConnections int
+
+	// Timeout limits the wait for a response (a minute, if not set)
+	Timeout time.Duration
+
+	// Headers are added to every request, e.g. for authentication
+	Headers map[string]string
+}
+
+type registryConfigFile struct {
+	Rewrite  []RewriteRule `json:"rewrite"`
+	Fallback []string      `json:"fallback"`
+	Hosts    map[string]struct {
+		KeepAlive      *bool             `json:"keepAlive"`
+		MaxConnections int               `json:"maxConnections"`
+		Timeout        string            `json:"timeout"`
+		Headers        map[string]string `json:"headers"`
+	} `json:"hosts"`
+}
+
+// LoadRegistryConfig reads a registry configuration of the form
+//
+//	{
+//	  "rewrite": [
+//	    { "from": "registry.npmjs.org", "to": "https://artifactory.example.com/api/npm/npm" }
+//	  ],
+//	  "fallback": ["https://registry.npmjs.org"],
+//	  "hosts": {
+//	    "artifactory.example.com": { "keepAlive": false, "maxConnections": 8, "timeout": "30s" }
+//	  }
+//	}
+//
+// where the first matching rewrite rule applies, and the registries in
+// fallback are tried in turn when the (rewritten) URL fails.
+func LoadRegistryConfig(filename string) (config *RegistryConfig, err error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	var file registryConfigFile
+	err = json.Unmarshal(contents, &file)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap: cannot parse %s: %v", filename, err)
+	}
+
+	config = &RegistryConfig{Rewrite: file.Rewrite, Hosts: make(map[string]HostConfig)}
+	for _, rule := range file.Rewrite {
+		if rule.From == "" || rule.To == "" {
+			return nil, fmt.Errorf("unwrap: %s: rewrite rules need a from and a to", filename)
+		}
+	}
+
+	for _, registry := range file.Fallback {
+		config.Fallback = append(config.Fallback, strings.TrimSuffix(registry, "/"))
+	}
+
+	for host, settings := range file.Hosts {
+		hostConfig := HostConfig{KeepAlive: true, MaxConnections: settings.MaxConnections, Headers: settings.Headers}
+		if settings.KeepAlive != nil {
+			hostConfig.KeepAlive = *settings.KeepAlive
+		}
+		if settings.Timeout != "" {
+			hostConfig.Timeout, err = time.ParseDuration(settings.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("unwrap: %s: bad timeout for %s: %v", filename, host, err)
+			}
+		}
+		config.Hosts[host] = hostConfig
+	}
+
+	return
+}
+
+// matchPrefix returns the rest of rawurl after prefix, if it starts with it
+func matchPrefix(rawurl string, prefix string) (rest string, ok bool) {
+	if !strings.Contains(prefix, "://") {
+		// a host, on either scheme
+		scheme := strings.Index(rawurl, "://")
+		if scheme < 0 {
+			return "", false
+		}
+		rawurl = rawurl[scheme+3:]
+	}
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	if !strings.HasPrefix(rawurl, prefix) {
+		return "", false
+	}
+
+	// only whole host names and path segments match
+	rest = rawurl[len(prefix):]
+	if rest != "" && rest[0] != '/' && !(rest[0] == ':' && !strings.Contains(prefix, "/")) {
+		return "", false
+	}
+
+	return rest, true
+}
+
+// registryPath splits a registry tarball URL, <registry>/<name>/-/<file>,
+// into the registry and the rest
+func registryPath(tarUrl string) (registry string, rest string, ok bool) {
+	cut := strings.Index(tarUrl, "/-/")
+	if cut < 0 {
+		return "", "", false
+	}
+
+	// scoped names are @scope/name, or @scope%2fname
+	start := strings.LastIndex(tarUrl[:cut], "/")
+	if scope := strings.LastIndex(tarUrl[:start], "/"); scope >= 0 && strings.HasPrefix(tarUrl[scope+1:], "@") {
+		start = scope
+	}
+	if start <= strings.Index(tarUrl, "://")+2 {
+		return "", "", false
+	}
+
+	return tarUrl[:start], tarUrl[start:], true
+}
+
+// candidates lists the URLs to try downloading tarUrl from, in order
+func (c *RegistryConfig) candidates(tarUrl string) (urls []string) {
+	primary := tarUrl
+	for _, rule := range c.Rewrite {
+		if rest, ok := matchPrefix(tarUrl, rule.From); ok {
+			primary = strings.TrimSuffix(rule.To, "/") + rest
+			break
+		}
+	}
+	urls = append(urls, primary)
+
+	_, rest, ok := registryPath(tarUrl)
+	if !ok {
+		return
+	}
+
+	for _, registry := range c.Fallback {
+		if fallback := registry + rest; fallback != primary {
+			urls = append(urls, fallback)
+		}
+	}
+
+	return
+}
+
+// hostConfig finds the settings for a host, by name with or without its port
+func (c *RegistryConfig) hostConfig(u *url.URL) (config HostConfig, ok bool) {
+	if config, ok = c.Hosts[u.Host]; ok {
+		return
+	}
+
+	config, ok = c.Hosts[u.Hostname()]
+	return
+}
+
+// how long to wait for a connection, and then for a response, or for more of
+// one, so that a stuck host fails over to the next registry rather than
+// hanging the install
+const (
+	dialTimeout            = 30 * time.Second
+	defaultResponseTimeout = time.Minute
+)
+
+// newTransport sets up connections that give up on unresponsive hosts
+func newTransport(responseTimeout time.Duration) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.ResponseHeaderTimeout = responseTimeout
+	return transport
+}
+
+// newClient sends requests over transport, also giving up on responses
+// whose bodies stall for longer than the transport waits for headers
+func newClient(transport *http.Transport) *http.Client {
+	return &http.Client{Transport: stallTimeout{transport, transport.ResponseHeaderTimeout}}
+}
+
+// stallTimeout cancels requests once a read of their response body has
+// waited for timeout. Time spent between reads doesn't count.
+type stallTimeout struct {
+	transport http.RoundTripper
+	timeout   time.Duration
+}
+
+func (s stallTimeout) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	resp, err = s.transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return
+	}
+
+	body := &stallingBody{body: resp.Body, timeout: s.timeout, cancel: cancel}
+	body.timer = time.AfterFunc(s.timeout, body.stall)
+	body.timer.Stop()
+	resp.Body = body
+	return
+}
+
+type stallingBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled int32
+}
+
+func (b *stallingBody) stall() {
+	atomic.StoreInt32(&b.stalled, 1)
+	b.cancel()
+}
+
+func (b *stallingBody) Read(p []byte) (n int, err error) {
+	b.timer.Reset(b.timeout)
+	n, err = b.body.Read(p)
+	b.timer.Stop()
+
+	if err != nil && atomic.LoadInt32(&b.stalled) == 1 {
+		return n, fmt.Errorf("no data received for %v", b.timeout)
+	}
+	return
+}
+
+func (b *stallingBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// client is the HTTP client for the host of u, set up as configured
+func (c *RegistryConfig) client(u *url.URL) *http.Client {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clients == nil {
+		c.clients = make(map[string]*http.Client)
+	}
+	if client, ok := c.clients[u.Host]; ok {
+		return client
+	}
+
+	transport := newTransport(defaultResponseTimeout)
+	if config, ok := c.hostConfig(u); ok {
+		transport.DisableKeepAlives = !config.KeepAlive
+		transport.MaxConnsPerHost = config.MaxConnections
+		if config.Timeout > 0 {
+			transport.ResponseHeaderTimeout = config.Timeout
+		}
+	}
+
+	client := newClient(transport)
+	c.clients[u.Host] = client
+	return client
+}
+
+// clientFor is the HTTP client for the host of rawurl; git remotes and LFS
+// servers share the registries' connection settings
+func (c *RegistryConfig) clientFor(rawurl string) *http.Client {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		// the request will fail on it anyway
+		u = &url.URL{}
+	}
+
+	return c.client(u)
+}
+
+// get downloads rawurl to w
+func (c *RegistryConfig) get(rawurl string, w io.Writer) (err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return
+	}
+	if config, ok := c.hostConfig(u); ok {
+		for key, value := range config.Headers {
+			req.Header.Set(key, value)
+		}
+	}
+
+	resp, err := c.client(u).Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		// the caller knows the URL
+		return urlErr.Err
+	}
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return
+}
@@ -0,0 +1,266 @@
+package npm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchPrefix(t *testing.T) {
+	tests := []struct {
+		url    string
+		prefix string
+		rest   string
+		ok     bool
+	}{
+		{"https://registry.npmjs.org/a/-/a-1.0.0.tgz", "registry.npmjs.org", "/a/-/a-1.0.0.tgz", true},
+		{"http://registry.npmjs.org/a/-/a-1.0.0.tgz", "registry.npmjs.org", "/a/-/a-1.0.0.tgz", true},
+		{"https://registry.npmjs.org:443/a/-/a-1.0.0.tgz", "registry.npmjs.org", ":443/a/-/a-1.0.0.tgz", true},
+		{"https://registry.npmjs.org.evil.com/a", "registry.npmjs.org", "", false},
+		{"https://registry.npmjs.org/a", "https://registry.npmjs.org/", "/a", true},
+		{"http://registry.npmjs.org/a", "https://registry.npmjs.org", "", false},
+		{"https://host/npm/a/-/a-1.0.0.tgz", "host/npm", "/a/-/a-1.0.0.tgz", true},
+		{"https://host/npm-private/a", "host/npm", "", false},
+		{"https://host:8080/a", "host/", ":8080/a", true},
+		{"https://host:8080/a", "host/a", "", false},
+		{"https://host", "https://host", "", true},
+		{"file:pkg.tgz", "host", "", false},
+	}
+
+	for _, test := range tests {
+		rest, ok := matchPrefix(test.url, test.prefix)
+		if rest != test.rest || ok != test.ok {
+			t.Errorf("matchPrefix(%s, %s) = %q, %v; want %q, %v", test.url, test.prefix, rest, ok, test.rest, test.ok)
+		}
+	}
+}
+
+func TestRegistryPath(t *testing.T) {
+	tests := []struct {
+		url      string
+		registry string
+		rest     string
+		ok       bool
+	}{
+		{"https://registry.npmjs.org/a/-/a-1.0.0.tgz", "https://registry.npmjs.org", "/a/-/a-1.0.0.tgz", true},
+		{"https://registry.npmjs.org/@s/p/-/p-1.0.0.tgz", "https://registry.npmjs.org", "/@s/p/-/p-1.0.0.tgz", true},
+		{"https://registry.npmjs.org/@s%2fp/-/p-1.0.0.tgz", "https://registry.npmjs.org", "/@s%2fp/-/p-1.0.0.tgz", true},
+		{"https://host/api/npm/npm/a/-/a-1.0.0.tgz", "https://host/api/npm/npm", "/a/-/a-1.0.0.tgz", true},
+		{"https://codeload.github.com/u/p/tar.gz/abc", "", "", false},
+		{"https://host/-/a-1.0.0.tgz", "", "", false},
+	}
+
+	for _, test := range tests {
+		registry, rest, ok := registryPath(test.url)
+		if registry != test.registry || rest != test.rest || ok != test.ok {
+			t.Errorf("registryPath(%s) = %q, %q, %v; want %q, %q, %v", test.url, registry, rest, ok, test.registry, test.rest, test.ok)
+		}
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	config := &RegistryConfig{
+		Rewrite: []RewriteRule{
+			{From: "registry.npmjs.org", To: "https://mirror.example.com/npm/"},
+			{From: "registry.npmjs.org", To: "https://never.example.com"},
+			{From: "https://registry.yarnpkg.com/@internal", To: "https://private.example.com/@internal"},
+		},
+		Fallback: []string{"https://mirror.example.com/npm", "https://registry.npmjs.org"},
+	}
+
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{"https://registry.npmjs.org/a/-/a-1.0.0.tgz", []string{
+			"https://mirror.example.com/npm/a/-/a-1.0.0.tgz",
+			"https://registry.npmjs.org/a/-/a-1.0.0.tgz",
+		}},
+		{"https://registry.yarnpkg.com/@internal/p/-/p-1.0.0.tgz", []string{
+			"https://private.example.com/@internal/p/-/p-1.0.0.tgz",
+			"https://mirror.example.com/npm/@internal/p/-/p-1.0.0.tgz",
+			"https://registry.npmjs.org/@internal/p/-/p-1.0.0.tgz",
+		}},
+		{"https://other.example.com/b/-/b-2.0.0.tgz", []string{
+			"https://other.example.com/b/-/b-2.0.0.tgz",
+			"https://mirror.example.com/npm/b/-/b-2.0.0.tgz",
+			"https://registry.npmjs.org/b/-/b-2.0.0.tgz",
+		}},
+		{"https://codeload.github.com/u/p/tar.gz/abc", []string{
+			"https://codeload.github.com/u/p/tar.gz/abc",
+		}},
+	}
+
+	for _, test := range tests {
+		if got := config.candidates(test.url); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("candidates(%s) = %q, want %q", test.url, got, test.want)
+		}
+	}
+
+	if got := (&RegistryConfig{}).candidates("https://registry.npmjs.org/a/-/a-1.0.0.tgz"); len(got) != 1 {
+		t.Errorf("without a configuration, got %q", got)
+	}
+}
+
+func TestLoadRegistryConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(contents string) string {
+		file := filepath.Join(dir, "registries.json")
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	config, err := LoadRegistryConfig(write(`{
+		"rewrite": [{"from": "registry.npmjs.org", "to": "https://mirror.example.com"}],
+		"fallback": ["https://registry.npmjs.org/"],
+		"hosts": {
+			"mirror.example.com": {"keepAlive": false, "maxConnections": 4, "timeout": "5s", "headers": {"Authorization": "Bearer x"}},
+			"other.example.com": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(config.Fallback, []string{"https://registry.npmjs.org"}) {
+		t.Errorf("fallback: %q", config.Fallback)
+	}
+	want := HostConfig{KeepAlive: false, MaxConnections: 4, Timeout: 5 * time.Second, Headers: map[string]string{"Authorization": "Bearer x"}}
+	if got := config.Hosts["mirror.example.com"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("mirror.example.com: got %+v", got)
+	}
+	if got := config.Hosts["other.example.com"]; !got.KeepAlive || got.Timeout != 0 {
+		t.Errorf("other.example.com: got %+v", got)
+	}
+
+	for _, bad := range []string{
+		`{"rewrite": [{"from": "registry.npmjs.org"}]}`,
+		`{"hosts": {"h": {"timeout": "soon"}}}`,
+		`{"fallback": "https://registry.npmjs.org"}`,
+	} {
+		if _, err := LoadRegistryConfig(write(bad)); err == nil {
+			t.Errorf("loaded %s", bad)
+		}
+	}
+}
+
+func TestRegistryClients(t *testing.T) {
+	config := &RegistryConfig{Hosts: map[string]HostConfig{
+		"slow.example.com":          {KeepAlive: true, Timeout: 5 * time.Minute},
+		"closing.example.com":       {KeepAlive: false, MaxConnections: 2},
+		"withport.example.com:8443": {KeepAlive: true, Timeout: time.Second},
+	}}
+
+	tests := []struct {
+		url       string
+		timeout   time.Duration
+		keepAlive bool
+		maxConns  int
+	}{
+		{"https://unconfigured.example.com/a", defaultResponseTimeout, true, 0},
+		{"https://slow.example.com/a", 5 * time.Minute, true, 0},
+		{"https://closing.example.com/a", defaultResponseTimeout, false, 2},
+		{"https://withport.example.com:8443/a", time.Second, true, 0},
+		{"https://withport.example.com/a", defaultResponseTimeout, true, 0},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+		client := config.client(u)
+		stall, ok := client.Transport.(stallTimeout)
+		if !ok {
+			t.Errorf("%s: no stall timeout", test.url)
+			continue
+		}
+		transport, ok := stall.transport.(*http.Transport)
+		if !ok {
+			t.Errorf("%s: no transport of its own", test.url)
+			continue
+		}
+		if stall.timeout != test.timeout {
+			t.Errorf("%s: got stall timeout %s, want %s", test.url, stall.timeout, test.timeout)
+		}
+		if transport.ResponseHeaderTimeout != test.timeout || transport.DisableKeepAlives == test.keepAlive || transport.MaxConnsPerHost != test.maxConns {
+			t.Errorf("%s: got timeout %s, keep-alive %v, %d connections", test.url, transport.ResponseHeaderTimeout, !transport.DisableKeepAlives, transport.MaxConnsPerHost)
+		}
+		if config.client(u) != client {
+			t.Errorf("%s: clients aren't reused", test.url)
+		}
+	}
+
+	if config.clientFor("https://slow.example.com/repo.git") != config.client(&url.URL{Host: "slow.example.com"}) {
+		t.Error("clientFor doesn't share the registry clients")
+	}
+}
+
+func TestRegistryGet(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(r.Header.Get("Authorization")))
+		case "/slow":
+			<-hang
+		case "/stall":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-hang
+		case "/trickle":
+			// slower than the timeout overall, but never quiet for that long
+			for i := 0; i < 30; i++ {
+				w.Write([]byte("."))
+				w.(http.Flusher).Flush()
+				time.Sleep(10 * time.Millisecond)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	// let the slow handler return before the server waits for it
+	defer close(hang)
+
+	u, _ := url.Parse(server.URL)
+	config := &RegistryConfig{Hosts: map[string]HostConfig{
+		u.Host: {KeepAlive: true, Timeout: 100 * time.Millisecond, Headers: map[string]string{"Authorization": "Bearer x"}},
+	}}
+
+	var out bytes.Buffer
+	if err := config.get(server.URL+"/ok", &out); err != nil || out.String() != "Bearer x" {
+		t.Errorf("got %q, %v", out.String(), err)
+	}
+
+	if err := config.get(server.URL+"/missing", &out); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v for a missing tarball", err)
+	}
+
+	start := time.Now()
+	err := config.get(server.URL+"/slow", &out)
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("got %v after %s from a server that doesn't respond", err, time.Since(start))
+	}
+	if err != nil && strings.Contains(err.Error(), server.URL) {
+		t.Errorf("the error repeats the URL: %v", err)
+	}
+
+	out.Reset()
+	start = time.Now()
+	err = config.get(server.URL+"/stall", &out)
+	if err == nil || !strings.Contains(err.Error(), "no data received") || time.Since(start) > 5*time.Second {
+		t.Errorf("got %v after %s from a server that stops sending", err, time.Since(start))
+	}
+
+	out.Reset()
+	if err = config.get(server.URL+"/trickle", &out); err != nil || out.Len() != 30 {
+		t.Errorf("got %d bytes, %v from a slow server", out.Len(), err)
+	}
+}
@@ -0,0 +1,187 @@
+package npm
+
+// a remote cache is an HTTP server shared by a team's installs, checked
+// before the registry whenever a tarball isn't in the local cache. Tarballs
+// are stored by content hash, from the lockfile's integrity field, at
+// <url>/<algorithm>/<hex digest>, with a plain GET and PUT, like a build
+// cache. Tarballs the lockfile has no integrity for aren't cached remotely:
+// anyone who can write to the cache could swap them for something else.
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RemoteCache is the remote cache to use, if any
+var RemoteCache *HTTPCache
+
+// HTTPCache is a remote cache of tarballs. Credentials for it can be given
+// in its URL.
+type HTTPCache struct {
+	Url string
+
+	// ReadOnly stops tarballs downloaded from the registry being uploaded
+	ReadOnly bool
+
+	Client *http.Client
+}
+
+// the remote cache is only worth waiting for briefly; the registry has
+// everything too
+const remoteCacheTimeout = 10 * time.Second
+
+// NewHTTPCache sets up the remote cache at url
+func NewHTTPCache(url string, readOnly bool) *HTTPCache {
+	client := newClient(newTransport(remoteCacheTimeout))
+	return &HTTPCache{Url: strings.TrimSuffix(url, "/"), ReadOnly: readOnly, Client: client}
+}
+
+// the algorithms integrity fields use, strongest first
+var integrityAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+}
+
+// parseIntegrity picks the strongest hash of an integrity field (a list of
+// algorithm-base64 digests) that it knows
+func parseIntegrity(sri string) (algorithm string, digest []byte, newHash func() hash.Hash, ok bool) {
+	hashes := make(map[string][]byte)
+	for _, field := range strings.Fields(sri) {
+		dash := strings.IndexByte(field, '-')
+		if dash < 0 {
+			continue
+		}
+
+		// options follow a ?
+		value := field[dash+1:]
+		if q := strings.IndexByte(value, '?'); q >= 0 {
+			value = value[:q]
+		}
+		if sum, err := base64.StdEncoding.DecodeString(value); err == nil {
+			hashes[field[:dash]] = sum
+		}
+	}
+
+	for _, alg := range integrityAlgorithms {
+		if sum, found := hashes[alg.name]; found {
+			return alg.name, sum, alg.new, true
+		}
+	}
+
+	return
+}
+
+// integrityChecker hashes what's written to it, to compare with an
+// integrity field; it accepts anything when there's none
+type integrityChecker struct {
+	hash.Hash
+	algorithm string
+	digest    []byte
+}
+
+func newIntegrityChecker(sri string) *integrityChecker {
+	algorithm, digest, newHash, ok := parseIntegrity(sri)
+	if !ok {
+		return &integrityChecker{Hash: sha1.New()}
+	}
+
+	return &integrityChecker{Hash: newHash(), algorithm: algorithm, digest: digest}
+}
+
+func (c *integrityChecker) check() error {
+	if c.algorithm == "" {
+		return nil
+	}
+
+	sum := c.Sum(nil)
+	if string(sum) != string(c.digest) {
+		return fmt.Errorf("integrity check failed: got %s-%s, but the lockfile has %s-%s", c.algorithm,
+			base64.StdEncoding.EncodeToString(sum), c.algorithm, base64.StdEncoding.EncodeToString(c.digest))
+	}
+
+	return nil
+}
+
+// caches reports whether tarballs with the integrity field sri are kept in
+// the remote cache, which is only when they can be checked
+func (c *HTTPCache) caches(sri string) bool {
+	_, _, _, ok := parseIntegrity(sri)
+	return ok
+}
+
+// key is where the tarball with the integrity field sri is kept in the
+// remote cache
+func (c *HTTPCache) key(sri string) string {
+	algorithm, digest, _, _ := parseIntegrity(sri)
+	return algorithm + "/" + hex.EncodeToString(digest)
+}
+
+// get copies the tarball with the integrity field sri from the remote cache
+// to w, if it's there
+func (c *HTTPCache) get(sri string, w io.Writer) (found bool, err error) {
+	resp, err := c.Client.Get(c.Url + "/" + c.key(sri))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("GET %s: %s", c.key(sri), resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err == nil, err
+}
+
+// put uploads the tarball with the integrity field sri, downloaded to file,
+// to the remote cache
+func (c *HTTPCache) put(sri string, file string) (err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("PUT", c.Url+"/"+c.key(sri), f)
+	if err != nil {
+		return
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s: %s", c.key(sri), resp.Status)
+	}
+
+	return
+}
@@ -0,0 +1,218 @@
+package npm
+
+import (
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseIntegrity(t *testing.T) {
+	sha1sum := sha1.Sum([]byte("x"))
+	sha512sum := sha512.Sum512([]byte("x"))
+	sri1 := "sha1-" + base64.StdEncoding.EncodeToString(sha1sum[:])
+	sri512 := "sha512-" + base64.StdEncoding.EncodeToString(sha512sum[:])
+
+	tests := []struct {
+		sri       string
+		algorithm string
+		digest    []byte
+	}{
+		{sri512, "sha512", sha512sum[:]},
+		{sri1, "sha1", sha1sum[:]},
+		{sri1 + " " + sri512, "sha512", sha512sum[:]},
+		{sri512 + "?opt=1 " + sri1, "sha512", sha512sum[:]},
+		{"md5-AAAA " + sri1, "sha1", sha1sum[:]},
+		{"sha512-!!! " + sri1, "sha1", sha1sum[:]},
+		{"", "", nil},
+		{"nonsense", "", nil},
+	}
+
+	for _, test := range tests {
+		algorithm, digest, _, ok := parseIntegrity(test.sri)
+		if ok != (test.algorithm != "") || algorithm != test.algorithm || string(digest) != string(test.digest) {
+			t.Errorf("parseIntegrity(%q) = %s, %x, %v", test.sri, algorithm, digest, ok)
+		}
+	}
+}
+
+func TestIntegrityChecker(t *testing.T) {
+	sum := sha512.Sum512([]byte("tarball"))
+	sri := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	checker := newIntegrityChecker(sri)
+	checker.Write([]byte("tarball"))
+	if err := checker.check(); err != nil {
+		t.Error(err)
+	}
+
+	checker = newIntegrityChecker(sri)
+	checker.Write([]byte("something else"))
+	if err := checker.check(); err == nil || !strings.Contains(err.Error(), "but the lockfile has "+sri) {
+		t.Errorf("got %v for a mismatch", err)
+	}
+
+	checker = newIntegrityChecker("")
+	checker.Write([]byte("anything"))
+	if err := checker.check(); err != nil {
+		t.Errorf("got %v without an integrity field", err)
+	}
+}
+
+// a remote cache that keeps what's PUT to it in memory
+type testCacheServer struct {
+	mu       sync.Mutex
+	blobs    map[string][]byte
+	requests []string
+	status   int // replaces every response, if set
+}
+
+func (s *testCacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		blob, ok := s.blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(blob)
+	case "PUT":
+		blob, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.blobs[r.URL.Path] = blob
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *testCacheServer) takeRequests() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := strings.Join(s.requests, ", ")
+	s.requests = nil
+	return requests
+}
+
+func TestRemoteCache(t *testing.T) {
+	tarball := []byte("pretend this is a gzipped tarball")
+	sum := sha512.Sum512(tarball)
+	sri := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+	key := "/npm/sha512/" + hex.EncodeToString(sum[:])
+
+	var registryHits int
+	var registryMu sync.Mutex
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		registryHits++
+		registryMu.Unlock()
+		w.Write(tarball)
+	}))
+	defer registry.Close()
+
+	cache := &testCacheServer{blobs: make(map[string][]byte)}
+	cacheServer := httptest.NewServer(cache)
+	defer cacheServer.Close()
+
+	defer func(remote *HTTPCache, registries *RegistryConfig) {
+		RemoteCache, Registries = remote, registries
+	}(RemoteCache, Registries)
+	Registries = &RegistryConfig{}
+
+	tarUrl := registry.URL + "/pkg/-/pkg-1.0.0.tgz"
+
+	tests := []struct {
+		name     string
+		sri      string
+		readOnly bool
+		status   int
+		blob     string // what the cache has for the tarball, if anything
+		requests string
+		registry bool // whether the registry is downloaded from
+	}{
+		{name: "miss", sri: sri, requests: "GET " + key + ", PUT " + key, registry: true},
+		{name: "hit", sri: sri, blob: string(tarball), requests: "GET " + key},
+		{name: "corrupt", sri: sri, blob: "tampered", requests: "GET " + key + ", PUT " + key, registry: true},
+		{name: "read-only miss", sri: sri, readOnly: true, requests: "GET " + key, registry: true},
+		{name: "server error", sri: sri, status: http.StatusInternalServerError, requests: "GET " + key + ", PUT " + key, registry: true},
+		{name: "no integrity", sri: "", requests: "", registry: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache.blobs = make(map[string][]byte)
+			if test.blob != "" {
+				cache.blobs[key] = []byte(test.blob)
+			}
+			cache.status = test.status
+			registryHits = 0
+			RemoteCache = NewHTTPCache(cacheServer.URL+"/npm/", test.readOnly)
+
+			tmpdir := t.TempDir()
+			err := downloadUrl(tmpdir, tarUrl, test.sri)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(filepath.Join(tmpdir, "pkg-1.0.0.tgz"))
+			if err != nil || string(got) != string(tarball) {
+				t.Errorf("cached tarball: %q, %v", got, err)
+			}
+			if requests := cache.takeRequests(); requests != test.requests {
+				t.Errorf("remote cache requests: got %q, want %q", requests, test.requests)
+			}
+			if (registryHits > 0) != test.registry {
+				t.Errorf("registry downloads: %d", registryHits)
+			}
+			if test.status == 0 && !test.readOnly && test.sri != "" && string(cache.blobs[key]) != string(tarball) {
+				t.Errorf("remote cache has %q", cache.blobs[key])
+			}
+		})
+	}
+}
+
+func TestRemoteCacheIntegrityFailure(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not what the lockfile says"))
+	}))
+	defer registry.Close()
+
+	cache := &testCacheServer{blobs: make(map[string][]byte)}
+	cacheServer := httptest.NewServer(cache)
+	defer cacheServer.Close()
+
+	defer func(remote *HTTPCache, registries *RegistryConfig) {
+		RemoteCache, Registries = remote, registries
+	}(RemoteCache, Registries)
+	Registries = &RegistryConfig{}
+	RemoteCache = NewHTTPCache(cacheServer.URL, false)
+
+	sum := sha512.Sum512([]byte("the real tarball"))
+	err := downloadUrl(t.TempDir(), registry.URL+"/pkg/-/pkg-1.0.0.tgz", "sha512-"+base64.StdEncoding.EncodeToString(sum[:]))
+	if err == nil || !strings.Contains(err.Error(), "integrity check failed") {
+		t.Errorf("got %v for a tarball that doesn't match", err)
+	}
+	if len(cache.blobs) > 0 {
+		t.Error("a tarball that failed its integrity check was uploaded")
+	}
+}
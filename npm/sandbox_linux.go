@@ -0,0 +1,292 @@
+package npm
+
+// lifecycle scripts can optionally run in a sandbox built from Linux
+// namespaces: a user namespace (so no privileges are needed), a mount
+// namespace where every filesystem is read-only apart from the package's own
+// directory and a private temp dir, and an empty network namespace.
+//
+// Mounts have to be rearranged from inside the new namespaces, so the script
+// is started through this binary: `npm-unwrap __sandbox -w DIR... -- CMD...`
+// remounts the filesystem and then execs CMD. The helper runs as root in the
+// user namespace, which it needs to mount, but gives up every capability
+// before the exec, so that the script can't undo the mounts.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// SandboxCommand is the hidden command used to start a sandboxed script;
+// main hands it to RunSandboxed before parsing any flags
+const SandboxCommand = "__sandbox"
+
+// statfs flags that must be kept when remounting, as the kernel refuses to
+// drop them inside a user namespace
+var lockedMountFlags = map[int64]uintptr{
+	0x2:    syscall.MS_NOSUID,
+	0x4:    syscall.MS_NODEV,
+	0x8:    syscall.MS_NOEXEC,
+	0x400:  syscall.MS_NOATIME,
+	0x800:  syscall.MS_NODIRATIME,
+	0x1000: syscall.MS_RELATIME,
+}
+
+// sandboxCommand rewrites cmd to run inside the sandbox, with write access
+// limited to the writable directories
+func sandboxCommand(cmd *exec.Cmd, writable []string, allowNetwork bool) (err error) {
+	self, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	args := []string{"npm-unwrap", SandboxCommand}
+	for _, dir := range writable {
+		args = append(args, "-w", dir)
+	}
+	args = append(args, "--", cmd.Path)
+	args = append(args, cmd.Args[1:]...)
+
+	cmd.Path = self
+	cmd.Args = args
+
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS)
+	if !allowNetwork {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags = flags
+	// root in the namespace, to be allowed to mount, whoever runs us
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+
+	return
+}
+
+// RunSandboxed implements SandboxCommand: it makes every mount except the
+// writable directories read-only, then replaces itself with the script.
+// It only returns if something went wrong.
+func RunSandboxed(args []string) (err error) {
+	var writable []string
+	for len(args) > 0 && args[0] != "--" {
+		if args[0] != "-w" || len(args) < 2 {
+			return errors.New("sandbox: usage: " + SandboxCommand + " [-w dir]... -- command [args...]")
+		}
+		writable = append(writable, filepath.Clean(args[1]))
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		return errors.New("sandbox: no command given")
+	}
+	command := args[1:]
+
+	// capabilities belong to threads, so the one that drops them has to be
+	// the one that execs the script
+	runtime.LockOSThread()
+
+	// keep our changes out of the parent namespace
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("sandbox: cannot make mounts private: %v", err)
+	}
+
+	// bind the writable directories over themselves first, so they are
+	// separate mounts that survive the read-only remount below
+	for _, dir := range writable {
+		err = syscall.Mount(dir, dir, "", syscall.MS_BIND|syscall.MS_REC, "")
+		if err != nil {
+			return fmt.Errorf("sandbox: cannot bind %s: %v", dir, err)
+		}
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return
+	}
+
+	for _, mnt := range mounts {
+		if isWritable(mnt, writable) {
+			continue
+		}
+
+		err = remountReadOnly(mnt)
+		if err != nil && !isPseudoFilesystem(mnt) {
+			return fmt.Errorf("sandbox: cannot make %s read-only: %v", mnt, err)
+		}
+	}
+
+	err = dropCapabilities()
+	if err != nil {
+		return
+	}
+
+	return syscall.Exec(command[0], command, os.Environ())
+}
+
+// see linux/prctl.h, linux/securebits.h and linux/capability.h
+const (
+	prCapbsetDrop        = 24
+	prSetSecurebits      = 28
+	prSetNoNewPrivs      = 38
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+
+	secbitNoroot              = 1 << 0
+	secbitNorootLocked        = 1 << 1
+	secbitNoSetuidFixup       = 1 << 2
+	secbitNoSetuidFixupLocked = 1 << 3
+	secbitKeepCapsLocked      = 1 << 5
+
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+func prctl(option uintptr, arg uintptr) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg, 0, 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// dropCapabilities leaves this thread, and whatever it execs, without any
+// capabilities: being root in the user namespace then gets the script
+// nothing more than owning the caller's files
+func dropCapabilities() (err error) {
+	// root doesn't get capabilities back by execing, or from setuid binaries
+	err = prctl(prSetSecurebits, secbitNoroot|secbitNorootLocked|secbitNoSetuidFixup|secbitNoSetuidFixupLocked|secbitKeepCapsLocked)
+	if err != nil {
+		return fmt.Errorf("sandbox: cannot set securebits: %v", err)
+	}
+
+	err = prctl(prSetNoNewPrivs, 1)
+	if err != nil {
+		return fmt.Errorf("sandbox: cannot set no_new_privs: %v", err)
+	}
+
+	lastCap := 63
+	if content, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		lastCap, _ = strconv.Atoi(strings.TrimSpace(string(content)))
+	}
+	for c := 0; c <= lastCap; c++ {
+		err = prctl(prCapbsetDrop, uintptr(c))
+		if err == syscall.EINVAL {
+			// past the last capability this kernel knows
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("sandbox: cannot drop capability %d: %v", c, err)
+		}
+	}
+
+	// older kernels have no ambient capabilities
+	err = prctl(prCapAmbient, prCapAmbientClearAll)
+	if err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("sandbox: cannot clear ambient capabilities: %v", err)
+	}
+
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+	_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("sandbox: cannot clear capabilities: %v", errno)
+	}
+
+	return nil
+}
+
+func remountReadOnly(mnt string) (err error) {
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(mnt, &stat)
+	if err != nil {
+		return
+	}
+
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	for statFlag, mountFlag := range lockedMountFlags {
+		if stat.Flags&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+
+	return syscall.Mount("", mnt, "", flags, "")
+}
+
+// /proc and /sys cannot always be remounted from a user namespace, and are
+// not writable by an unprivileged user anyway
+func isPseudoFilesystem(mnt string) bool {
+	for _, prefix := range []string{"/proc", "/sys"} {
+		if mnt == prefix || strings.HasPrefix(mnt, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isWritable(mnt string, writable []string) bool {
+	for _, dir := range writable {
+		if mnt == dir || strings.HasPrefix(mnt, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mountPoints lists every mount visible to this process, parents first
+func mountPoints() (mounts []string, err error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+
+	return mounts, scanner.Err()
+}
+
+// mountinfo escapes spaces, tabs, newlines and backslashes as \ooo
+func unescapeMountPath(path string) string {
+	var out strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(path[i])
+	}
+
+	return out.String()
+}
@@ -0,0 +1,85 @@
+package npm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sandboxed commands are started through the test binary, like they are
+// through npm-unwrap
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxCommand {
+		err := RunSandboxed(os.Args[2:])
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(127)
+	}
+
+	os.Exit(m.Run())
+}
+
+func runSandboxed(t *testing.T, writable string, script string) (output string, err error) {
+	cmd := exec.Command("/bin/sh", "-c", script)
+	err = sandboxCommand(cmd, []string{writable}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	return out.String(), err
+}
+
+func TestSandboxConfinesScripts(t *testing.T) {
+	dir := t.TempDir()
+	pkg := filepath.Join(dir, "pkg")
+	outside := filepath.Join(dir, "outside")
+	for _, d := range []string{pkg, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if output, err := runSandboxed(t, pkg, "true"); err != nil {
+		t.Skipf("no sandbox here: %v: %s", err, output)
+	}
+
+	tests := []struct {
+		name   string
+		script string
+		ok     bool
+	}{
+		{"write inside", "echo ok > " + pkg + "/file", true},
+		{"write outside", "echo bad > " + outside + "/file", false},
+		{"remount root", "mount -o remount,bind,rw / && echo bad > " + outside + "/remounted", false},
+		{"remount outside", "mount -o remount,bind,rw " + dir + " && echo bad > " + outside + "/remounted", false},
+		{"no capabilities", "grep -q '^CapEff:[[:space:]]*0000000000000000$' /proc/self/status", true},
+		{"no bounding set", "grep -q '^CapBnd:[[:space:]]*0000000000000000$' /proc/self/status", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := runSandboxed(t, pkg, test.script)
+			if test.ok && err != nil {
+				t.Errorf("%s failed: %v: %s", test.script, err, output)
+			}
+			if !test.ok && err == nil {
+				t.Errorf("%s succeeded in the sandbox", test.script)
+			}
+		})
+	}
+
+	names, err := readDirNames(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) > 0 {
+		t.Errorf("scripts wrote %s outside of their directory", strings.Join(names, ", "))
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package npm
+
+import (
+	"errors"
+	"os/exec"
+)
+
+const SandboxCommand = "__sandbox"
+
+var errNoSandbox = errors.New("sandbox: sandboxed scripts are only supported on Linux")
+
+func sandboxCommand(cmd *exec.Cmd, writable []string, allowNetwork bool) error {
+	return errNoSandbox
+}
+
+func RunSandboxed(args []string) error {
+	return errNoSandbox
+}
@@ -0,0 +1,372 @@
+package npm
+
+// a small subset of node-semver, enough to match package versions against the
+// ranges found in package.json files and policy files
+// see https://github.com/npm/node-semver#ranges
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type semver struct {
+	major int
+	minor int
+	patch int
+	pre   []string
+}
+
+type comparator struct {
+	op string
+	v  semver
+}
+
+// a range is a union of comparator sets; a set matches when all of its
+// comparators do
+type semverRange [][]comparator
+
+var (
+	versionRe    = regexp.MustCompile(`^[v=\s]*(\d+)\.(\d+)\.(\d+)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+	partialRe    = regexp.MustCompile(`^[v=\s]*([0-9]+|[xX*])?(?:\.([0-9]+|[xX*]))?(?:\.([0-9]+|[xX*]))?(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+	operatorRe   = regexp.MustCompile(`(<=|>=|<|>|=|~>|~|\^)\s+`)
+	comparatorRe = regexp.MustCompile(`^(<=|>=|<|>|=|~>|~|\^)?(.*)$`)
+)
+
+func parseVersion(str string) (v semver, err error) {
+	groups := versionRe.FindStringSubmatch(strings.TrimSpace(str))
+	if groups == nil {
+		return v, fmt.Errorf("semver: invalid version %q", str)
+	}
+
+	v.major, _ = strconv.Atoi(groups[1])
+	v.minor, _ = strconv.Atoi(groups[2])
+	v.patch, _ = strconv.Atoi(groups[3])
+	if groups[4] != "" {
+		v.pre = strings.Split(groups[4], ".")
+	}
+
+	return
+}
+
+func (v semver) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if len(v.pre) > 0 {
+		s += "-" + strings.Join(v.pre, ".")
+	}
+	return s
+}
+
+func compareInts(a int, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func comparePre(a []string, b []string) int {
+	// a version without a prerelease has higher precedence
+	if len(a) == 0 && len(b) == 0 {
+		return 0
+	} else if len(a) == 0 {
+		return 1
+	} else if len(b) == 0 {
+		return -1
+	}
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		an, aErr := strconv.Atoi(a[i])
+		bn, bErr := strconv.Atoi(b[i])
+
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := compareInts(an, bn); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return compareInts(len(a), len(b))
+}
+
+func (v semver) compare(other semver) int {
+	if c := compareInts(v.major, other.major); c != 0 {
+		return c
+	}
+	if c := compareInts(v.minor, other.minor); c != 0 {
+		return c
+	}
+	if c := compareInts(v.patch, other.patch); c != 0 {
+		return c
+	}
+	return comparePre(v.pre, other.pre)
+}
+
+func (c comparator) matches(v semver) bool {
+	cmp := v.compare(c.v)
+
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	default:
+		return cmp == 0
+	}
+}
+
+// partial versions ("1", "1.2", "1.x") are parsed with -1 standing in for
+// missing or wildcard components
+func parsePartial(str string) (parts [3]int, pre []string, err error) {
+	groups := partialRe.FindStringSubmatch(strings.TrimSpace(str))
+	if groups == nil {
+		return parts, pre, fmt.Errorf("semver: invalid version %q", str)
+	}
+
+	wildcard := false
+	for i := 0; i < 3; i++ {
+		g := groups[i+1]
+		if wildcard || g == "" || g == "x" || g == "X" || g == "*" {
+			wildcard = true
+			parts[i] = -1
+			continue
+		}
+		parts[i], _ = strconv.Atoi(g)
+	}
+
+	if groups[4] != "" && !wildcard {
+		pre = strings.Split(groups[4], ".")
+	}
+
+	return
+}
+
+// the smallest release sharing the given prefix, e.g. 1.3 -> 1.3.0
+func lowerBound(parts [3]int) semver {
+	return semver{major: maxInt(parts[0], 0), minor: maxInt(parts[1], 0), patch: maxInt(parts[2], 0)}
+}
+
+// the first version past the given prefix, e.g. 1.3 -> 1.4.0-0
+func nextPrefix(parts [3]int) semver {
+	switch {
+	case parts[1] < 0:
+		return semver{major: parts[0] + 1, pre: []string{"0"}}
+	case parts[2] < 0:
+		return semver{major: parts[0], minor: parts[1] + 1, pre: []string{"0"}}
+	default:
+		return semver{major: parts[0], minor: parts[1], patch: parts[2] + 1, pre: []string{"0"}}
+	}
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+var anyVersion = comparator{op: ">=", v: semver{}}
+var noVersion = comparator{op: "<", v: semver{pre: []string{"0"}}}
+
+func desugar(op string, str string) (comparators []comparator, err error) {
+	parts, pre, err := parsePartial(str)
+	if err != nil {
+		return
+	}
+
+	full := semver{major: parts[0], minor: parts[1], patch: parts[2], pre: pre}
+	isFull := parts[2] >= 0
+
+	if parts[0] < 0 {
+		// "*", "x", ">=*" etc.
+		if op == "<" || op == ">" {
+			return []comparator{noVersion}, nil
+		}
+		return []comparator{anyVersion}, nil
+	}
+
+	switch op {
+	case "", "=":
+		if isFull {
+			return []comparator{{"=", full}}, nil
+		}
+		return []comparator{{">=", lowerBound(parts)}, {"<", nextPrefix(parts)}}, nil
+	case "~", "~>":
+		lower := lowerBound(parts)
+		if isFull {
+			lower = full
+		}
+		upper := nextPrefix([3]int{parts[0], parts[1], -1})
+		if parts[1] < 0 {
+			upper = nextPrefix([3]int{parts[0], -1, -1})
+		}
+		return []comparator{{">=", lower}, {"<", upper}}, nil
+	case "^":
+		lower := lowerBound(parts)
+		if isFull {
+			lower = full
+		}
+		var upper semver
+		switch {
+		case parts[0] > 0 || parts[1] < 0:
+			upper = nextPrefix([3]int{parts[0], -1, -1})
+		case parts[1] > 0 || parts[2] < 0:
+			upper = nextPrefix([3]int{parts[0], parts[1], -1})
+		default:
+			upper = nextPrefix(parts)
+		}
+		return []comparator{{">=", lower}, {"<", upper}}, nil
+	case ">":
+		if isFull {
+			return []comparator{{">", full}}, nil
+		}
+		return []comparator{{">=", nextPrefix(parts)}}, nil
+	case ">=":
+		if isFull {
+			return []comparator{{">=", full}}, nil
+		}
+		return []comparator{{">=", lowerBound(parts)}}, nil
+	case "<":
+		if isFull {
+			return []comparator{{"<", full}}, nil
+		}
+		lower := lowerBound(parts)
+		lower.pre = []string{"0"}
+		return []comparator{{"<", lower}}, nil
+	case "<=":
+		if isFull {
+			return []comparator{{"<=", full}}, nil
+		}
+		return []comparator{{"<", nextPrefix(parts)}}, nil
+	}
+
+	return nil, fmt.Errorf("semver: unknown operator %q", op)
+}
+
+func parseComparatorSet(str string) (set []comparator, err error) {
+	str = strings.TrimSpace(operatorRe.ReplaceAllString(str, "$1"))
+
+	if hyphen := strings.SplitN(str, " - ", 2); len(hyphen) == 2 {
+		from, err := desugar(">=", hyphen[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := desugar("<=", hyphen[1])
+		if err != nil {
+			return nil, err
+		}
+		return append(from, to...), nil
+	}
+
+	for _, field := range strings.Fields(str) {
+		groups := comparatorRe.FindStringSubmatch(field)
+		comparators, err := desugar(groups[1], groups[2])
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, comparators...)
+	}
+
+	if len(set) == 0 {
+		set = []comparator{anyVersion}
+	}
+
+	return
+}
+
+func parseRange(str string) (r semverRange, err error) {
+	for _, alternative := range strings.Split(str, "||") {
+		set, err := parseComparatorSet(alternative)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, set)
+	}
+
+	return
+}
+
+func (r semverRange) matches(v semver) bool {
+	for _, set := range r {
+		if setMatches(set, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func setMatches(set []comparator, v semver) bool {
+	for _, c := range set {
+		if !c.matches(v) {
+			return false
+		}
+	}
+
+	if len(v.pre) == 0 {
+		return true
+	}
+
+	// prereleases only match when a comparator in the same set opts in to
+	// prereleases of the same major.minor.patch
+	for _, c := range set {
+		if len(c.v.pre) > 0 && c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+			return true
+		}
+	}
+
+	return false
+}
+
+// satisfies reports whether version falls within the npm-style range rng
+func satisfies(version string, rng string) (ok bool, err error) {
+	r, err := parseRange(rng)
+	if err != nil {
+		return
+	}
+
+	v, err := parseVersion(version)
+	if err != nil {
+		return false, errors.New("semver: cannot compare invalid version " + version)
+	}
+
+	return r.matches(v), nil
+}
+
+// maxSatisfying returns the highest of versions within rng, or "" if none is.
+// Versions that aren't valid semver are ignored.
+func maxSatisfying(versions []string, rng string) (best string, err error) {
+	r, err := parseRange(rng)
+	if err != nil {
+		return
+	}
+
+	var bestVersion semver
+	for _, version := range versions {
+		v, err := parseVersion(version)
+		if err != nil || !r.matches(v) {
+			continue
+		}
+		if best == "" || v.compare(bestVersion) > 0 {
+			best, bestVersion = version, v
+		}
+	}
+
+	return best, nil
+}
@@ -0,0 +1,137 @@
+package npm
+
+import "testing"
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		rng     string
+		version string
+		want    bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"=1.2.3", "1.2.4", false},
+		{"1.2", "1.2.9", true},
+		{"1.2", "1.3.0", false},
+		{"1.x", "1.9.9", true},
+		{"1.x", "2.0.0", false},
+		{"*", "0.0.1", true},
+		{"*", "1.0.0-beta", false},
+		{"", "3.1.4", true},
+		{"x", "3.1.4", true},
+		{"^1.2.3", "1.9.0", true},
+		{"^1.2.3", "2.0.0", false},
+		{"^1.2.3", "1.2.2", false},
+		{"^0.2.3", "0.2.9", true},
+		{"^0.2.3", "0.3.0", false},
+		{"^0.0.3", "0.0.3", true},
+		{"^0.0.3", "0.0.4", false},
+		{"^0.x", "0.9.0", true},
+		{"~1.2.3", "1.2.9", true},
+		{"~1.2.3", "1.3.0", false},
+		{"~1", "1.9.0", true},
+		{"~1", "2.0.0", false},
+		{">1.2.3", "1.2.4", true},
+		{">1.2", "1.2.9", false},
+		{">1.2", "1.3.0", true},
+		{">=1.2.3", "1.2.3", true},
+		{"<1.2.3", "1.2.2", true},
+		{"<1.2", "1.1.9", true},
+		{"<1.2", "1.2.0", false},
+		{"<=1.2", "1.2.9", true},
+		{"<=1.2", "1.3.0", false},
+		{"> 1.0.0 < 2.0.0", "1.5.0", true},
+		{">=1.0.0 <2.0.0", "2.0.0", false},
+		{"1.2.3 - 2.3.4", "2.3.4", true},
+		{"1.2.3 - 2.3.4", "2.3.5", false},
+		{"1.2 - 2.3", "2.3.9", true},
+		{"<1.0.0 || >=2.0.0", "0.5.0", true},
+		{"<1.0.0 || >=2.0.0", "1.5.0", false},
+		{"^1.0.0 || ^2.0.0", "2.1.0", true},
+
+		// prereleases only match ranges that name one of the same version
+		{"^1.0.0", "1.5.0-beta", false},
+		{"^1.0.0-beta.1", "1.0.0-beta.2", true},
+		{"^1.0.0-beta.1", "1.0.0-alpha", false},
+		{"^1.0.0-beta.1", "1.0.0", true},
+		{"^1.0.0-beta.1", "1.1.0-alpha", false},
+		{">=1.0.0-rc.1 <2.0.0", "1.0.0-rc.10", true},
+		{">=1.0.0-rc.1 <2.0.0", "1.0.0-rc.9", true},
+		{"~1.2.3-0", "1.2.3-pre", true},
+		{"1.0.0-beta", "1.0.0-beta", true},
+		{"<2.0.0", "2.0.0-rc.1", false},
+		{"1.0.0-alpha.1 || ^2.0.0-beta", "2.0.0-beta.3", true},
+		{"1.0.0-alpha.1 || ^2.0.0-beta", "1.0.0-alpha.2", false},
+	}
+
+	for _, test := range tests {
+		got, err := satisfies(test.version, test.rng)
+		if err != nil {
+			t.Errorf("satisfies(%s, %q): %v", test.version, test.rng, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("satisfies(%s, %q) = %v, want %v", test.version, test.rng, got, test.want)
+		}
+	}
+}
+
+func TestParseRangeErrors(t *testing.T) {
+	for _, rng := range []string{"1.2.3.4", "^a.b.c", ">=1.2 - 2", "latest"} {
+		if _, err := parseRange(rng); err == nil {
+			t.Errorf("parseRange(%q) succeeded", rng)
+		}
+	}
+
+	if _, err := satisfies("not-a-version", "*"); err == nil {
+		t.Error("satisfies accepted an invalid version")
+	}
+}
+
+func TestComparePrereleases(t *testing.T) {
+	// in order, per the semver spec
+	versions := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0",
+	}
+
+	for i := 0; i < len(versions)-1; i++ {
+		a, err := parseVersion(versions[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := parseVersion(versions[i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.compare(b) >= 0 || b.compare(a) <= 0 {
+			t.Errorf("%s should sort before %s", versions[i], versions[i+1])
+		}
+	}
+}
+
+func TestMaxSatisfying(t *testing.T) {
+	versions := []string{"1.0.0", "1.2.0", "1.10.0", "2.0.0-beta", "2.0.0", "v3", "2.1.0"}
+
+	tests := []struct {
+		rng  string
+		want string
+	}{
+		{"^1.0.0", "1.10.0"},
+		{"~1.2.0", "1.2.0"},
+		{"*", "2.1.0"},
+		{"<2.0.0", "1.10.0"},
+		{">=2.0.0-beta <2.0.0", "2.0.0-beta"},
+		{"^4.0.0", ""},
+	}
+
+	for _, test := range tests {
+		got, err := maxSatisfying(versions, test.rng)
+		if err != nil {
+			t.Errorf("maxSatisfying(%q): %v", test.rng, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("maxSatisfying(%q) = %q, want %q", test.rng, got, test.want)
+		}
+	}
+}
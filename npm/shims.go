@@ -0,0 +1,268 @@
+package npm
+
+// wrapper scripts for bins, as an alternative to symlinks. They call the
+// interpreter named in the script's shebang (or node, for scripts without
+// one) explicitly, so they work for scripts that are not executable on their
+// own, and survive being copied somewhere symlinks don't. The optional .cmd
+// and .ps1 shims are the same wrappers for Windows.
+// based on: https://github.com/npm/cmd-shim
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var shebangRe = regexp.MustCompile(`^#!\s*(?:/usr/bin/env\s+(?:-S\s+)?((?:[^ \t=]+=[^ \t=]+\s+)*))?([^ \t]+)(.*)$`)
+
+// mark wrappers and shims we generated, and which script they run
+const (
+	wrapperMarker = "# npm-unwrap wrapper for "
+	cmdMarker     = "@REM npm-unwrap wrapper for "
+)
+
+type interpreter struct {
+	env  string // VAR=value assignments from `#!/usr/bin/env VAR=value prog`
+	prog string
+	args string
+}
+
+// scriptInterpreter works out how to run the script at source: from its
+// shebang if it has one, otherwise from its extension. An empty prog means
+// the script is run directly.
+func scriptInterpreter(source string) (interp interpreter, err error) {
+	f, err := os.Open(source)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// a script without a trailing newline is still a script
+	firstLine, _ := bufio.NewReader(f).ReadString('\n')
+	firstLine = strings.TrimRight(firstLine, "\r\n")
+
+	if groups := shebangRe.FindStringSubmatch(firstLine); groups != nil {
+		return interpreter{
+			env:  strings.TrimSpace(groups[1]),
+			prog: groups[2],
+			args: strings.TrimSpace(groups[3]),
+		}, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(source)) {
+	case "", ".js", ".cjs", ".mjs":
+		interp.prog = "node"
+	case ".sh":
+		interp.prog = "sh"
+	}
+
+	return
+}
+
+// wrapBin is linkFile for wrappers: it writes a wrapper for source unless
+// dir/name already belongs to something replace does not allow replacing
+func wrapBin(dir string, name string, source string, replace func(target string) bool, withShims bool) (err error) {
+	wrapperPath := filepath.Join(dir, name)
+
+	info, err := os.Lstat(wrapperPath)
+	if err == nil {
+		existing := wrapperTarget(wrapperPath)
+		if info.Mode()&os.ModeSymlink != 0 {
+			existing, err = os.Readlink(wrapperPath)
+			if err != nil {
+				return
+			}
+			if !filepath.IsAbs(existing) {
+				existing = filepath.Join(dir, existing)
+			}
+		}
+
+		if existing == "" {
+			log.Printf("[WARN] %s already exists and was not written by npm-unwrap\n", wrapperPath)
+			return nil
+		}
+		if existing != source && !replace(existing) {
+			log.Printf("[WARN] %s already runs %s, not replacing it\n", wrapperPath, existing)
+			return nil
+		}
+
+		// writing through a symlink would overwrite the script itself
+		err = os.Remove(wrapperPath)
+		if err != nil {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	return writeBinWrapper(dir, name, source, withShims)
+}
+
+// writeBinWrapper writes dir/name as a shell script running source, plus
+// name.cmd and name.ps1 if withShims is set
+func writeBinWrapper(dir string, name string, source string, withShims bool) (err error) {
+	target, err := filepath.Rel(dir, source)
+	if err != nil {
+		return
+	}
+
+	interp, err := scriptInterpreter(source)
+	if os.IsNotExist(err) {
+		// generated by an install script that hasn't run yet
+		interp, err = interpreter{prog: "node"}, nil
+	}
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, name), []byte(shWrapper(target, interp)), 0755)
+	if err != nil {
+		return
+	}
+
+	if !withShims {
+		return removeShims(dir, name)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, name+".cmd"), []byte(cmdShim(target, interp)), 0755)
+	if err != nil {
+		return
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, name+".ps1"), []byte(ps1Shim(target, interp)), 0755)
+}
+
+// removeShims removes the name.cmd and name.ps1 shims left in dir by an
+// install with shims, leaving alone any we didn't write
+func removeShims(dir string, name string) (err error) {
+	for _, ext := range []string{".cmd", ".ps1"} {
+		shim := filepath.Join(dir, name+ext)
+		if wrapperTarget(shim) == "" {
+			continue
+		}
+
+		err = os.Remove(shim)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// wrapperTarget returns the absolute path of the script run by the wrapper
+// or shim at path, or "" if path is not one of ours
+func wrapperTarget(path string) string {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		for _, marker := range []string{wrapperMarker, cmdMarker} {
+			if strings.HasPrefix(line, marker) {
+				target := filepath.FromSlash(strings.Replace(strings.TrimPrefix(line, marker), "\\", "/", -1))
+				return filepath.Join(filepath.Dir(path), target)
+			}
+		}
+	}
+
+	return ""
+}
+
+func shWrapper(target string, interp interpreter) string {
+	target = filepath.ToSlash(target)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n%s%s\n", wrapperMarker, target)
+	b.WriteString("basedir=$(dirname \"$(echo \"$0\" | sed -e 's,\\\\,/,g')\")\n\n")
+	b.WriteString("case `uname` in\n    *CYGWIN*|*MINGW*|*MSYS*) basedir=`cygpath -w \"$basedir\"`;;\nesac\n\n")
+
+	if interp.prog == "" {
+		fmt.Fprintf(&b, "exec \"$basedir/%s\" \"$@\"\n", target)
+		return b.String()
+	}
+
+	env := ""
+	if interp.env != "" {
+		env = interp.env + " "
+	}
+	args := ""
+	if interp.args != "" {
+		args = interp.args + " "
+	}
+
+	fmt.Fprintf(&b, "if [ -x \"$basedir/%s\" ]; then\n", interp.prog)
+	fmt.Fprintf(&b, "  %sexec \"$basedir/%s\" %s\"$basedir/%s\" \"$@\"\n", env, interp.prog, args, target)
+	b.WriteString("else\n")
+	fmt.Fprintf(&b, "  %sexec %s %s\"$basedir/%s\" \"$@\"\n", env, interp.prog, args, target)
+	b.WriteString("fi\n")
+
+	return b.String()
+}
+
+func cmdShim(target string, interp interpreter) string {
+	target = strings.Replace(target, "/", "\\", -1)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "@ECHO off\r\n%s%s\r\n", cmdMarker, target)
+	b.WriteString("GOTO start\r\n:find_dp0\r\nSET dp0=%~dp0\r\nEXIT /b\r\n:start\r\nSETLOCAL\r\nCALL :find_dp0\r\n")
+
+	if interp.prog == "" {
+		fmt.Fprintf(&b, "\"%%dp0%%\\%s\" %%*\r\n", target)
+		return b.String()
+	}
+
+	for _, assignment := range strings.Fields(interp.env) {
+		fmt.Fprintf(&b, "SET %s\r\n", assignment)
+	}
+
+	prog := strings.Replace(interp.prog, "/", "\\", -1)
+	args := ""
+	if interp.args != "" {
+		args = interp.args + " "
+	}
+
+	fmt.Fprintf(&b, "\r\nIF EXIST \"%%dp0%%\\%s.exe\" (\r\n  SET \"_prog=%%dp0%%\\%s.exe\"\r\n) ELSE (\r\n  SET \"_prog=%s\"\r\n  SET PATHEXT=%%PATHEXT:;.JS;=;%%\r\n)\r\n\r\n", prog, prog, prog)
+	fmt.Fprintf(&b, "endLocal & goto #_undefined_# 2>NUL || title %%COMSPEC%% & \"%%_prog%%\" %s\"%%dp0%%\\%s\" %%*\r\n", args, target)
+
+	return b.String()
+}
+
+func ps1Shim(target string, interp interpreter) string {
+	target = filepath.ToSlash(target)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/usr/bin/env pwsh\n%s%s\n", wrapperMarker, target)
+	b.WriteString("$basedir=Split-Path $MyInvocation.MyCommand.Definition -Parent\n\n")
+
+	if interp.prog == "" {
+		fmt.Fprintf(&b, "& \"$basedir/%s\" $args\nexit $LASTEXITCODE\n", target)
+		return b.String()
+	}
+
+	for _, assignment := range strings.Fields(interp.env) {
+		kv := strings.SplitN(assignment, "=", 2)
+		fmt.Fprintf(&b, "$env:%s=\"%s\"\n", kv[0], kv[1])
+	}
+
+	args := ""
+	if interp.args != "" {
+		args = interp.args + " "
+	}
+
+	b.WriteString("$exe=\"\"\nif ($PSVersionTable.PSVersion -lt \"6.0\" -or $IsWindows) {\n  # Fix case when both the Windows and Linux builds of Node\n  # are installed in the same directory\n  $exe=\".exe\"\n}\n$ret=0\n")
+	fmt.Fprintf(&b, "if (Test-Path \"$basedir/%s$exe\") {\n", interp.prog)
+	fmt.Fprintf(&b, "  # Support pipeline input\n  if ($MyInvocation.ExpectingInput) {\n    $input | & \"$basedir/%s$exe\" %s\"$basedir/%s\" $args\n  } else {\n    & \"$basedir/%s$exe\" %s\"$basedir/%s\" $args\n  }\n", interp.prog, args, target, interp.prog, args, target)
+	b.WriteString("  $ret=$LASTEXITCODE\n} else {\n")
+	fmt.Fprintf(&b, "  # Support pipeline input\n  if ($MyInvocation.ExpectingInput) {\n    $input | & \"%s$exe\" %s\"$basedir/%s\" $args\n  } else {\n    & \"%s$exe\" %s\"$basedir/%s\" $args\n  }\n", interp.prog, args, target, interp.prog, args, target)
+	b.WriteString("  $ret=$LASTEXITCODE\n}\nexit $ret\n")
+
+	return b.String()
+}
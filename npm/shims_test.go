@@ -0,0 +1,217 @@
+package npm
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestShebangRe(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string // env, prog, args
+	}{
+		{"#!/usr/bin/env node", []string{"", "node", ""}},
+		{"#! /usr/bin/env node --harmony", []string{"", "node", " --harmony"}},
+		{"#!/usr/bin/env -S node --max-old-space-size=4096", []string{"", "node", " --max-old-space-size=4096"}},
+		{"#!/usr/bin/env NODE_ENV=production node", []string{"NODE_ENV=production ", "node", ""}},
+		{"#!/usr/bin/env -S A=1 B=2 sh -e", []string{"A=1 B=2 ", "sh", " -e"}},
+		{"#!/bin/sh", []string{"", "/bin/sh", ""}},
+		{"#!/bin/bash -eu", []string{"", "/bin/bash", " -eu"}},
+		{"// no shebang", nil},
+	}
+
+	for _, test := range tests {
+		groups := shebangRe.FindStringSubmatch(test.line)
+		var got []string
+		if groups != nil {
+			got = groups[1:]
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") || (got == nil) != (test.want == nil) {
+			t.Errorf("%q: got %q, want %q", test.line, got, test.want)
+		}
+	}
+}
+
+func TestScriptInterpreter(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		file     string
+		contents string
+		want     interpreter
+	}{
+		{"env.js", "#!/usr/bin/env node\nconsole.log(1)\n", interpreter{prog: "node"}},
+		{"crlf", "#!/usr/bin/env node\r\n", interpreter{prog: "node"}},
+		{"noeol", "#!/usr/bin/env -S FOO=bar sh -e", interpreter{env: "FOO=bar", prog: "sh", args: "-e"}},
+		{"plain.js", "console.log(1)\n", interpreter{prog: "node"}},
+		{"plain.mjs", "export {}\n", interpreter{prog: "node"}},
+		{"noext", "module.exports = 1\n", interpreter{prog: "node"}},
+		{"script.sh", "echo hi\n", interpreter{prog: "sh"}},
+		{"tool.exe", "MZ", interpreter{}},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(dir, test.file)
+		if err := ioutil.WriteFile(path, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := scriptInterpreter(path)
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.file, got, test.want)
+		}
+	}
+}
+
+func TestShimContents(t *testing.T) {
+	interp := interpreter{env: "FOO=bar", prog: "node", args: "--harmony"}
+
+	tests := []struct {
+		name     string
+		contents string
+		want     []string
+	}{
+		{"sh", shWrapper("../pkg/bin/cli.js", interp), []string{
+			"#!/bin/sh\n" + wrapperMarker + "../pkg/bin/cli.js\n",
+			`FOO=bar exec "$basedir/node" --harmony "$basedir/../pkg/bin/cli.js" "$@"`,
+			`FOO=bar exec node --harmony "$basedir/../pkg/bin/cli.js" "$@"`,
+		}},
+		{"sh direct", shWrapper("../pkg/bin/cli", interpreter{}), []string{
+			`exec "$basedir/../pkg/bin/cli" "$@"`,
+		}},
+		{"cmd", cmdShim("../pkg/bin/cli.js", interp), []string{
+			"@ECHO off\r\n" + cmdMarker + "..\\pkg\\bin\\cli.js\r\n",
+			"SET FOO=bar\r\n",
+			`"%_prog%" --harmony "%dp0%\..\pkg\bin\cli.js" %*` + "\r\n",
+		}},
+		{"ps1", ps1Shim("../pkg/bin/cli.js", interp), []string{
+			"#!/usr/bin/env pwsh\n" + wrapperMarker + "../pkg/bin/cli.js\n",
+			`$env:FOO="bar"`,
+			`& "$basedir/node$exe" --harmony "$basedir/../pkg/bin/cli.js" $args`,
+		}},
+	}
+
+	for _, test := range tests {
+		for _, want := range test.want {
+			if !strings.Contains(test.contents, want) {
+				t.Errorf("%s shim is missing %q:\n%s", test.name, want, test.contents)
+			}
+		}
+	}
+}
+
+func TestBinWrappers(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("wrappers are shell scripts")
+	}
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "node_modules", ".bin")
+	pkg := filepath.Join(dir, "node_modules", "pkg")
+	for _, d := range []string{bin, pkg} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// not executable, and run through sh with an environment variable
+	source := filepath.Join(pkg, "cli")
+	err := ioutil.WriteFile(source, []byte("#!/usr/bin/env -S GREETING=hello sh\necho \"$GREETING $*\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writeBinWrapper(bin, "cli", source, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(filepath.Join(bin, "cli"), "a", "b").CombinedOutput()
+	if err != nil || string(out) != "hello a b\n" {
+		t.Errorf("running the wrapper: %v: %q", err, out)
+	}
+
+	for _, name := range []string{"cli", "cli.cmd", "cli.ps1"} {
+		if got := wrapperTarget(filepath.Join(bin, name)); got != source {
+			t.Errorf("%s runs %q, want %q", name, got, source)
+		}
+	}
+
+	// shims we didn't write are left alone when shims are turned off
+	foreign := filepath.Join(bin, "cli.cmd")
+	if err := ioutil.WriteFile(foreign, []byte("@echo mine\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if wrapperTarget(foreign) != "" {
+		t.Error("a foreign shim was taken for ours")
+	}
+
+	err = writeBinWrapper(bin, "cli", source, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := readDirNames(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(names, " ") != "cli cli.cmd" {
+		t.Errorf("after writing wrappers without shims, .bin has %v", names)
+	}
+}
+
+func TestWrapBinReplace(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.js")
+	second := filepath.Join(dir, "second.js")
+	for _, f := range []string{first, second} {
+		if err := ioutil.WriteFile(f, []byte("#!/usr/bin/env node\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	never := func(string) bool { return false }
+	always := func(string) bool { return true }
+
+	tests := []struct {
+		source  string
+		replace func(string) bool
+		want    string
+	}{
+		{first, never, first},
+		{second, never, first},
+		{second, always, second},
+		{second, never, second},
+	}
+
+	for i, test := range tests {
+		err := wrapBin(dir, "tool", test.source, test.replace, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := wrapperTarget(filepath.Join(dir, "tool")); got != test.want {
+			t.Errorf("step %d: tool runs %s, want %s", i, got, test.want)
+		}
+	}
+
+	// files that aren't our wrappers are never replaced
+	own := filepath.Join(dir, "own")
+	if err := ioutil.WriteFile(own, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := wrapBin(dir, "own", first, always, false); err != nil {
+		t.Fatal(err)
+	}
+	if contents, _ := ioutil.ReadFile(own); string(contents) != "#!/bin/sh\n" {
+		t.Errorf("wrapBin replaced a file it didn't write: %q", contents)
+	}
+}
@@ -0,0 +1,176 @@
+package npm
+
+// submodules of git dependencies are checked out, recursively, at the
+// commits the superproject records for them, each fetched through its own
+// mirror like any other git dependency
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// how deeply submodules may nest
+const maxSubmoduleDepth = 8
+
+type gitSubmodule struct {
+	path   string // slash-separated, relative to the superproject
+	url    string
+	commit string
+}
+
+// exportGitCommit writes the files of commit, from the mirror of the remote
+// at url, into target, along with those of its submodules
+func exportGitCommit(client gitClient, tmpdir string, mirror string, url string, commit string, target string, mirrors *mirrorLocks, depth int) (err error) {
+	unlock := mirrors.lock(mirror)
+	err = client.archive(mirror, commit, target)
+	var submodules []gitSubmodule
+	if err == nil {
+		submodules, err = gitSubmodules(client, mirror, url, commit)
+	}
+	unlock()
+	if err != nil {
+		return
+	}
+
+	// only the files of this repository, not yet those of its submodules
+	err = resolveLFSPointers(target, url, mirror)
+	if err != nil {
+		return
+	}
+
+	if len(submodules) > 0 && depth >= maxSubmoduleDepth {
+		return fmt.Errorf("submodules of %s nest more than %d deep", url, maxSubmoduleDepth)
+	}
+
+	for _, sub := range submodules {
+		subTarget := filepath.Join(target, filepath.FromSlash(sub.path))
+		if !isWithin(subTarget, target) {
+			return fmt.Errorf("submodule path %s is outside of %s", sub.path, url)
+		}
+
+		subMirror, subCommit, err := fetchGitCommit(client, tmpdir, GitUrl{Url: sub.url, Ref: sub.commit}, mirrors)
+		if err != nil {
+			return fmt.Errorf("submodule %s: %v", sub.path, err)
+		}
+
+		fmt.Printf("checking out submodule %s from %s at %s\n", sub.path, sub.url, subCommit)
+		err = exportGitCommit(client, tmpdir, subMirror, sub.url, subCommit, subTarget, mirrors, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return
+}
+
+// gitSubmodules lists the submodules of commit, with their URLs from its
+// .gitmodules
+func gitSubmodules(client gitClient, mirror string, url string, commit string) (submodules []gitSubmodule, err error) {
+	links, err := client.gitlinks(mirror, commit)
+	if err != nil || len(links) == 0 {
+		return
+	}
+
+	content, err := client.readFile(mirror, commit, ".gitmodules")
+	if err != nil {
+		return nil, fmt.Errorf("%s has submodules, but no .gitmodules", url)
+	}
+	urls := parseGitmodules(content)
+
+	paths := make([]string, 0, len(links))
+	for path := range links {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		subUrl, ok := urls[path]
+		if !ok {
+			return nil, fmt.Errorf("no url for submodule %s in the .gitmodules of %s", path, url)
+		}
+		submodules = append(submodules, gitSubmodule{path: path, url: submoduleUrl(url, subUrl), commit: links[path]})
+	}
+
+	return
+}
+
+// parseGitmodules maps the paths of the submodules in a .gitmodules file to
+// their URLs
+func parseGitmodules(content []byte) (urls map[string]string) {
+	urls = make(map[string]string)
+	paths := make(map[string]string) // by section
+	sectionUrls := make(map[string]string)
+
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:eq]))
+		value := strings.Trim(strings.TrimSpace(line[eq+1:]), `"`)
+
+		switch key {
+		case "path":
+			paths[section] = strings.Trim(value, "/")
+		case "url":
+			sectionUrls[section] = value
+		}
+	}
+
+	for section, path := range paths {
+		if url, ok := sectionUrls[section]; ok {
+			urls[path] = url
+		}
+	}
+
+	return
+}
+
+// submoduleUrl resolves the URL of a submodule, which may be relative to
+// that of its superproject
+func submoduleUrl(base string, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+
+	base = strings.TrimRight(base, "/")
+	for {
+		if strings.HasPrefix(url, "./") {
+			url = url[2:]
+		} else if strings.HasPrefix(url, "../") {
+			url = url[3:]
+			// scp-style URLs have a : before their path
+			if cut := strings.LastIndexAny(base, "/:"); cut >= 0 {
+				sep := base[cut]
+				base = base[:cut]
+				if sep == ':' {
+					base += ":"
+				}
+			}
+		} else {
+			break
+		}
+	}
+
+	if strings.HasSuffix(base, ":") {
+		return base + url
+	}
+
+	return base + "/" + url
+}
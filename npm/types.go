@@ -4,15 +4,9 @@ package npm
 // in npm-shrinkwrap.json
 
 import (
-	"errors"
-	"regexp"
+	"strings"
 )
 
-type GitUrl struct {
-	Url	string
-	Ref	string
-}
-
 type PackageJSON map[string]interface{}
 
 type Module struct {
@@ -20,6 +14,13 @@ type Module struct {
 	Version      string
 	From         string
 	Resolved     string
+	Integrity    string
+	Optional     bool
+	Dev          bool
+	Bundled      bool
+	OS           []string
+	CPU          []string
+	Engines      map[string]string
 	Dependencies []Module
 }
 
@@ -27,6 +28,19 @@ type App struct {
 	Name         string
 	Version      string
 	Dependencies []Module
+	Workspaces   []Workspace
+
+	// Graph replaces Dependencies and Workspaces for lockfiles installed
+	// in an isolated layout (pnpm-lock.yaml)
+	Graph *PackageGraph
+}
+
+// Workspace is a package that lockfileVersion 2+ lockfiles record outside of
+// node_modules, by its path from the lockfile, along with the dependencies
+// installed in its own node_modules
+type Workspace struct {
+	Path         string
+	Dependencies []Module
 }
 
 type Package interface {
@@ -46,17 +60,46 @@ func (a App) DependencyList() (deps []Module) {
 	return a.Dependencies
 }
 
-// not nearly as general as npm's - see https://docs.npmjs.com/cli/install
-func GitUrlFromString(str string) (gitUrl GitUrl, err error) {
-	re := regexp.MustCompile("git\\+([^#]+)#?(.*)")
-	groups := re.FindStringSubmatch(str)
+func (w Workspace) DependencyList() (deps []Module) {
+	return w.Dependencies
+}
+
+// LocalSpec returns the path of a file: or link: dependency, as written in
+// the shrinkwrap. npm records these in resolved, or, in older shrinkwraps,
+// in version.
+func (m Module) LocalSpec() (path string, isLink bool, ok bool) {
+	for _, spec := range []string{m.Resolved, m.Version} {
+		if strings.HasPrefix(spec, "file:") {
+			return strings.TrimPrefix(spec, "file:"), false, true
+		}
+		if strings.HasPrefix(spec, "link:") {
+			return strings.TrimPrefix(spec, "link:"), true, true
+		}
+	}
+
+	return "", false, false
+}
+
+// OmitDev removes the modules only needed for development (marked "dev" in
+// the shrinkwrap) from the tree, so they are neither downloaded nor installed
+func (a *App) OmitDev() {
+	a.Dependencies = omitDev(a.Dependencies)
+	for i := range a.Workspaces {
+		a.Workspaces[i].Dependencies = omitDev(a.Workspaces[i].Dependencies)
+	}
+	if a.Graph != nil {
+		a.Graph.omitDev()
+	}
+}
+
+func omitDev(deps []Module) (kept []Module) {
+	for _, m := range deps {
+		if m.Dev {
+			continue
+		}
 
-	if len(groups) < 2 {
-		err = errors.New("gitUrl: not a valid git url")
-	} else if len(groups) == 1 {
-		gitUrl = GitUrl{Url: groups[1], Ref: "master" }
-	} else {
-		gitUrl = GitUrl{Url: groups[1], Ref: groups[2] }
+		m.Dependencies = omitDev(m.Dependencies)
+		kept = append(kept, m)
 	}
 
 	return
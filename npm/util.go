@@ -3,6 +3,7 @@ package npm
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 func PrintApp(a App) {
@@ -16,3 +17,37 @@ func printDependencies(deps []Module, indent int) {
 		printDependencies(dep.Dependencies, indent+2)
 	}
 }
+
+// PrintSkippedScripts lists the packages whose lifecycle scripts were not run
+// because of the script policy
+func PrintSkippedScripts(policy *ScriptPolicy) {
+	skipped := policy.Skipped()
+	if len(skipped) == 0 {
+		return
+	}
+
+	fmt.Printf("skipped install scripts for %d packages:\n", len(skipped))
+	for _, s := range skipped {
+		fmt.Printf("  %s @ %s (%s): %s\n", s.Name, s.Version, s.Path, s.Script)
+	}
+}
+
+// PrintScriptReport summarizes how long each lifecycle script took
+func PrintScriptReport(report *ScriptReport) {
+	runs := report.Runs()
+	if len(runs) == 0 {
+		return
+	}
+
+	var total time.Duration
+	fmt.Printf("ran %d lifecycle scripts:\n", len(runs))
+	for _, run := range runs {
+		status := "ok"
+		if run.Err != nil {
+			status = "failed"
+		}
+		fmt.Printf("  %8s  %-6s  %s (%s)\n", run.Elapsed.Round(time.Millisecond), status, run.Path, run.Event)
+		total += run.Elapsed
+	}
+	fmt.Printf("total script time: %s\n", total.Round(time.Millisecond))
+}
@@ -0,0 +1,226 @@
+package npm
+
+// npm workspaces: packages of a monorepo that live in the project itself, as
+// listed by the workspaces globs in the root package.json. Each one is linked
+// into the root node_modules like a link: dependency, gets the dependencies
+// the lockfile records under its own node_modules, and has its lifecycle
+// scripts run like any installed package.
+// see https://docs.npmjs.com/cli/using-npm/workspaces
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// workspaceDirs expands the workspaces globs of the package.json in baseDir
+// into the absolute directories of the workspaces
+func workspaceDirs(baseDir string) (dirs []string, err error) {
+	pkg, err := ReadPackageJSON(baseDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, pattern := range workspacePatterns(pkg["workspaces"]) {
+		exclude := strings.HasPrefix(pattern, "!")
+		pattern = cleanWorkspacePattern(pattern)
+
+		matches, err := globWorkspaces(baseDir, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap: bad workspaces pattern %q: %v", pattern, err)
+		}
+
+		for _, dir := range matches {
+			if _, statErr := os.Stat(filepath.Join(dir, "package.json")); statErr != nil {
+				continue
+			}
+			found[dir] = !exclude
+		}
+	}
+
+	for dir, included := range found {
+		if included {
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+
+	return
+}
+
+// workspacePatterns reads the workspaces field of a package.json: either a
+// list of globs, or {"packages": [...]} as yarn writes it
+func workspacePatterns(field interface{}) []string {
+	if object, ok := field.(map[string]interface{}); ok {
+		return toStringList(object["packages"])
+	}
+
+	return toStringList(field)
+}
+
+func cleanWorkspacePattern(pattern string) string {
+	pattern = strings.TrimPrefix(pattern, "!")
+	return path.Clean(strings.TrimSuffix(pattern, "/"))
+}
+
+// globWorkspaces expands pattern in baseDir. filepath.Glob has no **, for
+// any number of directories, so those patterns are matched while walking
+// the project, leaving out node_modules.
+func globWorkspaces(baseDir string, pattern string) (matches []string, err error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(filepath.Join(baseDir, filepath.FromSlash(pattern)))
+	}
+
+	segments := strings.Split(pattern, "/")
+	for _, segment := range segments {
+		if _, err = path.Match(segment, ""); err != nil {
+			return
+		}
+	}
+
+	err = filepath.Walk(baseDir, func(dir string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		if dir != baseDir && (info.Name() == "node_modules" || info.Name() == ".git") {
+			return filepath.SkipDir
+		}
+
+		rel, err := filepath.Rel(baseDir, dir)
+		if err != nil {
+			return err
+		}
+		if matchGlobSegments(segments, strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, dir)
+		}
+		return nil
+	})
+
+	return
+}
+
+// matchWorkspace reports whether the workspaces globs in patterns take in
+// the path relPath, from the project root. As when expanding them, a later
+// pattern overrides an earlier one.
+func matchWorkspace(patterns []string, relPath string) (included bool) {
+	names := strings.Split(relPath, "/")
+	for _, pattern := range patterns {
+		exclude := strings.HasPrefix(pattern, "!")
+		if matchGlobSegments(strings.Split(cleanWorkspacePattern(pattern), "/"), names) {
+			included = !exclude
+		}
+	}
+
+	return
+}
+
+// matchGlobSegments matches a path, split into its names, against a glob
+// split the same way, where ** matches any number of names
+func matchGlobSegments(pattern []string, names []string) bool {
+	if len(pattern) == 0 {
+		return len(names) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(names); i++ {
+			if matchGlobSegments(pattern[1:], names[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(names) == 0 {
+		return false
+	}
+	matched, err := path.Match(pattern[0], names[0])
+	return err == nil && matched && matchGlobSegments(pattern[1:], names[1:])
+}
+
+// installWorkspaces links the workspaces into targetDir and installs their
+// own dependencies, after the top-level modules in roots are in place. It
+// returns the new links, and the nodes that run the workspaces' scripts.
+func (a *App) installWorkspaces(tmpdir string, targetDir string, opts InstallOptions, roots []*scriptNode) (links []*scriptNode, workspaces []*scriptNode, err error) {
+	dirs, err := workspaceDirs(opts.BaseDir)
+	if err != nil {
+		return
+	}
+
+	lockfileDeps := make(map[string][]Module)
+	for _, ws := range a.Workspaces {
+		lockfileDeps[ws.Path] = ws.Dependencies
+	}
+
+	linked := make(map[string]bool)
+	for _, n := range roots {
+		linked[n.name] = true
+	}
+
+	for _, dir := range dirs {
+		pkg, err := ReadPackageJSON(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name, err := pkg.Name()
+		if err != nil {
+			return nil, nil, fmt.Errorf("unwrap: workspace %s: %v", dir, err)
+		}
+
+		// the lockfile usually links workspaces from node_modules itself
+		if !linked[name] {
+			link, err := linkLocalModule(Module{Name: name}, dir, filepath.Join(targetDir, name))
+			if err != nil {
+				return nil, nil, err
+			}
+			links = append(links, link)
+			linked[name] = true
+		}
+
+		relPath, err := filepath.Rel(opts.BaseDir, dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		node := &scriptNode{name: name, dir: dir, pkg: pkg, workspace: true}
+
+		deps := lockfileDeps[filepath.ToSlash(relPath)]
+		if len(deps) > 0 {
+			nodeModulesDir := filepath.Join(dir, "node_modules")
+			err = os.MkdirAll(nodeModulesDir, 0755)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, module := range deps {
+				dep, err := installModule(module, tmpdir, nodeModulesDir, opts)
+				if err != nil {
+					return nil, nil, err
+				}
+				if dep != nil {
+					node.deps = append(node.deps, dep)
+				}
+			}
+		}
+
+		log.Printf("workspace %s: %d dependencies\n", relPath, len(node.deps))
+		workspaces = append(workspaces, node)
+	}
+
+	// workspaces may use anything hoisted to the root, so their scripts
+	// run last
+	for _, node := range workspaces {
+		node.after = append(node.after, roots...)
+		node.after = append(node.after, links...)
+	}
+
+	return
+}
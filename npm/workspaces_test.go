@@ -0,0 +1,135 @@
+package npm
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatchWorkspace(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{[]string{"packages/*"}, "packages/a", true},
+		{[]string{"packages/*"}, "packages/group/a", false},
+		{[]string{"packages/*/"}, "packages/a", true},
+		{[]string{"./packages/*"}, "packages/a", true},
+		{[]string{"packages/**"}, "packages/a", true},
+		{[]string{"packages/**"}, "packages/group/a", true},
+		{[]string{"packages/**"}, "libs/a", false},
+		{[]string{"**/pkg-*"}, "pkg-a", true},
+		{[]string{"**/pkg-*"}, "deep/er/pkg-a", true},
+		{[]string{"packages/**/a"}, "packages/a", true},
+		{[]string{"packages/**/a"}, "packages/x/y/a", true},
+		{[]string{"packages/**/a"}, "packages/x/b", false},
+		{[]string{"apps/web"}, "apps/web", true},
+		{[]string{"packages/*", "!packages/private"}, "packages/private", false},
+		{[]string{"packages/*", "!packages/private"}, "packages/public", true},
+		{[]string{"!packages/private", "packages/*"}, "packages/private", true},
+		{nil, "packages/a", false},
+		{[]string{"packages/[a"}, "packages/a", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchWorkspace(tt.patterns, tt.path); got != tt.want {
+			t.Errorf("matchWorkspace(%q, %q) = %v, want %v", tt.patterns, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWorkspaceDirs(t *testing.T) {
+	tests := []struct {
+		name       string
+		workspaces string
+		want       []string
+		wantErr    bool
+	}{
+		{name: "one level", workspaces: `["packages/*"]`, want: []string{"packages/b", "packages/private"}},
+		{name: "recursive", workspaces: `["packages/**"]`, want: []string{"packages/b", "packages/group/a", "packages/private"}},
+		{name: "recursive with exclusion", workspaces: `["packages/**", "!packages/private"]`, want: []string{"packages/b", "packages/group/a"}},
+		{name: "yarn object", workspaces: `{"packages": ["packages/group/*", "apps/web"]}`, want: []string{"apps/web", "packages/group/a"}},
+		{name: "anywhere", workspaces: `["**/a"]`, want: []string{"packages/group/a"}},
+		{name: "none", workspaces: `[]`},
+		{name: "bad pattern", workspaces: `["packages/[a"]`, wantErr: true},
+		{name: "bad recursive pattern", workspaces: `["packages/**/[a"]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTree(t, dir, map[string]string{
+				"package.json":                           `{"name": "root", "workspaces": ` + tt.workspaces + `}`,
+				"packages/b/package.json":                `{"name": "b"}`,
+				"packages/private/package.json":          `{"name": "private"}`,
+				"packages/group/a/package.json":          `{"name": "a"}`,
+				"packages/group/README.md":               "no package here\n",
+				"packages/b/node_modules/a/package.json": `{"name": "a"}`,
+				"apps/web/package.json":                  `{"name": "web"}`,
+				"libs/shared/package.json":               `{"name": "shared"}`,
+			})
+
+			dirs, err := workspaceDirs(dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var got []string
+			for _, d := range dirs {
+				rel, err := filepath.Rel(dir, d)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkspaceTrees(t *testing.T) {
+	lockfile := `{
+	  "name": "root",
+	  "lockfileVersion": 3,
+	  "packages": {
+	    "": {"name": "root", "workspaces": ["packages/**"], "dependencies": {"shared": "file:libs/shared"}},
+	    "libs/shared": {"version": "1.0.0", "dependencies": {"x": "1.0.0"}},
+	    "libs/shared/node_modules/x": {"version": "1.0.0", "resolved": "https://registry.example/x/-/x-1.0.0.tgz"},
+	    "node_modules/a": {"resolved": "packages/group/a", "link": true},
+	    "node_modules/b": {"resolved": "packages/b", "link": true},
+	    "node_modules/shared": {"resolved": "libs/shared", "link": true},
+	    "packages/b": {"version": "1.0.0"},
+	    "packages/b/node_modules/y": {"version": "2.0.0", "resolved": "https://registry.example/y/-/y-2.0.0.tgz"},
+	    "packages/group/a": {"version": "1.0.0"}
+	  }
+	}`
+
+	app, err := ParseApp(strings.NewReader(lockfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, ws := range app.Workspaces {
+		paths = append(paths, ws.Path)
+	}
+	if want := []string{"packages/b", "packages/group/a"}; !reflect.DeepEqual(paths, want) {
+		t.Fatalf("workspaces = %q, want %q", paths, want)
+	}
+	if deps := app.Workspaces[0].Dependencies; len(deps) != 1 || deps[0].Name != "y" {
+		t.Errorf("packages/b dependencies = %+v, want y", deps)
+	}
+
+	// without workspaces in the root package, there are none
+	app, err = ParseApp(strings.NewReader(strings.Replace(lockfile, `"workspaces": ["packages/**"], `, "", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(app.Workspaces) != 0 {
+		t.Errorf("workspaces = %+v, want none", app.Workspaces)
+	}
+}
@@ -0,0 +1,370 @@
+package npm
+
+// just enough YAML to read lockfiles: block mappings and sequences, flow
+// mappings and sequences on a single line, and plain or quoted scalars. Every
+// scalar is returned as a string; mappings are map[string]interface{} and
+// sequences []interface{}.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type yamlLine struct {
+	number  int
+	indent  int
+	content string
+}
+
+func parseYAML(r io.Reader) (value interface{}, err error) {
+	var lines []yamlLine
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(stripYAMLComment(scanner.Text()), " \t\r")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || content == "---" || content == "..." {
+			continue
+		}
+		lines = append(lines, yamlLine{number, len(text) - len(content), content})
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	p := &yamlParser{lines: lines}
+	value, err = p.block(lines[0].indent)
+	if err == nil && p.pos < len(lines) {
+		err = p.errorf("unexpected indentation")
+	}
+
+	return
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	line := p.lines[len(p.lines)-1]
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos]
+	}
+
+	return fmt.Errorf("yaml: line %d: %s", line.number, fmt.Sprintf(format, args...))
+}
+
+// block parses the mapping or sequence whose entries start at indent
+func (p *yamlParser) block(indent int) (value interface{}, err error) {
+	if strings.HasPrefix(p.lines[p.pos].content+" ", "- ") {
+		return p.sequence(indent)
+	}
+
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (seq []interface{}, err error) {
+	seq = []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := &p.lines[p.pos]
+		if !strings.HasPrefix(line.content+" ", "- ") {
+			break
+		}
+
+		item := strings.TrimSpace(line.content[1:])
+		if item == "" {
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				seq = append(seq, "")
+				continue
+			}
+			value, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+			continue
+		}
+
+		if _, _, isEntry := splitYAMLEntry(item); isEntry {
+			// `- key: value` starts a mapping indented past the dash
+			line.indent += len(line.content) - len(item)
+			line.content = item
+			value, err := p.mapping(line.indent)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, value)
+			continue
+		}
+
+		value, err := parseYAMLFlow(item)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		seq = append(seq, value)
+		p.pos++
+	}
+
+	return
+}
+
+func (p *yamlParser) mapping(indent int) (m map[string]interface{}, err error) {
+	m = make(map[string]interface{})
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+
+		rawKey, rest, isEntry := splitYAMLEntry(line.content)
+		if !isEntry {
+			return nil, p.errorf("expected a key in %q", line.content)
+		}
+		key, err := unquoteYAML(rawKey)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		p.pos++
+
+		if rest != "" {
+			m[key], err = parseYAMLFlow(rest)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			continue
+		}
+
+		// a nested block, which for sequences may start at the same indent
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			nested := next.indent > indent || (next.indent == indent && strings.HasPrefix(next.content+" ", "- "))
+			if nested {
+				m[key], err = p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		m[key] = ""
+	}
+
+	return
+}
+
+// splitYAMLEntry splits `key: value` at the first colon outside quotes that
+// is followed by a space or the end of the line
+func splitYAMLEntry(content string) (key string, rest string, ok bool) {
+	var quote byte
+	for i := 0; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == '{' || c == '[':
+			if i == 0 {
+				return "", "", false
+			}
+		case c == ':' && (i+1 == len(content) || content[i+1] == ' '):
+			return strings.TrimSpace(content[:i]), strings.TrimSpace(content[i+1:]), true
+		}
+	}
+
+	return "", "", false
+}
+
+// stripYAMLComment removes a trailing # comment, which must follow a space
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" :[{,-", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+
+	return text
+}
+
+func unquoteYAML(s string) (string, error) {
+	if strings.HasPrefix(s, "'") {
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	}
+	if strings.HasPrefix(s, "\"") {
+		return strconv.Unquote(s)
+	}
+
+	return s, nil
+}
+
+// parseYAMLFlow parses a value written on a single line: a scalar, or a flow
+// mapping or sequence
+func parseYAMLFlow(s string) (value interface{}, err error) {
+	f := &yamlFlow{s: s}
+	value, err = f.value(false)
+	if err != nil {
+		return
+	}
+
+	f.skipSpaces()
+	if f.pos < len(f.s) {
+		return nil, fmt.Errorf("unexpected %q after value", f.s[f.pos:])
+	}
+
+	return
+}
+
+type yamlFlow struct {
+	s   string
+	pos int
+}
+
+func (f *yamlFlow) skipSpaces() {
+	for f.pos < len(f.s) && f.s[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) value(inFlow bool) (value interface{}, err error) {
+	f.skipSpaces()
+	if f.pos == len(f.s) {
+		return "", nil
+	}
+
+	switch f.s[f.pos] {
+	case '{':
+		return f.mapping()
+	case '[':
+		return f.sequence()
+	}
+
+	return f.scalar(inFlow, false)
+}
+
+func (f *yamlFlow) mapping() (m map[string]interface{}, err error) {
+	m = make(map[string]interface{})
+	f.pos++
+
+	for {
+		f.skipSpaces()
+		if f.pos == len(f.s) {
+			return nil, fmt.Errorf("unterminated mapping")
+		}
+		if f.s[f.pos] == '}' {
+			f.pos++
+			return
+		}
+
+		key, err := f.scalar(true, true)
+		if err != nil {
+			return nil, err
+		}
+		f.skipSpaces()
+
+		var value interface{} = ""
+		if f.pos < len(f.s) && f.s[f.pos] == ':' {
+			f.pos++
+			value, err = f.value(true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		m[key] = value
+
+		f.skipSpaces()
+		if f.pos < len(f.s) && f.s[f.pos] == ',' {
+			f.pos++
+		}
+	}
+}
+
+func (f *yamlFlow) sequence() (seq []interface{}, err error) {
+	seq = []interface{}{}
+	f.pos++
+
+	for {
+		f.skipSpaces()
+		if f.pos == len(f.s) {
+			return nil, fmt.Errorf("unterminated sequence")
+		}
+		if f.s[f.pos] == ']' {
+			f.pos++
+			return
+		}
+
+		value, err := f.value(true)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, value)
+
+		f.skipSpaces()
+		if f.pos < len(f.s) && f.s[f.pos] == ',' {
+			f.pos++
+		}
+	}
+}
+
+// scalar reads a quoted or plain scalar. Inside flow collections plain
+// scalars end at , ] or }, and keys also end at a colon.
+func (f *yamlFlow) scalar(inFlow bool, isKey bool) (string, error) {
+	start := f.pos
+
+	if c := f.s[f.pos]; c == '"' || c == '\'' {
+		for f.pos++; f.pos < len(f.s); f.pos++ {
+			if f.s[f.pos] == '\\' && c == '"' {
+				f.pos++
+			} else if f.s[f.pos] == c {
+				if c == '\'' && f.pos+1 < len(f.s) && f.s[f.pos+1] == '\'' {
+					f.pos++
+					continue
+				}
+				f.pos++
+				return unquoteYAML(f.s[start:f.pos])
+			}
+		}
+		return "", fmt.Errorf("unterminated string %s", f.s[start:])
+	}
+
+	for ; f.pos < len(f.s); f.pos++ {
+		c := f.s[f.pos]
+		if inFlow && (c == ',' || c == ']' || c == '}') {
+			break
+		}
+		if isKey && c == ':' && (f.pos+1 == len(f.s) || f.s[f.pos+1] == ' ') {
+			break
+		}
+	}
+
+	return strings.TrimSpace(f.s[start:f.pos]), nil
+}
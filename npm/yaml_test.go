@@ -0,0 +1,77 @@
+package npm
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want interface{}
+	}{
+		{"empty", "# nothing\n", map[string]interface{}{}},
+		{"scalars", "a: 1\nb: 'it''s'\nc: \"x\\ty\"\nd: plain text # comment\ne:\n",
+			map[string]interface{}{"a": "1", "b": "it's", "c": "x\ty", "d": "plain text", "e": ""}},
+		{"nested", "lockfileVersion: '6.0'\n\nimporters:\n\n  .:\n    dependencies:\n      alpha:\n        specifier: ^1.0.0\n        version: 1.0.0\n",
+			map[string]interface{}{
+				"lockfileVersion": "6.0",
+				"importers": map[string]interface{}{
+					".": map[string]interface{}{
+						"dependencies": map[string]interface{}{
+							"alpha": map[string]interface{}{"specifier": "^1.0.0", "version": "1.0.0"},
+						},
+					},
+				},
+			}},
+		{"quoted keys", "'@scope/pkg@1.0.0':\n  dev: true\n\"/a@1.0.0(b@2.0.0)\": {}\n",
+			map[string]interface{}{
+				"@scope/pkg@1.0.0":  map[string]interface{}{"dev": "true"},
+				"/a@1.0.0(b@2.0.0)": map[string]interface{}{},
+			}},
+		{"flow", "resolution: {integrity: sha512-abc=, tarball: 'http://host/a-1.0.0.tgz'}\nos: [darwin, 'linux']\nengines: {node: '>=14'}\n",
+			map[string]interface{}{
+				"resolution": map[string]interface{}{"integrity": "sha512-abc=", "tarball": "http://host/a-1.0.0.tgz"},
+				"os":         []interface{}{"darwin", "linux"},
+				"engines":    map[string]interface{}{"node": ">=14"},
+			}},
+		{"sequences", "cpu:\n  - x64\n  - arm64\nnested:\n  - name: a\n    version: 1.0.0\n  - b\n",
+			map[string]interface{}{
+				"cpu": []interface{}{"x64", "arm64"},
+				"nested": []interface{}{
+					map[string]interface{}{"name": "a", "version": "1.0.0"},
+					"b",
+				},
+			}},
+		{"hash in a value", "url: http://host/a#b\nc: 'd # e'\n",
+			map[string]interface{}{"url": "http://host/a#b", "c": "d # e"}},
+	}
+
+	for _, test := range tests {
+		got, err := parseYAML(strings.NewReader(test.doc))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []string{
+		"a: {b: c\n",
+		"a: [b, c\n",
+		"a: 'unterminated\n",
+		"a: 1\n  b: 2\n",
+	}
+
+	for _, doc := range tests {
+		if _, err := parseYAML(strings.NewReader(doc)); err == nil {
+			t.Errorf("parseYAML(%q) succeeded", doc)
+		}
+	}
+}
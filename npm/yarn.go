@@ -0,0 +1,492 @@
+package npm
+
+// yarn.lock (v1, as written by Yarn classic) support. A yarn.lock only lists
+// which version each range resolved to, not where packages go, so the
+// node_modules layout is worked out here: breadth first from package.json,
+// every package is placed as high up the tree as it can go without hiding a
+// different version of the same name from a package below, and reuses a
+// matching version above it when there is one. This is the layout Yarn
+// produces, apart from Yarn sometimes hoisting the most used version of a
+// name rather than the first one reached.
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type yarnEntry struct {
+	name         string
+	version      string
+	resolved     string
+	integrity    string
+	dependencies map[string]string
+	optionalDeps map[string]string
+}
+
+// a package placed in the hoisted tree
+type hoistNode struct {
+	name      string
+	entry     *yarnEntry // nil for the root and for workspaces
+	workspace string     // path of a workspace, from the project
+	parent    *hoistNode
+	children  map[string]*hoistNode
+
+	// names that this node or one below it finds above this node, and
+	// which therefore can't be placed here
+	pinned map[string]bool
+}
+
+func newHoistNode(name string, entry *yarnEntry, parent *hoistNode) *hoistNode {
+	return &hoistNode{
+		name:     name,
+		entry:    entry,
+		parent:   parent,
+		children: make(map[string]*hoistNode),
+		pinned:   make(map[string]bool),
+	}
+}
+
+// ParseYarnApp reads a yarn.lock from r, along with the package.json (and any
+// workspaces) in baseDir, and lays the packages out the way Yarn would
+func ParseYarnApp(r io.Reader, baseDir string) (app App, err error) {
+	entries, err := parseYarnLock(r)
+	if err != nil {
+		return
+	}
+
+	manifest, err := ReadPackageJSON(baseDir)
+	if err != nil {
+		return
+	}
+
+	app.Name, _ = manifest.Name()
+	app.Version, _ = manifest.Version()
+
+	root := newHoistNode("", nil, nil)
+
+	// workspaces are linked into the root node_modules, and yarn.lock
+	// doesn't list them: their dependencies hoist past them to the root
+	dirs, err := workspaceDirs(baseDir)
+	if err != nil {
+		return
+	}
+
+	workspaces := make(map[string]bool)
+	var wsNodes []*hoistNode
+	var wsManifests []PackageJSON
+	for _, dir := range dirs {
+		pkg, err := ReadPackageJSON(dir)
+		if err != nil {
+			return app, err
+		}
+		name, err := pkg.Name()
+		if err != nil {
+			return app, fmt.Errorf("unwrap: workspace %s: %v", dir, err)
+		}
+		relPath, err := filepath.Rel(baseDir, dir)
+		if err != nil {
+			return app, err
+		}
+
+		ws := newHoistNode(name, nil, root)
+		ws.workspace = filepath.ToSlash(relPath)
+		root.children[name] = ws
+		workspaces[name] = true
+		wsNodes = append(wsNodes, ws)
+		wsManifests = append(wsManifests, pkg)
+	}
+
+	rootDeps := manifestDependencies(manifest, workspaces)
+
+	queue := []*hoistNode{root}
+	requires := map[*hoistNode]map[string]string{root: rootDeps}
+	for i, ws := range wsNodes {
+		queue = append(queue, ws)
+		requires[ws] = manifestDependencies(wsManifests[i], workspaces)
+	}
+
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+
+		deps := requires[n]
+		if n.entry != nil {
+			deps = n.entry.allDependencies()
+		}
+
+		for _, name := range sortedKeys(deps) {
+			spec := name + "@" + deps[name]
+			entry, ok := entries[spec]
+			if !ok {
+				return app, fmt.Errorf("unwrap: %s is not in yarn.lock", spec)
+			}
+
+			placed, err := n.place(name, entry)
+			if err != nil {
+				return app, err
+			}
+			if placed != nil {
+				queue = append(queue, placed)
+			}
+		}
+	}
+
+	manifests := append([]PackageJSON{manifest}, wsManifests...)
+	prod := yarnReachable(entries, manifests, workspaces, "dependencies", "optionalDependencies")
+	required := yarnReachable(entries, manifests, workspaces, "dependencies", "devDependencies")
+
+	app.Dependencies = root.modules(prod, required)
+	for _, ws := range wsNodes {
+		app.Workspaces = append(app.Workspaces, Workspace{Path: ws.workspace, Dependencies: ws.modules(prod, required)})
+	}
+
+	return
+}
+
+// place finds where the dependency name of n goes: the highest node above n
+// that neither has a different version of name nor shadows one for a node
+// below it. It returns the new node, or nil if a matching version is already
+// in reach.
+func (n *hoistNode) place(name string, entry *yarnEntry) (placed *hoistNode, err error) {
+	var target *hoistNode
+	blocked := false
+	for a := n; a != nil; a = a.parent {
+		if existing, ok := a.children[name]; ok {
+			if existing.entry != nil && existing.entry.version == entry.version {
+				n.pin(a, name)
+				return nil, nil
+			}
+			break
+		}
+
+		if a.pinned[name] {
+			blocked = true
+		}
+		if !blocked {
+			target = a
+		}
+	}
+
+	if target == nil {
+		return nil, fmt.Errorf("unwrap: no place for %s@%s in the tree below %s", name, entry.version, n.path())
+	}
+
+	placed = newHoistNode(name, entry, target)
+	target.children[name] = placed
+	n.pin(target, name)
+
+	return
+}
+
+// pin records that the nodes from n up to holder find name at holder
+func (n *hoistNode) pin(holder *hoistNode, name string) {
+	for a := n; a != holder; a = a.parent {
+		a.pinned[name] = true
+	}
+}
+
+func (n *hoistNode) path() string {
+	if n.parent == nil {
+		return "the root"
+	}
+	if n.workspace != "" {
+		return n.workspace
+	}
+
+	return n.parent.path() + " > " + n.name
+}
+
+// modules converts the children of n into the Module tree InstallFromTmpdir
+// expects
+func (n *hoistNode) modules(prod map[*yarnEntry]bool, required map[*yarnEntry]bool) (deps []Module) {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := n.children[name]
+		if child.entry == nil {
+			// workspaces are linked separately
+			continue
+		}
+
+		deps = append(deps, Module{
+			Name:         name,
+			Version:      child.entry.version,
+			Resolved:     child.entry.resolved,
+			Integrity:    child.entry.integrity,
+			Dev:          !prod[child.entry],
+			Optional:     !required[child.entry],
+			Dependencies: child.modules(prod, required),
+		})
+	}
+
+	return
+}
+
+func (e *yarnEntry) allDependencies() map[string]string {
+	deps := make(map[string]string)
+	for name, rng := range e.dependencies {
+		deps[name] = rng
+	}
+	for name, rng := range e.optionalDeps {
+		deps[name] = rng
+	}
+
+	return deps
+}
+
+// manifestDependencies lists everything a package.json asks for, apart from
+// other workspaces
+func manifestDependencies(pkg PackageJSON, workspaces map[string]bool) map[string]string {
+	deps := make(map[string]string)
+	for _, field := range []string{"devDependencies", "dependencies", "optionalDependencies"} {
+		for name, rng := range toStringMap(pkg[field]) {
+			if !workspaces[name] {
+				deps[name] = rng
+			}
+		}
+	}
+
+	return deps
+}
+
+// yarnReachable finds the entries reachable from the manifests through the
+// given dependency fields
+func yarnReachable(entries map[string]*yarnEntry, manifests []PackageJSON, workspaces map[string]bool, fields ...string) map[*yarnEntry]bool {
+	reached := make(map[*yarnEntry]bool)
+
+	var visit func(name string, rng string)
+	visit = func(name string, rng string) {
+		entry, ok := entries[name+"@"+rng]
+		if !ok || reached[entry] {
+			return
+		}
+		reached[entry] = true
+
+		for _, field := range fields {
+			deps := entry.dependencies
+			if field == "optionalDependencies" {
+				deps = entry.optionalDeps
+			} else if field != "dependencies" {
+				// only manifests have devDependencies that are installed
+				continue
+			}
+
+			for depName, depRange := range deps {
+				visit(depName, depRange)
+			}
+		}
+	}
+
+	for _, pkg := range manifests {
+		for _, field := range fields {
+			for name, rng := range toStringMap(pkg[field]) {
+				if !workspaces[name] {
+					visit(name, rng)
+				}
+			}
+		}
+	}
+
+	return reached
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// parseYarnLock reads the entries of a yarn.lock, keyed by every name@range
+// spec that resolved to them
+func parseYarnLock(r io.Reader) (entries map[string]*yarnEntry, err error) {
+	blocks, err := parseYarnBlocks(r)
+	if err != nil {
+		return
+	}
+
+	entries = make(map[string]*yarnEntry)
+	for key, value := range blocks {
+		block, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unwrap: yarn.lock: %s is not an entry", key)
+		}
+
+		entry := &yarnEntry{
+			dependencies: yarnStringMap(block["dependencies"]),
+			optionalDeps: yarnStringMap(block["optionalDependencies"]),
+		}
+		entry.version, _ = block["version"].(string)
+		entry.resolved, _ = block["resolved"].(string)
+		entry.integrity, _ = block["integrity"].(string)
+
+		for _, spec := range strings.Split(key, ",") {
+			spec, err = yarnUnquote(strings.TrimSpace(spec))
+			if err != nil {
+				return nil, fmt.Errorf("unwrap: yarn.lock: bad key %s: %v", key, err)
+			}
+
+			at := strings.LastIndex(spec, "@")
+			if at <= 0 {
+				return nil, fmt.Errorf("unwrap: yarn.lock: bad key %s", key)
+			}
+			// aliases (alias@npm:name@range) are installed under the alias
+			if npmAlias := strings.Index(spec, "@npm:"); npmAlias > 0 {
+				at = npmAlias
+			}
+
+			entry.name = spec[:at]
+			entries[spec] = entry
+			adjustYarnEntry(entry, spec[at+1:])
+		}
+	}
+
+	return
+}
+
+// adjustYarnEntry turns what yarn.lock records into what the installer
+// expects: tarball URLs without their #sha1 suffix (which older yarn.lock
+// files have instead of an integrity field), and local dependencies by their
+// file: path
+func adjustYarnEntry(entry *yarnEntry, rng string) {
+	if strings.HasPrefix(rng, "file:") || strings.HasPrefix(rng, "link:") {
+		entry.version = rng
+		entry.resolved = ""
+		return
+	}
+
+	if strings.HasPrefix(entry.resolved, "http://") || strings.HasPrefix(entry.resolved, "https://") {
+		if hash := strings.Index(entry.resolved, "#"); hash >= 0 {
+			if sum, err := hex.DecodeString(entry.resolved[hash+1:]); err == nil && entry.integrity == "" && len(sum) == sha1.Size {
+				entry.integrity = "sha1-" + base64.StdEncoding.EncodeToString(sum)
+			}
+			entry.resolved = entry.resolved[:hash]
+		}
+	}
+}
+
+func yarnStringMap(value interface{}) map[string]string {
+	m := make(map[string]string)
+	if block, ok := value.(map[string]interface{}); ok {
+		for key, entry := range block {
+			if s, ok := entry.(string); ok {
+				m[key] = s
+			}
+		}
+	}
+
+	return m
+}
+
+// parseYarnBlocks parses the indentation-based yarn.lock syntax into nested
+// maps: `key value` lines hold strings and `key:` lines open a block
+func parseYarnBlocks(r io.Reader) (root map[string]interface{}, err error) {
+	type level struct {
+		indent int
+		block  map[string]interface{}
+	}
+
+	root = make(map[string]interface{})
+	stack := []level{{-1, root}}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimRight(scanner.Text(), " \r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || strings.HasPrefix(content, "#") {
+			continue
+		}
+
+		indent := len(line) - len(content)
+		for indent <= stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		current := stack[len(stack)-1].block
+
+		if strings.HasSuffix(content, ":") {
+			key := strings.TrimSuffix(content, ":")
+			if indent > 0 {
+				key, err = yarnUnquote(key)
+				if err != nil {
+					return nil, fmt.Errorf("unwrap: yarn.lock line %d: %v", lineNo, err)
+				}
+			}
+
+			block := make(map[string]interface{})
+			current[key] = block
+			stack = append(stack, level{indent, block})
+			continue
+		}
+
+		key, value, err := splitYarnLine(content)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap: yarn.lock line %d: %v", lineNo, err)
+		}
+		current[key] = value
+	}
+
+	return root, scanner.Err()
+}
+
+// splitYarnLine splits `key value`, where either may be quoted
+func splitYarnLine(content string) (key string, value string, err error) {
+	end := strings.IndexAny(content, " \t")
+	if strings.HasPrefix(content, "\"") {
+		end = closingQuote(content) + 1
+		if end == 0 {
+			return "", "", fmt.Errorf("unterminated string in %s", content)
+		}
+	}
+	if end < 0 {
+		return "", "", fmt.Errorf("no value for %s", content)
+	}
+
+	key, err = yarnUnquote(content[:end])
+	if err != nil {
+		return
+	}
+	value, err = yarnUnquote(strings.TrimSpace(content[end:]))
+
+	return
+}
+
+// closingQuote returns the index of the quote that ends the string at the
+// start of s, or -1
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+
+	return -1
+}
+
+func yarnUnquote(s string) (string, error) {
+	if strings.HasPrefix(s, "\"") {
+		return strconv.Unquote(s)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,206 @@
+package npm
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testYarnLock = `# THIS IS AN AUTOGENERATED FILE. DO NOT EDIT THIS FILE DIRECTLY.
+# yarn lockfile v1
+
+
+"@scope/pkg@^1.0.0", "@scope/pkg@^1.2.0":
+  version "1.2.3"
+  resolved "https://registry.yarnpkg.com/@scope/pkg/-/pkg-1.2.3.tgz#2fd4e1c67a2d28fced849ee1bb76e7391b93eb12"
+  dependencies:
+    left-pad "~1.3.0"
+  optionalDependencies:
+    fsevents "^2.0.0"
+
+left-pad@~1.3.0:
+  version "1.3.0"
+  resolved "https://registry.yarnpkg.com/left-pad/-/left-pad-1.3.0.tgz#5b8a3a7765dfe001261dde915589e782f8c94d1e"
+  integrity sha512-XI5MPzVNApjAyhQzphX8BkmKsKUxD4LdyK24iZeQD0k5y4wjbUiHJeBGq4JnDpKNxLOH7csmE3OmwF8blWkXIQ==
+
+pad@npm:left-pad@^1.0.0:
+  version "1.3.0"
+  resolved "https://registry.yarnpkg.com/left-pad/-/left-pad-1.3.0.tgz"
+
+"local@file:./local":
+  version "0.0.1"
+`
+
+func TestParseYarnLock(t *testing.T) {
+	entries, err := parseYarnLock(strings.NewReader(testYarnLock))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec      string
+		name      string
+		version   string
+		resolved  string
+		integrity string
+	}{
+		{"@scope/pkg@^1.0.0", "@scope/pkg", "1.2.3", "https://registry.yarnpkg.com/@scope/pkg/-/pkg-1.2.3.tgz", "sha1-L9ThxnotKPzthJ7hu3bnORuT6xI="},
+		{"@scope/pkg@^1.2.0", "@scope/pkg", "1.2.3", "https://registry.yarnpkg.com/@scope/pkg/-/pkg-1.2.3.tgz", "sha1-L9ThxnotKPzthJ7hu3bnORuT6xI="},
+		{"left-pad@~1.3.0", "left-pad", "1.3.0", "https://registry.yarnpkg.com/left-pad/-/left-pad-1.3.0.tgz", "sha512-XI5MPzVNApjAyhQzphX8BkmKsKUxD4LdyK24iZeQD0k5y4wjbUiHJeBGq4JnDpKNxLOH7csmE3OmwF8blWkXIQ=="},
+		{"pad@npm:left-pad@^1.0.0", "pad", "1.3.0", "https://registry.yarnpkg.com/left-pad/-/left-pad-1.3.0.tgz", ""},
+		{"local@file:./local", "local", "file:./local", "", ""},
+	}
+
+	for _, test := range tests {
+		entry, ok := entries[test.spec]
+		if !ok {
+			t.Errorf("no entry for %s", test.spec)
+			continue
+		}
+		got := []string{entry.name, entry.version, entry.resolved, entry.integrity}
+		want := []string{test.name, test.version, test.resolved, test.integrity}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %q, want %q", test.spec, got, want)
+		}
+	}
+
+	if len(entries) != len(tests) {
+		t.Errorf("got %d entries, want %d", len(entries), len(tests))
+	}
+
+	scoped := entries["@scope/pkg@^1.0.0"]
+	if scoped != entries["@scope/pkg@^1.2.0"] {
+		t.Error("specs sharing a block should share an entry")
+	}
+	if !reflect.DeepEqual(scoped.dependencies, map[string]string{"left-pad": "~1.3.0"}) {
+		t.Errorf("dependencies: got %v", scoped.dependencies)
+	}
+	if !reflect.DeepEqual(scoped.optionalDeps, map[string]string{"fsevents": "^2.0.0"}) {
+		t.Errorf("optionalDependencies: got %v", scoped.optionalDeps)
+	}
+}
+
+func TestParseYarnLockErrors(t *testing.T) {
+	tests := []string{
+		"\"unterminated@^1.0.0:\n  version \"1.0.0\"\n",
+		"noversion@^1.0.0:\n  version\n",
+		"@^1.0.0:\n  version \"1.0.0\"\n",
+		"plain@^1.0.0 \"1.0.0\"\n",
+	}
+
+	for _, lock := range tests {
+		if _, err := parseYarnLock(strings.NewReader(lock)); err == nil {
+			t.Errorf("parseYarnLock(%q) succeeded", lock)
+		}
+	}
+}
+
+// yarnLayout flattens a module tree into name@version paths
+func yarnLayout(deps []Module, prefix string, flags bool) (paths []string) {
+	for _, m := range deps {
+		path := prefix + m.Name + "@" + m.Version
+		if flags && m.Dev {
+			path += " dev"
+		}
+		if flags && m.Optional {
+			path += " optional"
+		}
+		paths = append(paths, path)
+		paths = append(paths, yarnLayout(m.Dependencies, prefix+m.Name+"/", flags)...)
+	}
+
+	return
+}
+
+func yarnBlock(name string, version string, deps ...string) string {
+	block := name + "@^" + version + ":\n  version \"" + version + "\"\n"
+	if len(deps) > 0 {
+		block += "  dependencies:\n"
+		for _, dep := range deps {
+			at := strings.LastIndex(dep, "@")
+			block += "    " + dep[:at] + " \"" + dep[at+1:] + "\"\n"
+		}
+	}
+
+	return block + "\n"
+}
+
+func TestParseYarnAppHoisting(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		lock     string
+		layout   []string
+	}{
+		{
+			name:     "flat",
+			manifest: `{"dependencies": {"a": "^1.0.0", "b": "^1.0.0"}}`,
+			lock:     yarnBlock("a", "1.0.0") + yarnBlock("b", "1.0.0", "c@^1.0.0") + yarnBlock("c", "1.0.0", "a@^1.0.0"),
+			layout:   []string{"a@1.0.0", "b@1.0.0", "c@1.0.0"},
+		},
+		{
+			name:     "conflicting versions nest",
+			manifest: `{"dependencies": {"a": "^1.0.0", "b": "^1.0.0"}}`,
+			lock:     yarnBlock("a", "1.0.0") + yarnBlock("a", "2.0.0") + yarnBlock("b", "1.0.0", "a@^2.0.0", "c@^1.0.0") + yarnBlock("c", "1.0.0", "a@^1.0.0"),
+			layout:   []string{"a@1.0.0", "b@1.0.0", "b/a@2.0.0", "c@1.0.0"},
+		},
+		{
+			name:     "packages found above aren't shadowed",
+			manifest: `{"dependencies": {"p": "^1.0.0", "q": "^2.0.0", "w": "^2.0.0", "x": "^1.0.0"}}`,
+			lock: yarnBlock("p", "1.0.0", "q@^1.0.0", "w@^1.0.0") + yarnBlock("q", "1.0.0", "x@^1.0.0") + yarnBlock("q", "2.0.0") +
+				yarnBlock("w", "1.0.0", "x@^2.0.0") + yarnBlock("w", "2.0.0") + yarnBlock("x", "1.0.0") + yarnBlock("x", "2.0.0"),
+			layout: []string{"p@1.0.0", "p/q@1.0.0", "p/w@1.0.0", "p/w/x@2.0.0", "q@2.0.0", "w@2.0.0", "x@1.0.0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(test.manifest), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			app, err := ParseYarnApp(strings.NewReader(test.lock), dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := yarnLayout(app.Dependencies, "", false); !reflect.DeepEqual(got, test.layout) {
+				t.Errorf("got layout\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.layout, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseYarnAppFlags(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `{"dependencies": {"a": "^1.0.0"}, "devDependencies": {"d": "^1.0.0"}, "optionalDependencies": {"o": "^1.0.0"}}`
+	err := ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(manifest), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := yarnBlock("a", "1.0.0", "s@^1.0.0") + yarnBlock("d", "1.0.0", "s@^1.0.0", "t@^1.0.0") + yarnBlock("o", "1.0.0") +
+		yarnBlock("s", "1.0.0") + yarnBlock("t", "1.0.0")
+	app, err := ParseYarnApp(strings.NewReader(lock), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a@1.0.0", "d@1.0.0 dev", "o@1.0.0 optional", "s@1.0.0", "t@1.0.0 dev"}
+	if got := yarnLayout(app.Dependencies, "", true); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "package.json"), []byte(`{"dependencies": {"a": "^1.0.0"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseYarnApp(strings.NewReader(yarnBlock("a", "1.0.0", "missing@^1.0.0")), dir)
+	if err == nil || !strings.Contains(err.Error(), "missing@^1.0.0") {
+		t.Errorf("got %v for a dependency missing from yarn.lock", err)
+	}
+}
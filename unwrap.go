@@ -1,32 +1,129 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/alunny/npm-unwrap/npm"
 )
 
 const Version = "0.0.1"
 
+var (
+	production    = flag.Bool("production", false, "do not install devDependencies")
+	ignoreScripts = flag.Bool("ignore-scripts", false, "do not run any lifecycle scripts")
+	scriptPolicy  = flag.String("script-policy", "", "only run lifecycle scripts for packages allowed by this JSON file")
+	scriptJobs    = flag.Int("script-concurrency", 0, "maximum number of lifecycle scripts to run at once (default: number of CPUs)")
+	scriptLogDir  = flag.String("script-log-dir", "", "write the output of each lifecycle script to a file in this directory")
+	scriptTimeout = flag.Duration("script-timeout", 0, "kill any lifecycle script running longer than this (e.g. 10m)")
+	scriptsLimit  = flag.Duration("scripts-total-timeout", 0, "limit on the wall-clock time of the whole script phase")
+	linkLocal     = flag.Bool("link-local", false, "symlink file: directory dependencies instead of copying them")
+	linkPrefix    = flag.String("link-prefix", "", "also link top-level bins into DIR/bin and man pages into DIR/share/man")
+	binWrappers   = flag.Bool("bin-wrappers", false, "write bins as wrapper scripts instead of symlinks")
+	binShims      = flag.Bool("bin-shims", false, "write .cmd and .ps1 shims next to bin wrappers (implies --bin-wrappers)")
+	sandbox       = flag.Bool("sandbox-scripts", false, "run lifecycle scripts without network access and with write access only to their package (Linux only)")
+	strictGitRefs = flag.Bool("strict-git-refs", false, "fail on git dependencies the lockfile doesn't pin to a commit, instead of warning")
+	nativeGit     = flag.Bool("native-git", false, "fetch git dependencies in-process, as when git is not installed")
+	gitLFS        = flag.Bool("git-lfs", false, "download the Git LFS files of git dependencies, instead of failing on them")
+	cacheDir      = flag.String("cache-dir", npm.CacheDir, "keep downloads in this directory between installs")
+	cacheMaxSize  = flag.String("cache-max-size", "", "after installing, evict the least recently used cache entries until the cache is smaller than this (e.g. 2G)")
+	remoteCache   = flag.String("remote-cache", "", "check this HTTP cache for tarballs before the registry, and upload the ones downloaded from it")
+	remoteCacheRO = flag.Bool("remote-cache-read-only", false, "only download from the remote cache, never upload to it")
+	registryConf  = flag.String("registry-config", "", "rewrite tarball URLs to mirrors, fall back to other registries and set up HTTP connections as this JSON file says")
+)
+
+func installOptions() (opts npm.InstallOptions) {
+	if *scriptPolicy != "" {
+		policy, err := npm.LoadScriptPolicy(*scriptPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Scripts = policy
+	} else {
+		opts.Scripts = &npm.ScriptPolicy{}
+	}
+	opts.Scripts.IgnoreAll = *ignoreScripts
+	opts.Scripts.Sandbox = *sandbox
+	opts.ScriptConcurrency = *scriptJobs
+	opts.ScriptLogDir = *scriptLogDir
+	opts.ScriptTimeout = *scriptTimeout
+	opts.ScriptPhaseTimeout = *scriptsLimit
+	opts.BaseDir = "."
+	opts.LinkLocalDirs = *linkLocal
+	opts.LinkPrefix = *linkPrefix
+	opts.BinWrappers = *binWrappers || *binShims
+	opts.BinShims = *binShims
+	opts.Report = &npm.ScriptReport{}
+
+	return
+}
+
 func install() {
-	shrinkwrapReader, err := os.Open("./npm-shrinkwrap.json")
+	app, lockfile, err := npm.LoadApp(".")
 	if err != nil {
-		log.Fatal("could not read ./npm-shrinkwrap.json")
+		log.Fatal(err)
 	}
-	defer shrinkwrapReader.Close()
+	log.Printf("reading %s\n", lockfile)
 
-	app, err := npm.ParseApp(shrinkwrapReader)
+	if *production {
+		app.OmitDev()
+	}
 
+	err = app.SkipIncompatible()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// npm.PrintApp(app)
 
+	opts := installOptions()
+
+	var maxSize int64
+	if *cacheMaxSize != "" {
+		maxSize, err = npm.ParseSize(*cacheMaxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// other installs may share the cache, but nothing may be removed from
+	// it while this one is using it
+	unlockCache, err := npm.LockCache(npm.CacheDir, false)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	npm.RequirePinnedGitRefs = *strictGitRefs
+	npm.NativeGit = *nativeGit
+	npm.GitLFS = *gitLFS
+	if *remoteCache != "" {
+		npm.RemoteCache = npm.NewHTTPCache(*remoteCache, *remoteCacheRO)
+	}
+	if *registryConf != "" {
+		npm.Registries, err = npm.LoadRegistryConfig(*registryConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 	downloadDir := app.DownloadDependencies()
-	app.InstallFromTmpdir(downloadDir, "./node_modules")
+	err = app.InstallFromTmpdir(downloadDir, "./node_modules", opts)
+	unlockCache()
+	npm.PrintScriptReport(opts.Report)
+	npm.PrintSkippedScripts(opts.Scripts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if maxSize > 0 {
+		err = npm.EvictCache(npm.CacheDir, maxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// app.DownloadDependencies()
 	// app.Install()
@@ -35,15 +132,82 @@ func install() {
 	// prune afterwards
 }
 
+// stringList collects the values of a flag given more than once
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func cache(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: npm-unwrap cache ls|verify|clean [package...]|gc [--keep-for lockfile...] [--older-than duration]")
+	}
+
+	var err error
+	switch args[0] {
+	case "ls":
+		var entries []npm.CacheEntry
+		entries, err = npm.ListCache(npm.CacheDir)
+		if err == nil {
+			npm.PrintCache(entries)
+		}
+	case "verify":
+		err = npm.VerifyCache(npm.CacheDir)
+	case "clean":
+		err = npm.CleanCache(npm.CacheDir, args[1:])
+	case "gc":
+		var keepFor stringList
+		gcFlags := flag.NewFlagSet("cache gc", flag.ExitOnError)
+		gcFlags.Var(&keepFor, "keep-for", "keep the entries this lockfile needs (may be repeated, or followed by more lockfiles)")
+		olderThan := gcFlags.Duration("older-than", 0, "remove entries fetched longer ago than this (e.g. 720h)")
+		// lockfiles can follow --keep-for, before or after other flags
+		for rest := args[1:]; len(rest) > 0; rest = gcFlags.Args()[1:] {
+			gcFlags.Parse(rest)
+			if gcFlags.NArg() == 0 {
+				break
+			}
+			keepFor = append(keepFor, gcFlags.Arg(0))
+		}
+
+		var cutoff time.Time
+		if *olderThan > 0 {
+			cutoff = time.Now().Add(-*olderThan)
+		}
+		err = npm.GCCache(npm.CacheDir, keepFor, cutoff)
+	default:
+		log.Fatalf("unrecognized cache command: %s\n", args[0])
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	if len(os.Args) > 1 {
-		cmd := os.Args[1]
+	if len(os.Args) > 1 && os.Args[1] == npm.SandboxCommand {
+		log.Fatal(npm.RunSandboxed(os.Args[2:]))
+	}
+
+	flag.Parse()
+	npm.CacheDir = *cacheDir
+
+	if flag.NArg() > 0 {
+		cmd := flag.Arg(0)
 
 		if cmd == "version" {
 			fmt.Printf("%s\n", Version)
 			os.Exit(0)
+		} else if cmd == "cache" {
+			cache(flag.Args()[1:])
+			os.Exit(0)
 		} else {
 			log.Fatalf("unrecognized command: %s\n", cmd)
 		}